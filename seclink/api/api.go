@@ -4,12 +4,21 @@ import (
 	"embed"
 	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
-	"os"
+	"net/netip"
+	"path"
 	"path/filepath"
+	"seclink/auth"
+	"seclink/crypt"
 	"seclink/db"
 	"seclink/log"
+	"seclink/storage"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/a-h/templ"
 	"github.com/gofiber/contrib/fiberzerolog"
@@ -19,15 +28,36 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/mazen160/go-random"
 	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
 )
 
 //go:embed resources/*
 var res embed.FS
 
 type SCreateLink struct {
-	Filepath  string        `json:"path"`
-	TtlString string        `json:"ttl"`
-	Ttl       time.Duration `json:"-"`
+	Filepath           string        `json:"path"`
+	TtlString          string        `json:"ttl"`
+	Ttl                time.Duration `json:"-"`
+	MaxDownloadsString string        `json:"maxdownloads"`
+	MaxDownloads       int           `json:"-"`
+	Notes              string        `json:"notes"`
+	Passphrase         string        `json:"passphrase"`
+	Archive            string        `json:"archive"`   // Format to share a folder as, zip when not given
+	Paths              SStringList   `json:"paths"`     // Files of a bundle link, instead of path
+	E2E                bool          `json:"e2e"`       // The file at path was encrypted in the browser, see e2e.go
+	Landing            SFormBool     `json:"landing"`   // Downloads start from a landing page, see landing.go
+	Message            string        `json:"message"`   // Shown to recipients on the page of the link
+	RateLimitString    string        `json:"ratelimit"` // Bytes a second for all downloads of the link together, such as 2MB
+	RateLimit          int64         `json:"-"`
+}
+
+// Fields are pointers so a PATCH only touches what the client sent
+type SUpdateLink struct {
+	ExtendString       *string `json:"extend"`
+	MaxDownloadsString *string `json:"maxdownloads"`
+	Notes              *string `json:"notes"`
+	RateLimitString    *string `json:"ratelimit"`
+	Unlock             bool    `json:"unlock"` // Clears a lock from too many wrong passphrases
 }
 
 type ISeclinkApi interface {
@@ -35,8 +65,23 @@ type ISeclinkApi interface {
 }
 
 type SSeclinkApi struct {
-	db            db.ISeclinkDb
-	dataFilesPath string // The root data path is stored globally, but the files sub-folder is a constant, this stores that path so we dont have to repeatedly determine the sub-folder
+	db                db.ISeclinkDb
+	passwordProviders []auth.IPasswordProvider
+	oidcProvider      *auth.SOidcProvider // Discovered on first use, see getOidcProvider
+	oidcMutex         sync.Mutex
+	store             storage.IStorage // Where the shared files live, see storage.backend
+	uploadsPath       string           // Staging folder for unfinished tus uploads, outside the files directory so they are never listed
+	uploadLocks       sync.Map
+	quotaMutex        sync.Mutex // Held while an upload is checked against the quotas and reserved
+	storeUsed         int64      // Bytes in storage, kept between walks, see storeUsage
+	storeUsedAt       time.Time  // When storage was last walked for storeUsed
+	storeUsedMutex    sync.Mutex
+	bandwidth         *rate.Limiter            // Shared by every download, nil when bandwidth.global is not set
+	linkLimiters      map[string]*SLinkLimiter // Buckets of links with a rate limit that are being downloaded
+	linkLimitersMutex sync.Mutex
+	trustedProxies    []netip.Prefix              // Proxies whose forwarding header is believed, see clientIP
+	failures          map[string]*SClientFailures // Recent failed requests of public clients, see recordFailure
+	failuresMutex     sync.Mutex
 }
 
 // Starts the api server
@@ -44,20 +89,63 @@ func (a *SSeclinkApi) Start() error {
 
 	l := log.Get()
 
+	if viper.GetBool("auth.enabled") && viper.GetBool("auth.local.enabled") && !viper.GetBool("auth.oidc.enabled") {
+		users, err := a.db.GetAllUsers()
+		if err == nil && len(users) == 0 {
+			l.Warn().Msg("Admin authentication is enabled but there are no users, add one with `seclink user add`")
+		}
+	}
+
+	// Fail now rather than on the first upload when encryption can not work
+	if crypt.Enabled() {
+		_, err := crypt.Master()
+		if err != nil {
+			l.Error().Err(err).Msg("Encryption at rest is enabled but the master key could not be loaded")
+			return err
+		}
+	}
+
+	a.bandwidth = newByteLimiter(configSize("bandwidth.global"))
+
+	var err error
+	a.trustedProxies, err = parseTrustedProxies(viper.GetStringSlice("protection.trustedproxies"))
+	if err != nil {
+		l.Error().Err(err).Msg("Invalid trusted proxies")
+		return err
+	}
+	_, _, err = banTimes()
+	if err != nil {
+		l.Error().Err(err).Msg("Invalid ban times")
+		return err
+	}
+
 	// Prepare HTML template rendering system from embedded resources
 	httpFS := http.FS(res)
 
 	// Public API and port
-	app := fiber.New()
+	app := fiber.New(fiber.Config{ErrorHandler: a.PublicErrorHandler})
 	app.Use(fiberzerolog.New(fiberzerolog.Config{
 		Logger: &l,
 	}))
 	app.Use(recover.New())
+	app.Use("/static", filesystem.New(filesystem.Config{
+		Root:       httpFS,
+		PathPrefix: "resources/static",
+	}))
+	if rateLimiter := a.linkRateLimiter(); rateLimiter != nil {
+		app.Use("/links", rateLimiter)
+	}
+	app.Use("/links", a.protectLinks)
 	app.Get("/links/:id", a.GetLink)
+	app.Post("/links/:id", a.GetLink)
+	app.Post("/links/:id/unlock", a.UnlockLink)
+	app.Get("/links/:id/files/:index", a.GetBundleFile)
+	app.Get("/links/:id/zip", a.GetBundleArchive)
+	app.Get("/links/:id/data", a.GetE2EData)
 
 	// Private admin API and port
-	// TODO: Make the BodyLimit in MB a configurable option
-	admin := fiber.New(fiber.Config{BodyLimit: 2000 * 1024 * 1024}) // Ensure we load the HTML template rendering engine
+	// Request bodies are streamed so tus uploads go to disk as they arrive
+	admin := fiber.New(fiber.Config{BodyLimit: adminBodyLimit(), StreamRequestBody: true}) // Ensure we load the HTML template rendering engine
 	admin.Use("/static", filesystem.New(filesystem.Config{
 		Root:       httpFS,
 		PathPrefix: "resources/static",
@@ -66,16 +154,56 @@ func (a *SSeclinkApi) Start() error {
 	admin.Use(fiberzerolog.New(fiberzerolog.Config{
 		Logger: &l,
 	}))
-	app.Use(recover.New())
-	admin.Get("/admin", a.AdminUI)
-	admin.Post("/api/v1/links/share", a.CreateLink)
-	admin.Post("/api/v1/files/upload", a.UploadFile)
+	admin.Use(recover.New())
+	admin.Use(a.RequireAuth)
+	admin.Get("/login", a.LoginPage)
+	admin.Post("/login", a.Login)
+	admin.Post("/logout", a.Logout)
+	if viper.GetBool("auth.oidc.enabled") {
+		admin.Get("/auth/oidc/login", a.OidcLogin)
+		admin.Get("/auth/oidc/callback", a.OidcCallback)
+	}
+	admin.Get("/", func(c *fiber.Ctx) error {
+		return c.Redirect("/admin")
+	})
+	admin.Get("/admin", requireScope(auth.ScopeLinksRead), a.AdminUI)
+	admin.Get("/admin/tokens", requireScope(auth.ScopeTokensManage), a.AdminTokensUI)
+	admin.Get("/admin/bundle/items", requireScope(auth.ScopeLinksCreate), a.BundleItems)
+	admin.Get("/api/v1/links", requireScope(auth.ScopeLinksRead), a.ListLinks)
+	admin.Post("/api/v1/links/share", requireScope(auth.ScopeLinksCreate), a.CreateLink)
+	admin.Delete("/api/v1/links/:id", requireScope(auth.ScopeLinksManage), a.RevokeLink)
+	admin.Patch("/api/v1/links/:id", requireScope(auth.ScopeLinksManage), a.UpdateLink)
+	admin.Post("/api/v1/files/upload", requireScope(auth.ScopeFilesWrite), a.UploadFile)
+	admin.Options("/api/v1/uploads", requireScope(auth.ScopeFilesWrite), requireTusVersion, a.TusOptions)
+	admin.Post("/api/v1/uploads", requireScope(auth.ScopeFilesWrite), requireTusVersion, a.CreateUpload)
+	admin.Head("/api/v1/uploads/:id", requireScope(auth.ScopeFilesWrite), requireTusVersion, a.HeadUpload)
+	admin.Patch("/api/v1/uploads/:id", requireScope(auth.ScopeFilesWrite), requireTusVersion, a.PatchUpload)
+	admin.Delete("/api/v1/uploads/:id", requireScope(auth.ScopeFilesWrite), requireTusVersion, a.TerminateUpload)
+	admin.Get("/api/v1/files", requireScope(auth.ScopeFilesRead), a.ListFiles)
+	admin.Get("/api/v1/usage", requireScope(auth.ScopeFilesRead), a.GetUsage)
+	admin.Post("/api/v1/files/mkdir", requireScope(auth.ScopeFilesWrite), a.MakeDirectory)
+	admin.Post("/api/v1/files/move", requireScope(auth.ScopeFilesWrite), a.MoveFile)
+	admin.Delete("/api/v1/files/*", requireScope(auth.ScopeFilesDelete), a.DeleteFile)
+	admin.Get("/api/v1/tokens", requireScope(auth.ScopeTokensManage), a.GetTokens)
+	admin.Post("/api/v1/tokens", requireScope(auth.ScopeTokensManage), a.CreateToken)
+	admin.Delete("/api/v1/tokens/:id", requireScope(auth.ScopeTokensManage), a.RevokeToken)
+	admin.Get("/admin/audit", requireScope(auth.ScopeAuditRead), a.AdminAuditUI)
+	admin.Get("/api/v1/audit", requireScope(auth.ScopeAuditRead), a.GetAuditEvents)
+	admin.Get("/admin/bans", requireScope(auth.ScopeBansManage), a.AdminBansUI)
+	admin.Get("/api/v1/bans", requireScope(auth.ScopeBansManage), a.GetBans)
+	admin.Delete("/api/v1/bans/:ip", requireScope(auth.ScopeBansManage), a.ClearBan)
+
+	// Clear out uploads that were abandoned part way
+	go a.expireUploads()
+
+	// Forget failed public requests that can no longer lead to a ban
+	go a.expireFailures()
 
 	// Start admin port listening, as a goroutine
 	go admin.Listen(fmt.Sprintf("0.0.0.0:%d", viper.GetInt("server.adminport")))
 
 	// Start public port
-	err := app.Listen(fmt.Sprintf("0.0.0.0:%d", viper.GetInt("server.port")))
+	err = app.Listen(fmt.Sprintf("0.0.0.0:%d", viper.GetInt("server.port")))
 	if err != nil {
 		return err
 	}
@@ -84,51 +212,201 @@ func (a *SSeclinkApi) Start() error {
 
 }
 
-// If link exists and has not expired then return downloaded file
+// If link exists and has not expired then return downloaded file. Landing
+// links only download on a POST, a GET gets their landing page
 func (a *SSeclinkApi) GetLink(c *fiber.Ctx) error {
-	l := log.Get()
+	id := c.Params("id")
+	record, err := a.usableLink(c, id)
+	if record == nil {
+		return err
+	}
 
-	if id := c.Params("id"); id != "" {
+	// Bundles list their files rather than downloading straight away
+	if len(record.Paths) > 0 {
+		return a.renderBundle(c, id, *record)
+	}
 
-		// See if the ID exists in the database
-		filePath, err := a.db.Get([]byte(id))
-		if err != nil {
-			l.Error().
-				Err(err).
-				Str("ID", id).
-				Msg("Could not find id in database")
-			return err
+	object, err := a.linkFile(c, id, record.Path)
+	if object == nil {
+		return err
+	}
+
+	// End-to-end links get the page that decrypts them, it fetches the data itself
+	if record.E2E {
+		return a.renderE2E(c, id, *record)
+	}
+
+	// A download being resumed is not a link preview, it gets the file
+	if record.Landing && c.Method() != fiber.MethodPost && !a.resuming(c, id) {
+		return a.renderLanding(c, id, *record, *object)
+	}
+
+	// Folders are packed as they stream, so they can not be resumed
+	if record.Archive != "" {
+		if c.Method() != fiber.MethodHead {
+			consumed, err := a.consumeDownload(c, id, false)
+			if consumed == nil {
+				return err
+			}
+			a.logDownload(c, id, record.Path, consumed, "Downloading folder")
 		}
+		return a.streamArchive(c, id, *record)
+	}
 
-		// Check the file exists
-		absoluteFilePath := filepath.Join(a.dataFilesPath, string(filePath))
-		exists, err := pathExists(absoluteFilePath)
-		if err != nil {
-			l.Error().
-				Err(err).
-				Str("ID", id).
-				Str("AbsoluteFilePath", absoluteFilePath).
-				Msg("Error occurred checking if file exists")
+	delivery, err := a.prepareDelivery(c, id, *record, *object)
+	if delivery == nil {
+		return err
+	}
+	if delivery.Counted {
+		consumed, err := a.consumeDownload(c, id, true)
+		if consumed == nil {
 			return err
 		}
-		if !exists {
-			l.Error().
-				Str("ID", id).
-				Str("AbsoluteFilePath", absoluteFilePath).
-				Msg("File does not exist")
-			return err
+		a.allowResume(c, id, delivery)
+		a.logDownload(c, id, record.Path, consumed, "Downloading file")
+	}
+	if redirected, err := a.presignedDownload(c, delivery, path.Base(record.Path)); redirected || err != nil {
+		return err
+	}
+	a.setDigestHeaders(c, record.Path)
+	return a.sendContent(c, delivery, path.Base(record.Path))
+}
+
+// Logs and audits a download of rel from link id that was just counted
+func (a *SSeclinkApi) logDownload(c *fiber.Ctx, id string, rel string, consumed *db.SLinkRecord, msg string) {
+	l := log.Get()
+
+	l.Info().
+		Str("Path", rel).
+		Str("ID", id).
+		Int("Downloads", consumed.Downloads).
+		Int("MaxDownloads", consumed.MaxDownloads).
+		Msg(msg)
+	a.auditAs(c, "", db.AuditLinkDownloaded, id, rel)
+}
+
+// Loads a link for a public request and checks it can be used. When it can
+// not a nil record is returned, along with the error saying why or the result
+// of rendering the unlock page
+func (a *SSeclinkApi) usableLink(c *fiber.Ctx, id string) (*db.SLinkRecord, error) {
+	l := log.Get()
+
+	// See if the ID exists in the database
+	record, err := a.db.GetLink(id)
+	if err == db.ErrLinkNotFound {
+		linkErr := a.missingLink(id)
+		l.Info().
+			Str("ID", id).
+			Str("Reason", linkErr.Code).
+			Msg("Link is not available")
+		a.auditAs(c, "", db.AuditLinkDenied, id, strings.ToLower(linkErr.Title))
+		return nil, linkErr
+	}
+	if err != nil {
+		l.Error().
+			Err(err).
+			Str("ID", id).
+			Msg("Could not read link from database")
+		return nil, err
+	}
+
+	// The client that took the last download may still fetch the rest of it,
+	// and of a bundle the rest of its files
+	if record.Exhausted() && !a.resuming(c, id) && !(len(record.Paths) > 0 && a.inSession(c, id)) {
+		a.auditAs(c, "", db.AuditLinkDenied, id, "exhausted")
+		return nil, ErrLinkExhausted
+	}
+	if record.Locked {
+		a.auditAs(c, "", db.AuditLinkDenied, id, "locked")
+		return nil, ErrLinkLocked
+	}
+
+	// Protected links need the passphrase before anything is sent
+	if record.PassphraseHash != "" && !a.isUnlocked(c, id) {
+		return nil, a.Render(c, PublicUnlockPage(id, ""))
+	}
+
+	return &record, nil
+}
+
+// Why the link id can not be found, it may have expired or been removed
+func (a *SSeclinkApi) missingLink(id string) *SLinkError {
+	l := log.Get()
+
+	gone, err := a.db.GetGoneLink(id)
+	if err != nil {
+		if err != db.ErrLinkNotFound {
+			l.Error().Err(err).Str("ID", id).Msg("Could not read why a link went away")
 		}
+		return ErrLinkNotFound
+	}
+	return goneLinkError(gone)
+}
 
-		l.Info().Str("AbsoluteFilePath", absoluteFilePath).Str("ID", id).Msg("Downloading file")
-		c.Download(absoluteFilePath, string(filePath))
+// Looks up a file shared by link id, checking its path again in case a
+// symlink was swapped in since the link was made. Returns nil and the error
+// to respond with when it can not be sent
+func (a *SSeclinkApi) linkFile(c *fiber.Ctx, id string, rel string) (*storage.SObject, error) {
+	l := log.Get()
 
-	} else {
+	object, err := a.store.Stat(rel)
+	if errors.Is(err, ErrUnsafePath) {
+		l.Error().
+			Err(err).
+			Str("ID", id).
+			Str("Path", rel).
+			Msg("Link path resolves outside the files directory")
+		a.auditAs(c, "", db.AuditLinkDenied, id, "unsafe path")
+		return nil, ErrLinkNotFound
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		l.Error().
+			Str("ID", id).
+			Str("Path", rel).
+			Msg("File does not exist")
+		a.auditAs(c, "", db.AuditLinkDenied, id, "file removed")
+		return nil, ErrFileMissing
+	}
+	if err != nil {
 		l.Error().
-			Msg("An empty id was provided on the route")
-		return fmt.Errorf("an empty id was provided on the route")
+			Err(err).
+			Str("ID", id).
+			Str("Path", rel).
+			Msg("Error occurred checking if file exists")
+		return nil, err
 	}
+	return &object, nil
+}
 
-	return nil
+// Counts a download against link id, this fails with ErrLinkExhausted once
+// the link has no downloads left. A resumable download that takes the last
+// one keeps the link around for links.resumettl so it can be finished
+func (a *SSeclinkApi) consumeDownload(c *fiber.Ctx, id string, resumable bool) (*db.SLinkRecord, error) {
+	l := log.Get()
+
+	var keep time.Duration
+	if resumable {
+		keep = viper.GetDuration("links.resumettl")
+	}
+	record, err := a.db.ConsumeDownload(id, keep)
+	if err == db.ErrLinkExhausted {
+		l.Info().
+			Str("ID", id).
+			Msg("Link has no downloads left")
+		a.auditAs(c, "", db.AuditLinkDenied, id, "exhausted")
+		return nil, ErrLinkExhausted
+	}
+	if err == db.ErrLinkNotFound {
+		return nil, a.missingLink(id)
+	}
+	if err != nil {
+		l.Error().
+			Err(err).
+			Str("ID", id).
+			Msg("Could not record download")
+		return nil, err
+	}
+	return &record, nil
 }
 
 func (a *SSeclinkApi) CreateLink(c *fiber.Ctx) error {
@@ -144,21 +422,65 @@ func (a *SSeclinkApi) CreateLink(c *fiber.Ctx) error {
 
 	// Convert TTL string to time.Duration
 	input.Ttl, err = time.ParseDuration(input.TtlString)
-	if err != nil {
+	if err != nil || input.Ttl <= 0 {
 		l.Error().
 			Err(err).
 			Str("ttlstring", input.TtlString).
-			Msg("Could not convert time string to duration")
-		return err
+			Msg("Could not convert time string to a positive duration")
+		return fiber.NewError(fiber.StatusBadRequest, "ttl must be a positive duration")
 	}
 
-	l.Trace().Interface("input", input).Msg("Input")
+	// An empty download limit means unlimited
+	if input.MaxDownloadsString != "" {
+		input.MaxDownloads, err = strconv.Atoi(input.MaxDownloadsString)
+		if err != nil || input.MaxDownloads < 0 {
+			l.Error().
+				Err(err).
+				Str("maxdownloadsstring", input.MaxDownloadsString).
+				Msg("Could not convert max downloads to a number")
+			return fiber.NewError(fiber.StatusBadRequest, "max downloads must be a whole number, 0 for unlimited")
+		}
+	}
 
-	absoluteFilePath := filepath.Join(a.dataFilesPath, input.Filepath)
-	exists, err := pathExists(absoluteFilePath)
+	input.RateLimit, err = parseRateLimit(input.RateLimitString)
 	if err != nil {
-		l.Error().Err(err).Str("FilePath", input.Filepath).Msg("An error occurred determining if filepath exists")
-		return err
+		l.Error().
+			Err(err).
+			Str("ratelimitstring", input.RateLimitString).
+			Msg("Could not convert rate limit to a size")
+		return fiber.NewError(fiber.StatusBadRequest, "rate limit must be a size such as 500KB or 2MiB")
+	}
+
+	input.Message = strings.TrimSpace(input.Message)
+	if utf8.RuneCountInString(input.Message) > maxLinkMessage {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("message can be at most %d characters", maxLinkMessage))
+	}
+
+	l.Trace().Interface("input", input).Msg("Input")
+
+	// Bundles share a hand picked list of files instead of a single path
+	var exists bool
+	if len(input.Paths) > 0 {
+		input.Paths, err = a.checkBundlePaths(input.Paths)
+		if err != nil {
+			return err
+		}
+		input.Filepath = ""
+		input.Archive = ""
+		input.Landing = false // The bundle page already waits for a click
+		exists = true
+	} else {
+		exists, err = a.checkSharePath(&input)
+		if err != nil {
+			return err
+		}
+	}
+	if input.E2E {
+		err = a.checkE2EFile(input, exists)
+		if err != nil {
+			return err
+		}
+		input.Landing = false // So does the page that decrypts it
 	}
 
 	if exists {
@@ -169,56 +491,308 @@ func (a *SSeclinkApi) CreateLink(c *fiber.Ctx) error {
 		}
 		l.Info().Str("id", id).Msg("Generated ID")
 
-		err = a.db.Set([]byte(id), []byte(input.Filepath), input.Ttl)
+		// Only the slow hash of the passphrase is kept
+		var passphraseHash string
+		if input.Passphrase != "" {
+			passphraseHash, err = auth.HashPassword(input.Passphrase)
+			if err != nil {
+				l.Error().Err(err).Str("ID", id).Msg("An error occurred hashing the passphrase")
+				return err
+			}
+		}
+
+		err = a.db.SetLink(id, db.SLinkRecord{
+			Path:           input.Filepath,
+			CreatedBy:      getPrincipal(c).Name,
+			CreatedAt:      time.Now(),
+			Ttl:            input.Ttl,
+			MaxDownloads:   input.MaxDownloads,
+			Notes:          input.Notes,
+			Archive:        input.Archive,
+			Paths:          input.Paths,
+			PassphraseHash: passphraseHash,
+			E2E:            input.E2E,
+			Landing:        bool(input.Landing),
+			Message:        input.Message,
+			RateLimit:      input.RateLimit,
+		}, input.Ttl)
 
 		if err != nil {
 			l.Error().Err(err).Str("FilePath", input.Filepath).Str("ID", id).Msg("An error occurred inserting a record")
 			return err
 		}
+		a.audit(c, db.AuditLinkCreated, id, linkTarget(input.Filepath, input.Paths))
+
+		// API clients get the new link back rather than the UI fragment
+		if !isHtmx(c) {
+			link, err := a.db.GetSharedLink(id)
+			if err != nil {
+				l.Error().Err(err).Str("ID", id).Msg("An error occurred reading back the new link")
+				return err
+			}
+			return c.Status(fiber.StatusCreated).JSON(link)
+		}
 
 	} else {
-		l.Error().Err(err).Str("FilePath", input.Filepath).Str("AbsoluteFilePath", absoluteFilePath).Msg("Filepath does not exist")
+		l.Error().Str("FilePath", input.Filepath).Msg("Filepath does not exist")
 		return fmt.Errorf("file does not exist")
 	}
 
-	data, err := a.GetUiData()
+	return a.renderSharedLinksTable(c)
+}
+
+// Cleans and checks the single path of a new link, reporting whether it
+// exists. Folders get their archive format checked
+func (a *SSeclinkApi) checkSharePath(input *SCreateLink) (bool, error) {
+	l := log.Get()
+
+	var err error
+	input.Filepath, err = cleanFilePath(input.Filepath)
+	if err != nil {
+		l.Warn().Err(err).Str("FilePath", input.Filepath).Msg("Refusing to share an unsafe path")
+		return false, fiber.NewError(fiber.StatusBadRequest, ErrUnsafePath.Error())
+	}
+	object, err := a.store.Stat(input.Filepath)
+	if errors.Is(err, ErrUnsafePath) {
+		l.Warn().Err(err).Str("FilePath", input.Filepath).Msg("Refusing to share an unsafe path")
+		return false, fiber.NewError(fiber.StatusBadRequest, ErrUnsafePath.Error())
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		l.Error().Err(err).Str("FilePath", input.Filepath).Msg("An error occurred determining if filepath exists")
+		return false, err
+	}
+	exists := err == nil
+
+	// Folders are streamed as an archive, the format is fixed when the link is made
+	if exists && object.IsDir {
+		if input.Filepath == "" {
+			return false, fiber.NewError(fiber.StatusBadRequest, "the whole files directory can not be shared")
+		}
+		if input.Archive == "" {
+			input.Archive = ArchiveZip
+		}
+		if !validArchive(input.Archive) {
+			return false, fiber.NewError(fiber.StatusBadRequest, "archive must be zip or tar.gz")
+		}
+	} else {
+		input.Archive = ""
+	}
+	return exists, nil
+}
+
+// Revokes a link so it can no longer be downloaded
+func (a *SSeclinkApi) RevokeLink(c *fiber.Ctx) error {
+	l := log.Get()
+	id := c.Params("id")
+
+	err := a.authorizeLinkManagement(c, id)
 	if err != nil {
-		l.Error().Err(err).Msg("failed to get required ui data")
 		return err
 	}
 
-	return a.Render(c, AdminSharedLinksTable(data.SharedLinks))
+	err = a.db.DeleteLink(id, db.LinkGoneRevoked)
+	if err == db.ErrLinkNotFound {
+		l.Error().Str("ID", id).Msg("Could not find link to revoke")
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		l.Error().Err(err).Str("ID", id).Msg("An error occurred revoking a link")
+		return err
+	}
+	l.Info().Str("ID", id).Msg("Revoked link")
+	a.audit(c, db.AuditLinkRevoked, id, "")
 
+	return a.renderSharedLinksTable(c)
 }
 
-func GenerateLink() (string, error) {
-	data, err := random.String(64)
-	return data, err
-}
+// Extends the TTL of a link and/or edits its metadata
+func (a *SSeclinkApi) UpdateLink(c *fiber.Ctx) error {
+	l := log.Get()
+	id := c.Params("id")
+
+	err := a.authorizeLinkManagement(c, id)
+	if err != nil {
+		return err
+	}
+
+	var input SUpdateLink
+	if err := c.BodyParser(&input); err != nil {
+		l.Error().Err(err).Msg("Invalid input")
+		return err
+	}
+
+	// Validate everything up front so a bad field does not leave a half applied update
+	var extend time.Duration
+	if input.ExtendString != nil && *input.ExtendString != "" {
+		extend, err = time.ParseDuration(*input.ExtendString)
+		if err != nil || extend <= 0 {
+			l.Error().
+				Err(err).
+				Str("extendstring", *input.ExtendString).
+				Msg("Could not convert extend string to a positive duration")
+			return fiber.NewError(fiber.StatusBadRequest, "extend must be a positive duration")
+		}
+	}
+
+	maxDownloads := -1
+	if input.MaxDownloadsString != nil {
+		maxDownloads = 0
+		if *input.MaxDownloadsString != "" {
+			maxDownloads, err = strconv.Atoi(*input.MaxDownloadsString)
+			if err != nil || maxDownloads < 0 {
+				l.Error().
+					Err(err).
+					Str("maxdownloadsstring", *input.MaxDownloadsString).
+					Msg("Could not convert max downloads to a number")
+				return fiber.NewError(fiber.StatusBadRequest, "max downloads must be a whole number, 0 for unlimited")
+			}
+		}
+	}
+
+	rateLimit := int64(-1)
+	if input.RateLimitString != nil {
+		rateLimit, err = parseRateLimit(*input.RateLimitString)
+		if err != nil {
+			l.Error().
+				Err(err).
+				Str("ratelimitstring", *input.RateLimitString).
+				Msg("Could not convert rate limit to a size")
+			return fiber.NewError(fiber.StatusBadRequest, "rate limit must be a size such as 500KB or 2MiB")
+		}
+	}
 
-// Returns a list of relative filenames from the data directory, excludes db folder
-func (a *SSeclinkApi) GetFileList() ([]SFile, error) {
-	var files []SFile
-	err := filepath.Walk(a.dataFilesPath, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			// Get relative path
-			relPath, err := filepath.Rel(a.dataFilesPath, path)
-			if err == nil {
-				files = append(files, SFile{Path: relPath, TtlString: viper.GetDuration("links.defaultttl").String()})
+	// Every change goes in one transaction, so a failure leaves the link as it was
+	apply := func(record *db.SLinkRecord) error {
+		// Only kept so its last download can be resumed
+		if record.Exhausted() {
+			return fiber.NewError(fiber.StatusGone, "the link has no downloads left")
+		}
+		if maxDownloads >= 0 {
+			// A limit already reached would leave a link nobody can use or see
+			if maxDownloads > 0 && maxDownloads <= record.Downloads {
+				return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("max downloads must be more than the %d downloads already made", record.Downloads))
 			}
+			record.MaxDownloads = maxDownloads
+		}
+		if input.Notes != nil {
+			record.Notes = *input.Notes
+		}
+		if rateLimit >= 0 {
+			record.RateLimit = rateLimit
+		}
+		if input.Unlock {
+			record.Locked = false
+			record.FailedAttempts = 0
 		}
 		return nil
-	})
-	return files, err
+	}
+	if extend > 0 {
+		_, err = a.db.ExtendLink(id, extend, apply)
+	} else {
+		_, err = a.db.UpdateLink(id, apply)
+	}
+	if err == db.ErrLinkNoExpiry {
+		return fiber.NewError(fiber.StatusBadRequest, "the link never expires, there is nothing to extend")
+	}
+	if err == db.ErrLinkNotFound {
+		l.Error().Str("ID", id).Msg("Could not find link to update")
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if _, ok := err.(*fiber.Error); ok {
+		return err
+	}
+	if err != nil {
+		l.Error().Err(err).Str("ID", id).Msg("An error occurred updating a link")
+		return err
+	}
+	l.Info().Str("ID", id).Dur("Extend", extend).Bool("Unlock", input.Unlock).Msg("Updated link")
+	detail := ""
+	if input.Unlock {
+		detail = "unlocked"
+	}
+	a.audit(c, db.AuditLinkUpdated, id, detail)
+
+	return a.renderSharedLinksTable(c)
+}
+
+// Renders the active links table fragment, used as the htmx response of link operations
+func (a *SSeclinkApi) renderSharedLinksTable(c *fiber.Ctx) error {
+	l := log.Get()
+
+	principal := getPrincipal(c)
+	links, err := a.GetLinks(principal)
+	if err != nil {
+		l.Error().Err(err).Msg("failed to get links from db")
+		return err
+	}
+
+	return a.Render(c, AdminSharedLinksTable(principal, links))
 }
 
-// Get active links list
-func (a *SSeclinkApi) GetLinks() ([]db.SSharedLink, error) {
+func GenerateLink() (string, error) {
+	data, err := random.String(64)
+	return data, err
+}
+
+// Get active links list, only the principals own links unless they can see all links
+func (a *SSeclinkApi) GetLinks(principal auth.SPrincipal) ([]db.SSharedLink, error) {
 	results, err := a.db.GetAllLinks()
 	if err != nil {
 		return nil, err
 	}
-	return results, nil
+	if principal.Can(auth.ScopeLinksAll) {
+		return results, nil
+	}
+
+	own := make([]db.SSharedLink, 0)
+	for _, link := range results {
+		if link.CreatedBy == principal.Name {
+			own = append(own, link)
+		}
+	}
+	return own, nil
+}
+
+// Checks the principal may revoke or edit the link, sharers can only manage
+// links they created
+func (a *SSeclinkApi) authorizeLinkManagement(c *fiber.Ctx, id string) error {
+	l := log.Get()
+	principal := getPrincipal(c)
+
+	record, err := a.db.GetLink(id)
+	if err == db.ErrLinkNotFound {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		l.Error().Err(err).Str("ID", id).Msg("Could not find id in database")
+		return err
+	}
+
+	if !canManageLink(principal, record.CreatedBy) {
+		l.Warn().
+			Str("ID", id).
+			Str("Principal", principal.Name).
+			Str("CreatedBy", record.CreatedBy).
+			Msg("Principal tried to manage a link they did not create")
+		return fiber.NewError(fiber.StatusForbidden, "you can only manage links you created")
+	}
+	return nil
+}
+
+// Lists active links as JSON for API clients
+func (a *SSeclinkApi) ListLinks(c *fiber.Ctx) error {
+	l := log.Get()
+
+	links, err := a.GetLinks(getPrincipal(c))
+	if err != nil {
+		l.Error().Err(err).Msg("failed to get links from db")
+		return err
+	}
+
+	if isHtmx(c) {
+		return a.Render(c, AdminSharedLinksTable(getPrincipal(c), links))
+	}
+	return c.JSON(links)
 }
 
 // If link exists and has not expired then return downloaded file
@@ -228,13 +802,17 @@ func (a *SSeclinkApi) AdminUI(c *fiber.Ctx) error {
 
 	l.Trace().Msg("Root page called")
 
-	data, err := a.GetUiData()
+	dir, err := cleanFilePath(c.Query("dir"))
+	if err != nil {
+		return fileError(err)
+	}
+	data, err := a.GetUiData(getPrincipal(c), dir)
 	if err != nil {
 		l.Error().Err(err).Msg("failed to get required ui data")
-		return err
+		return fileError(err)
 	}
 
-	return a.Render(c, AdminUiPage(data.SharedLinks, data.Files))
+	return a.Render(c, AdminUiPage(data.User, data.SharedLinks, data.Dir, data.Files))
 }
 
 func (a *SSeclinkApi) UploadFile(c *fiber.Ctx) error {
@@ -242,69 +820,119 @@ func (a *SSeclinkApi) UploadFile(c *fiber.Ctx) error {
 
 	l.Trace().Msg("UploadFile called")
 
+	// Turn away oversized uploads on the declared length, before the body is read
+	if max := maxUploadSize(); max > 0 && int64(c.Request().Header.ContentLength()) > max+multipartOverhead {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge, fmt.Sprintf("uploads are limited to %s", formatSize(max)))
+	}
+
 	file, err := c.FormFile("binaryFile")
 
+	// Uploads go into the folder being browsed, the root when not given
+	dir, dirErr := cleanFilePath(c.FormValue("dir"))
+	if dirErr != nil {
+		return fileError(dirErr)
+	}
+	var relPath string
+
 	// Check for errors:
 	if err == nil {
-		savePath := filepath.Join(a.dataFilesPath, file.Filename)
+		relPath = path.Join(dir, file.Filename)
+		_, err := a.store.Stat(relPath)
+		if errors.Is(err, ErrUnsafePath) {
+			l.Warn().Err(err).Str("Filename", file.Filename).Msg("Refusing to save an upload to an unsafe path")
+			return fiber.NewError(fiber.StatusBadRequest, ErrUnsafePath.Error())
+		}
+		folder, err := a.store.Stat(parentDir(relPath))
+		if err != nil || !folder.IsDir {
+			return fiber.NewError(fiber.StatusBadRequest, "the destination folder does not exist")
+		}
+		replacing, err := a.checkUploadTarget(c, relPath)
+		if err != nil {
+			return err
+		}
+		// Reserved like a tus upload until the file is in place, so uploads
+		// running at the same time can not each fit the quota on their own
+		now := time.Now()
+		reservation := db.SUpload{
+			Id:        randomString(),
+			Path:      relPath,
+			Length:    file.Size,
+			CreatedBy: getPrincipal(c).Name,
+			CreatedAt: now,
+			ExpiresAt: now.Add(viper.GetDuration("uploads.expiry")),
+		}
+		err = a.reserveUpload(reservation)
+		if _, ok := err.(*fiber.Error); ok {
+			return err
+		}
+		if err != nil {
+			l.Error().Err(err).Str("Path", relPath).Msg("An error occurred reserving space for an upload")
+			return err
+		}
+		defer a.releaseUpload(reservation.Id)
+		replaced := a.fileSize(relPath)
 		l.Info().
-			Str("savePath", savePath).
+			Str("Path", relPath).
 			Str("Filename", file.Filename).
 			Msg("file upload successful, saving file")
+		src, err := file.Open()
+		if err != nil {
+			l.Error().Err(err).Str("Filename", file.Filename).Msg("failed to read the uploaded file")
+			return err
+		}
+		defer src.Close()
+
 		// 👷 Save file to root directory:
-		err = c.SaveFile(file, savePath)
+		sum, err := a.saveHashed(src, relPath)
 		if err != nil {
 			l.Error().
 				Err(err).
-				Str("savePath", savePath).
+				Str("Path", relPath).
 				Str("Filename", file.Filename).
 				Msg("failed to save file to the save path")
 			return err
 		}
+		a.recordUpload(relPath, getPrincipal(c).Name, sum, replaced)
+		a.audit(c, db.AuditFileUploaded, relPath, "")
+		err = a.revokeFileLinks(c, replacing, "file replaced")
+		if err != nil {
+			return err
+		}
 	} else {
 		l.Error().
 			Err(err).
-			Str("Filename", file.Filename).
 			Msg("failed to upload file")
 		return err
 	}
 
-	err = c.SendString("File upload successful!")
-	if err != nil {
-		return err
-	}
-
-	data, err := a.GetUiData()
-	if err != nil {
-		l.Error().Err(err).Msg("failed to get required ui data")
-		return err
-	}
-
-	return a.Render(c, AdminFileTable(data.Files))
+	// API clients get the stored file back rather than the UI fragment
+	return a.renderFileChange(c, fiber.StatusCreated, dir, relPath, false)
 }
 
-// Get all current data on the app, used for rendering UI pages
-func (a *SSeclinkApi) GetUiData() (SUiData, error) {
+// Get all current data on the app visible to principal, used for rendering UI pages
+func (a *SSeclinkApi) GetUiData(principal auth.SPrincipal, dir string) (SUiData, error) {
 
 	l := log.Get()
 
-	sharedLinks, err := a.GetLinks()
+	sharedLinks, err := a.GetLinks(principal)
 	if err != nil {
 		l.Error().Err(err).Msg("failed to get links from db")
 		return SUiData{}, err
 	}
 
-	files, err := a.GetFileList()
+	files, err := a.GetFileList(dir)
 	if err != nil {
 		l.Error().
 			Err(err).
-			Str("datapath", a.dataFilesPath).
+			Str("Dir", dir).
 			Msg("Could not list files in data path")
 		return SUiData{}, err
 	}
 
 	return SUiData{
+		User:        principal,
 		SharedLinks: sharedLinks,
+		Dir:         dir,
 		Files:       files,
 	}, nil
 
@@ -319,21 +947,18 @@ func (a *SSeclinkApi) Render(c *fiber.Ctx, component templ.Component, options ..
 }
 
 // New Seclink API
-func NewSeclinkApi(db db.ISeclinkDb) ISeclinkApi {
-	return &SSeclinkApi{
-		db:            db,
-		dataFilesPath: filepath.Join(viper.GetString("server.datapath"), "files"),
+func NewSeclinkApi(db db.ISeclinkDb, store storage.IStorage) ISeclinkApi {
+	var passwordProviders []auth.IPasswordProvider
+	if viper.GetBool("auth.local.enabled") {
+		passwordProviders = append(passwordProviders, auth.NewLocalProvider(db))
 	}
-}
 
-// Path exists
-func pathExists(path string) (bool, error) {
-	_, err := os.Stat(path)
-	if err == nil {
-		return true, nil
-	}
-	if errors.Is(err, os.ErrNotExist) {
-		return false, nil
+	return &SSeclinkApi{
+		db:                db,
+		passwordProviders: passwordProviders,
+		store:             store,
+		uploadsPath:       filepath.Join(viper.GetString("server.datapath"), "uploads"),
+		linkLimiters:      make(map[string]*SLinkLimiter),
+		failures:          make(map[string]*SClientFailures),
 	}
-	return false, err
 }
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"seclink/db"
+	"seclink/log"
+	"seclink/storage"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Archive formats a folder link can be downloaded as
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+// Whether format is one of the archive formats
+func validArchive(format string) bool {
+	return format == ArchiveZip || format == ArchiveTarGz
+}
+
+// Streams the folder shared by link id to the client as an archive built on
+// the fly. Files are copied straight from storage into the response so memory
+// use does not grow with the size of the folder
+func (a *SSeclinkApi) streamArchive(c *fiber.Ctx, id string, record db.SLinkRecord) error {
+	rel, format := record.Path, record.Archive
+	name := path.Base(rel) + "." + format
+	contentType := "application/zip"
+	if format == ArchiveTarGz {
+		contentType = "application/gzip"
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s"`, name))
+	c.Set(fiber.HeaderAcceptRanges, "none")
+	if c.Method() == fiber.MethodHead {
+		return nil
+	}
+
+	throttle := a.throttle(id, record.RateLimit)
+	c.Response().SetBodyStreamWriter(func(w *bufio.Writer) {
+		l := log.Get()
+
+		defer throttle.Release()
+		var err error
+		if format == ArchiveTarGz {
+			err = a.writeTarGz(throttle.Writer(w), rel)
+		} else {
+			err = a.writeZip(throttle.Writer(w), rel)
+		}
+		// Headers are long gone by now, all that can be done is stop
+		if err != nil {
+			l.Error().Err(err).Str("Path", rel).Str("Format", format).Msg("An error occurred streaming an archive")
+		}
+	})
+	return nil
+}
+
+// Calls fn for every file and folder below the folder at rel that is safe to
+// include, with its path inside the archive
+func (a *SSeclinkApi) walkArchive(rel string, fn func(name string, object storage.SObject, info fs.FileInfo) error) error {
+	return a.store.Walk(rel, func(object storage.SObject) error {
+		name := strings.TrimPrefix(object.Path, rel+"/")
+		return fn(name, object, a.objectInfo(object))
+	})
+}
+
+func (a *SSeclinkApi) writeZip(w io.Writer, rel string) error {
+	archive := zip.NewWriter(w)
+
+	err := a.walkArchive(rel, func(name string, object storage.SObject, info fs.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+			_, err = archive.CreateHeader(header)
+			return err
+		}
+		header.Method = zip.Deflate
+
+		entry, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		return a.copyFile(entry, object.Path)
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func (a *SSeclinkApi) writeTarGz(w io.Writer, rel string) error {
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+
+	err := a.walkArchive(rel, func(name string, object storage.SObject, info fs.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+			return archive.WriteHeader(header)
+		}
+
+		err = archive.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+		return a.copyFile(archive, object.Path)
+	})
+	if err != nil {
+		return err
+	}
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+	return compressed.Close()
+}
+
+// Copies the content of the file at rel into w
+func (a *SSeclinkApi) copyFile(w io.Writer, rel string) error {
+	file, _, err := openContent(a.store, rel)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(w, file)
+	return err
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"seclink/db"
+	"seclink/log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	auditDefaultLimit = 50
+	auditMaxLimit     = 500
+)
+
+// A page of audit events, Next is passed back as before to get the following page
+type SAuditPage struct {
+	Events []db.SAuditEvent `json:"events"`
+	Next   string           `json:"next,omitempty"`
+}
+
+// Records an audit event for the current principal
+func (a *SSeclinkApi) audit(c *fiber.Ctx, action string, target string, detail string) {
+	a.auditAs(c, getPrincipal(c).Name, action, target, detail)
+}
+
+// Records an audit event for actor, failing to record it is logged rather
+// than failing the request
+func (a *SSeclinkApi) auditAs(c *fiber.Ctx, actor string, action string, target string, detail string) {
+	l := log.Get()
+
+	_, err := a.db.AddAuditEvent(db.SAuditEvent{
+		Action:    action,
+		Actor:     actor,
+		Target:    target,
+		Detail:    detail,
+		ClientIp:  a.clientIP(c),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+	})
+	if err != nil {
+		l.Error().
+			Err(err).
+			Str("Action", action).
+			Str("Actor", actor).
+			Str("Target", target).
+			Msg("An error occurred recording an audit event")
+	}
+}
+
+// Reads the audit filter from the query string
+func parseAuditFilter(c *fiber.Ctx) (db.SAuditFilter, error) {
+	filter := db.SAuditFilter{
+		Action: c.Query("action"),
+		Actor:  c.Query("actor"),
+		Target: c.Query("target"),
+		Before: c.Query("before"),
+		Limit:  c.QueryInt("limit", auditDefaultLimit),
+	}
+	if filter.Limit <= 0 || filter.Limit > auditMaxLimit {
+		filter.Limit = auditMaxLimit
+	}
+
+	var err error
+	if since := c.Query("since"); since != "" {
+		filter.Since, err = ParseAuditTime(since)
+		if err != nil {
+			return filter, fiber.NewError(fiber.StatusBadRequest, "since must be an RFC 3339 time or a duration such as 24h")
+		}
+	}
+	if until := c.Query("until"); until != "" {
+		filter.Until, err = ParseAuditTime(until)
+		if err != nil {
+			return filter, fiber.NewError(fiber.StatusBadRequest, "until must be an RFC 3339 time or a duration such as 24h")
+		}
+	}
+	return filter, nil
+}
+
+// Parses an RFC 3339 time, or a duration meaning that long ago
+func ParseAuditTime(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04", value); err == nil {
+		// What a datetime-local input sends, taken as UTC
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Gets a page of audit events, newest first
+func (a *SSeclinkApi) GetAuditEvents(c *fiber.Ctx) error {
+	l := log.Get()
+
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		return err
+	}
+
+	// Ask for one extra event to know if there is another page
+	limit := filter.Limit
+	filter.Limit++
+	events, err := a.db.GetAuditEvents(filter)
+	if err != nil {
+		l.Error().Err(err).Msg("An error occurred reading audit events")
+		return err
+	}
+
+	page := SAuditPage{Events: events}
+	if len(events) > limit {
+		page.Events = events[:limit]
+		page.Next = page.Events[limit-1].Id
+	}
+
+	if isHtmx(c) {
+		return a.Render(c, AdminAuditTable(page))
+	}
+	return c.JSON(page)
+}
+
+func (a *SSeclinkApi) AdminAuditUI(c *fiber.Ctx) error {
+	return a.Render(c, AdminAuditPage(getPrincipal(c), db.AuditActions))
+}
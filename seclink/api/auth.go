@@ -0,0 +1,271 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"seclink/auth"
+	"seclink/db"
+	"seclink/log"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Cookie holding the admin session id
+	sessionCookieName = "seclink_session"
+	// Fiber locals key the authenticated auth.SPrincipal is stored under
+	principalKey = "principal"
+)
+
+// Admin app paths that can be reached without a session
+var publicAdminPaths = map[string]bool{
+	"/login":              true,
+	"/auth/oidc/login":    true,
+	"/auth/oidc/callback": true,
+}
+
+// API tokens only update their last used time this often, saves a db write per request
+const tokenTouchInterval = time.Minute
+
+// Middleware that rejects admin requests without a valid session or API token
+func (a *SSeclinkApi) RequireAuth(c *fiber.Ctx) error {
+	if !viper.GetBool("auth.enabled") {
+		c.Locals(principalKey, auth.SPrincipal{Role: auth.RoleAdmin, Scopes: auth.AllScopes})
+		return c.Next()
+	}
+	if publicAdminPaths[c.Path()] {
+		return c.Next()
+	}
+
+	// Automation presents a bearer token, browsers a session cookie
+	if header := c.Get(fiber.HeaderAuthorization); header != "" {
+		principal, err := a.tokenPrincipal(header)
+		if err != nil {
+			l := log.Get()
+			l.Warn().
+				Err(err).
+				Str("IP", a.clientIP(c)).
+				Msg("Rejected API token")
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid API token")
+		}
+		c.Locals(principalKey, principal)
+		return c.Next()
+	}
+
+	principal, err := a.sessionPrincipal(c)
+	if err != nil {
+		return a.unauthorized(c)
+	}
+
+	c.Locals(principalKey, principal)
+	return c.Next()
+}
+
+// Route middleware that only lets principals holding scope through
+func requireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal := getPrincipal(c)
+		if !principal.Can(scope) {
+			l := log.Get()
+			l.Warn().
+				Str("Principal", principal.Name).
+				Str("Scope", scope).
+				Str("Path", c.Path()).
+				Msg("Principal lacks the scope for this route")
+			return fiber.NewError(fiber.StatusForbidden, fmt.Sprintf("the %s scope is required", scope))
+		}
+		return c.Next()
+	}
+}
+
+// Looks up the principal behind an "Authorization: Bearer" header
+func (a *SSeclinkApi) tokenPrincipal(header string) (auth.SPrincipal, error) {
+	bearer, found := strings.CutPrefix(header, "Bearer ")
+	if !found {
+		return auth.SPrincipal{}, fmt.Errorf("expected a bearer token")
+	}
+
+	id, secret, ok := auth.ParseToken(bearer)
+	if !ok {
+		return auth.SPrincipal{}, fmt.Errorf("malformed API token")
+	}
+
+	token, err := a.db.GetToken(id)
+	if err != nil {
+		return auth.SPrincipal{}, err
+	}
+	if !auth.CheckTokenSecret(token.SecretHash, secret) {
+		return auth.SPrincipal{}, fmt.Errorf("API token secret does not match")
+	}
+
+	if time.Since(token.LastUsedAt) > tokenTouchInterval {
+		err = a.db.TouchToken(id, time.Now())
+		if err != nil {
+			l := log.Get()
+			l.Error().Err(err).Str("TokenId", id).Msg("Could not record API token use")
+		}
+	}
+
+	return auth.SPrincipal{
+		Name:     fmt.Sprintf("token:%s", token.Name),
+		Provider: auth.TokenProviderName,
+		Scopes:   token.Scopes,
+	}, nil
+}
+
+// Looks up the principal behind the session cookie
+func (a *SSeclinkApi) sessionPrincipal(c *fiber.Ctx) (auth.SPrincipal, error) {
+	sessionId := c.Cookies(sessionCookieName)
+	if sessionId == "" {
+		return auth.SPrincipal{}, db.ErrSessionNotFound
+	}
+
+	session, err := a.db.GetSession(sessionId)
+	if err != nil {
+		return auth.SPrincipal{}, err
+	}
+
+	// Deleting a local user or changing their role should apply to existing
+	// sessions straight away
+	role := session.Role
+	if session.Provider == auth.LocalProviderName {
+		user, err := a.db.GetUser(session.Username)
+		if err != nil {
+			return auth.SPrincipal{}, err
+		}
+		role = user.Role
+	}
+
+	return auth.SPrincipal{
+		Name:     session.Username,
+		Provider: session.Provider,
+		Role:     role,
+		Scopes:   auth.ScopesForRole(role),
+	}, nil
+}
+
+// Sends unauthenticated users to the login page, htmx and API clients get a 401
+func (a *SSeclinkApi) unauthorized(c *fiber.Ctx) error {
+	if c.Get("HX-Request") == "true" {
+		c.Set("HX-Redirect", "/login")
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+	if strings.HasPrefix(c.Path(), "/api/") {
+		return fiber.NewError(fiber.StatusUnauthorized, "authentication required")
+	}
+	return c.Redirect("/login", fiber.StatusSeeOther)
+}
+
+// The principal of the current admin request, unnamed when auth is disabled
+func getPrincipal(c *fiber.Ctx) auth.SPrincipal {
+	principal, _ := c.Locals(principalKey).(auth.SPrincipal)
+	return principal
+}
+
+func (a *SSeclinkApi) LoginPage(c *fiber.Ctx) error {
+	return a.Render(c, AdminLoginPage("", viper.GetBool("auth.oidc.enabled")))
+}
+
+// Checks the login form against each password provider and starts a session
+func (a *SSeclinkApi) Login(c *fiber.Ctx) error {
+	l := log.Get()
+	username := c.FormValue("username")
+
+	for _, provider := range a.passwordProviders {
+		principal, err := provider.Authenticate(username, c.FormValue("password"))
+		if err == auth.ErrInvalidCredentials {
+			continue
+		}
+		if err != nil {
+			l.Error().
+				Err(err).
+				Str("Provider", provider.Name()).
+				Str("Username", username).
+				Msg("An error occurred authenticating user")
+			return err
+		}
+
+		err = a.startSession(c, principal)
+		if err != nil {
+			return err
+		}
+		return c.Redirect("/admin", fiber.StatusSeeOther)
+	}
+
+	l.Warn().
+		Str("Username", username).
+		Str("IP", a.clientIP(c)).
+		Msg("Failed admin login")
+	a.auditAs(c, username, db.AuditLoginFailed, "", "invalid credentials")
+	return a.Render(c, AdminLoginPage(auth.ErrInvalidCredentials.Error(), viper.GetBool("auth.oidc.enabled")), templ.WithStatus(fiber.StatusUnauthorized))
+}
+
+// Ends the current session
+func (a *SSeclinkApi) Logout(c *fiber.Ctx) error {
+	l := log.Get()
+
+	if sessionId := c.Cookies(sessionCookieName); sessionId != "" {
+		err := a.db.DeleteSession(sessionId)
+		if err != nil && err != db.ErrSessionNotFound {
+			l.Error().Err(err).Msg("An error occurred deleting session")
+			return err
+		}
+	}
+	c.ClearCookie(sessionCookieName)
+
+	l.Info().Str("Username", getPrincipal(c).Name).Msg("User logged out")
+	a.audit(c, db.AuditLogout, "", "")
+	return c.Redirect("/login", fiber.StatusSeeOther)
+}
+
+// Stores a new session for principal and hands its id to the browser
+func (a *SSeclinkApi) startSession(c *fiber.Ctx, principal auth.SPrincipal) error {
+	l := log.Get()
+
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return err
+	}
+	sessionId := base64.RawURLEncoding.EncodeToString(raw)
+
+	ttl := viper.GetDuration("auth.sessionttl")
+	err = a.db.SetSession(sessionId, db.SSession{
+		Username:  principal.Name,
+		Provider:  principal.Provider,
+		Role:      principal.Role,
+		CreatedAt: time.Now(),
+	}, ttl)
+	if err != nil {
+		l.Error().Err(err).Str("Username", principal.Name).Msg("An error occurred storing session")
+		return err
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessionId,
+		Path:     "/",
+		Expires:  time.Now().Add(ttl),
+		Secure:   viper.GetBool("auth.securecookie"),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	l.Info().
+		Str("Username", principal.Name).
+		Str("Provider", principal.Provider).
+		Str("Role", principal.Role).
+		Msg("User logged in")
+	a.auditAs(c, principal.Name, db.AuditLoginSucceeded, "", principal.Provider)
+	return nil
+}
+
+// Whether the request came from htmx in the admin UI rather than an API client
+func isHtmx(c *fiber.Ctx) bool {
+	return c.Get("HX-Request") == "true"
+}
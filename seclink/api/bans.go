@@ -0,0 +1,82 @@
+package api
+
+import (
+	"seclink/db"
+	"seclink/log"
+	"slices"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Lists client bans, newest first. Ended bans are listed until their strikes are forgotten
+func (a *SSeclinkApi) GetBans(c *fiber.Ctx) error {
+	l := log.Get()
+
+	bans, err := a.allBans()
+	if err != nil {
+		l.Error().Err(err).Msg("An error occurred reading bans")
+		return err
+	}
+
+	if isHtmx(c) {
+		return a.Render(c, AdminBanTable(bans))
+	}
+	return c.JSON(bans)
+}
+
+// Lifts the ban of a client and forgets its strikes and recent failures
+func (a *SSeclinkApi) ClearBan(c *fiber.Ctx) error {
+	l := log.Get()
+	ip := c.Params("ip")
+
+	err := a.db.DeleteBan(ip)
+	if err == db.ErrBanNotFound {
+		l.Error().Str("IP", ip).Msg("Could not find ban to clear")
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		l.Error().Err(err).Str("IP", ip).Msg("An error occurred clearing a ban")
+		return err
+	}
+
+	a.failuresMutex.Lock()
+	delete(a.failures, ip)
+	a.failuresMutex.Unlock()
+
+	l.Info().Str("IP", ip).Msg("Cleared client ban")
+	a.audit(c, db.AuditBanCleared, ip, "")
+
+	if isHtmx(c) {
+		bans, err := a.allBans()
+		if err != nil {
+			l.Error().Err(err).Msg("An error occurred reading bans")
+			return err
+		}
+		return a.Render(c, AdminBanTable(bans))
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (a *SSeclinkApi) allBans() ([]db.SBan, error) {
+	bans, err := a.db.GetAllBans()
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(bans, func(x, y db.SBan) int {
+		return y.BannedAt.Compare(x.BannedAt)
+	})
+	return bans, nil
+}
+
+// Admin UI page for viewing and clearing client bans
+func (a *SSeclinkApi) AdminBansUI(c *fiber.Ctx) error {
+	l := log.Get()
+
+	bans, err := a.allBans()
+	if err != nil {
+		l.Error().Err(err).Msg("An error occurred reading bans")
+		return err
+	}
+
+	return a.Render(c, AdminBansPage(getPrincipal(c), bans))
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"seclink/db"
+	"seclink/log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// SStringList accepts a JSON array or a single string, the json-enc htmx
+// extension sends a lone checked box as a plain string
+type SStringList []string
+
+func (s *SStringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*s = SStringList{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(data, &list)
+	*s = list
+	return err
+}
+
+// A file listed on the public page of a bundle link
+type SBundleFile struct {
+	Index   int
+	Name    string
+	Size    int64
+	Sha256  string
+	Removed bool
+}
+
+// Cleans and checks the paths of a new bundle, every one must be an existing
+// file. Duplicates are dropped
+func (a *SSeclinkApi) checkBundlePaths(paths []string) ([]string, error) {
+	l := log.Get()
+
+	cleaned := make([]string, 0, len(paths))
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		rel, err := cleanFilePath(p)
+		var file SFile
+		if err == nil {
+			file, err = a.statFile(rel)
+		}
+		if errors.Is(err, ErrUnsafePath) {
+			l.Warn().Err(err).Str("FilePath", p).Msg("Refusing to bundle an unsafe path")
+			return nil, fiber.NewError(fiber.StatusBadRequest, ErrUnsafePath.Error())
+		}
+		if err != nil || file.IsDir {
+			return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("%s is not a file", rel))
+		}
+		if !seen[rel] {
+			seen[rel] = true
+			cleaned = append(cleaned, rel)
+		}
+	}
+	if len(cleaned) == 0 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "a bundle needs at least one file")
+	}
+	return cleaned, nil
+}
+
+// Describes a link by what it shares, for audit events
+func linkTarget(path string, paths []string) string {
+	if len(paths) > 0 {
+		return strings.Join(paths, " ")
+	}
+	return path
+}
+
+// Renders the public listing of a bundle, nothing is counted until a file is downloaded
+func (a *SSeclinkApi) renderBundle(c *fiber.Ctx, id string, record db.SLinkRecord) error {
+	files := make([]SBundleFile, 0, len(record.Paths))
+	for i, p := range record.Paths {
+		file := SBundleFile{Index: i, Name: path.Base(p)}
+		info, err := a.statFile(p)
+		if err != nil || info.IsDir {
+			file.Removed = true
+		} else {
+			file.Size = info.Size
+			file.Sha256 = info.Sha256
+		}
+		files = append(files, file)
+	}
+	return a.Render(c, PublicBundlePage(id, record.Message, files))
+}
+
+// Downloads one file of a bundle. The first file a client fetches is counted
+// as a download of the link and starts its session, the files it fetches
+// while that lasts are not counted again
+func (a *SSeclinkApi) GetBundleFile(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	record, err := a.usableLink(c, id)
+	if record == nil {
+		return err
+	}
+
+	index, err := c.ParamsInt("index")
+	if err != nil || index < 0 || index >= len(record.Paths) {
+		return fiber.NewError(fiber.StatusNotFound, "file does not exist")
+	}
+	rel := record.Paths[index]
+
+	object, err := a.linkFile(c, id, rel)
+	if object == nil {
+		return err
+	}
+
+	delivery, err := a.prepareDelivery(c, id, *record, *object)
+	if delivery == nil {
+		return err
+	}
+	if token, started, ok := a.resumeSession(c, id); delivery.Counted && ok {
+		a.joinSession(id, token, started, delivery)
+	} else if delivery.Counted {
+		consumed, err := a.consumeDownload(c, id, true)
+		if consumed == nil {
+			return err
+		}
+		a.allowResume(c, id, delivery)
+		a.logDownload(c, id, rel, consumed, "Downloading file from bundle")
+	}
+	if redirected, err := a.presignedDownload(c, delivery, path.Base(rel)); redirected || err != nil {
+		return err
+	}
+	a.setDigestHeaders(c, rel)
+	return a.sendContent(c, delivery, path.Base(rel))
+}
+
+// Downloads every file of a bundle as one zip, counted as a single download
+// of the link. Files removed since the bundle was made are left out
+func (a *SSeclinkApi) GetBundleArchive(c *fiber.Ctx) error {
+	l := log.Get()
+	id := c.Params("id")
+
+	record, err := a.usableLink(c, id)
+	if record == nil {
+		return err
+	}
+	if len(record.Paths) == 0 {
+		return fiber.NewError(fiber.StatusNotFound, "link is not a bundle")
+	}
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="bundle.zip"`)
+	c.Set(fiber.HeaderAcceptRanges, "none")
+	if c.Method() == fiber.MethodHead {
+		return nil
+	}
+
+	consumed, err := a.consumeDownload(c, id, false)
+	if consumed == nil {
+		return err
+	}
+
+	l.Info().
+		Str("ID", id).
+		Int("Files", len(record.Paths)).
+		Int("Downloads", consumed.Downloads).
+		Int("MaxDownloads", consumed.MaxDownloads).
+		Msg("Downloading bundle")
+	a.auditAs(c, "", db.AuditLinkDownloaded, id, linkTarget("", record.Paths))
+
+	paths := record.Paths
+	throttle := a.throttle(id, record.RateLimit)
+	c.Response().SetBodyStreamWriter(func(w *bufio.Writer) {
+		l := log.Get()
+
+		defer throttle.Release()
+		err := a.writeBundleZip(throttle.Writer(w), paths)
+		if err != nil {
+			l.Error().Err(err).Str("ID", id).Msg("An error occurred streaming a bundle")
+		}
+	})
+	return nil
+}
+
+// Writes the files at paths to a zip, named by their path in the files directory
+func (a *SSeclinkApi) writeBundleZip(w io.Writer, paths []string) error {
+	archive := zip.NewWriter(w)
+
+	for _, rel := range paths {
+		object, err := a.store.Stat(rel)
+		if err != nil || object.IsDir {
+			continue
+		}
+
+		header, err := zip.FileInfoHeader(a.objectInfo(object))
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		header.Method = zip.Deflate
+		entry, err := archive.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		err = a.copyFile(entry, rel)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// Renders basket entries for the selected files, added to the bundle being
+// put together in the admin UI
+func (a *SSeclinkApi) BundleItems(c *fiber.Ctx) error {
+	var paths []string
+	for _, value := range c.Context().QueryArgs().PeekMulti("paths") {
+		rel, err := cleanFilePath(string(value))
+		if err != nil {
+			continue
+		}
+		file, err := a.statFile(rel)
+		if err != nil || file.IsDir {
+			continue
+		}
+		paths = append(paths, rel)
+	}
+	return a.Render(c, AdminBundleItems(paths))
+}
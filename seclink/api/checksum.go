@@ -0,0 +1,139 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"seclink/db"
+	"seclink/log"
+	"seclink/storage"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Every file written through seclink gets a SHA-256 checksum, worked out as
+// the bytes stream to disk, so recipients can check they got the exact file
+
+// Hex SHA-256 of the content of the file at rel in store
+func HashFile(store storage.IStorage, rel string) (string, error) {
+	file, _, err := openContent(store, rel)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return hashStream(file)
+}
+
+// Hex SHA-256 of everything r has left
+func hashStream(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Writes src to a new file at rel, returning the checksum of what was written.
+// Nothing is left behind when it fails
+func (a *SSeclinkApi) saveHashed(src io.Reader, rel string) (string, error) {
+	file, err := a.createContent(rel)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, h), src)
+	if err != nil {
+		file.Abort()
+		return "", err
+	}
+	err = file.Close()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Picks up the hash of a tus upload where the last request left it, nil when
+// the hash fell behind the bytes on disk and the file has to be hashed again
+func resumeHash(upload db.SUpload, offset int64) hash.Hash {
+	h := sha256.New()
+	if offset == 0 {
+		return h
+	}
+	if upload.Hashed != offset || upload.HashState == nil {
+		return nil
+	}
+	if h.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.HashState) != nil {
+		return nil
+	}
+	return h
+}
+
+// Saves the state of h into upload once hashed bytes have been written
+func saveHash(upload *db.SUpload, h hash.Hash, hashed int64) {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		upload.HashState = nil
+		return
+	}
+	upload.HashState = state
+	upload.Hashed = hashed
+}
+
+// Records the file now at rel, who uploaded it and its checksum. replaced is
+// the size of the file it took the place of, 0 when there was none
+func (a *SSeclinkApi) recordUpload(rel string, user string, sum string, replaced int64) {
+	l := log.Get()
+
+	object, err := a.store.Stat(rel)
+	if err != nil {
+		l.Error().Err(err).Str("Path", rel).Msg("An error occurred checking an uploaded file")
+		return
+	}
+	a.adjustUsage(object.Size - replaced)
+
+	err = a.db.SetFileRecord(db.SFileRecord{
+		Path:       rel,
+		UploadedBy: user,
+		UploadedAt: time.Now(),
+		Sha256:     sum,
+		Size:       object.Size,
+		ModTime:    object.ModTime,
+	})
+	if err != nil {
+		l.Error().Err(err).Str("Path", rel).Msg("An error occurred recording an uploaded file")
+	}
+}
+
+// The recorded checksum of the file object, empty when there is none or the
+// file has changed since
+func (a *SSeclinkApi) fileChecksum(object storage.SObject) string {
+	record, err := a.db.GetFileRecord(object.Path)
+	if err != nil || !record.Current(object.Size, object.ModTime) {
+		return ""
+	}
+	return record.Sha256
+}
+
+// Sends the checksum of a download as Repr-Digest, RFC 9530, and the older
+// Digest header for clients that only know that one
+func (a *SSeclinkApi) setDigestHeaders(c *fiber.Ctx, rel string) {
+	object, err := a.store.Stat(rel)
+	if err != nil {
+		return
+	}
+	sum, err := hex.DecodeString(a.fileChecksum(object))
+	if err != nil || len(sum) == 0 {
+		return
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(sum)
+	c.Set("Repr-Digest", "sha-256=:"+encoded+":")
+	c.Set("Digest", "SHA-256="+encoded)
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"crypto/cipher"
+	"io"
+	"io/fs"
+	"os"
+	"seclink/crypt"
+	"seclink/db"
+	"seclink/log"
+	"seclink/storage"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// Files in storage are either plain or encrypted at rest, see the crypt
+// package. Everything that reads or writes file content goes through here so
+// both kinds are handled the same
+
+// Opens the content of the file at rel, decrypting it when it is stored
+// encrypted, along with its length
+func openContent(store storage.IStorage, rel string) (io.ReadSeekCloser, int64, error) {
+	file, err := store.Open(rel)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !crypt.IsEncrypted(file) {
+		return file, file.Size(), nil
+	}
+	reader, err := crypt.NewReader(file, file.Size())
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return reader, reader.Size(), nil
+}
+
+// Creates the file at rel for new content, encrypted when encryption.enabled
+// is set. The content is complete once it is closed
+func (a *SSeclinkApi) createContent(rel string) (storage.IWriter, error) {
+	if !crypt.Enabled() {
+		return a.store.Create(rel)
+	}
+	key, err := crypt.Master()
+	if err != nil {
+		return nil, err
+	}
+	file, err := a.store.Create(rel)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := crypt.NewWriter(file, key)
+	if err != nil {
+		file.Abort()
+		return nil, err
+	}
+	return &SSealedWriter{SWriter: sealed, file: file}, nil
+}
+
+// SSealedWriter encrypts new content on its way into storage
+type SSealedWriter struct {
+	*crypt.SWriter
+	file storage.IWriter
+}
+
+func (w *SSealedWriter) Abort() {
+	w.file.Abort()
+}
+
+// The size of the content of object, which for an encrypted file is less
+// than it takes in storage
+func (a *SSeclinkApi) contentSize(object storage.SObject) int64 {
+	if object.IsDir {
+		return 0
+	}
+	file, err := a.store.Open(object.Path)
+	if err != nil {
+		return object.Size
+	}
+	defer file.Close()
+	if !crypt.IsEncrypted(file) {
+		return object.Size
+	}
+	size, err := crypt.PlainSize(file, file.Size())
+	if err != nil {
+		return object.Size
+	}
+	return size
+}
+
+// SObjectInfo is the FileInfo of a file in storage with the size of its
+// content, archives are built from these
+type SObjectInfo struct {
+	object storage.SObject
+	size   int64
+}
+
+func (i SObjectInfo) Name() string { return i.object.Name }
+func (i SObjectInfo) Size() int64  { return i.size }
+func (i SObjectInfo) IsDir() bool  { return i.object.IsDir }
+func (i SObjectInfo) Sys() any     { return nil }
+
+// Folders on S3 have no time of their own, they are given the time of the archive
+func (i SObjectInfo) ModTime() time.Time {
+	if i.object.ModTime.IsZero() {
+		return time.Now()
+	}
+	return i.object.ModTime
+}
+
+// Storage may not keep permissions, archives get what suits the recipient
+func (i SObjectInfo) Mode() fs.FileMode {
+	if i.object.IsDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (a *SSeclinkApi) objectInfo(object storage.SObject) fs.FileInfo {
+	return SObjectInfo{object: object, size: a.contentSize(object)}
+}
+
+// Redirects the client to download a delivery straight from storage, when
+// storage.s3.presign is set and the storage can. Returns whether it did
+func (a *SSeclinkApi) presignedDownload(c *fiber.Ctx, delivery *SDelivery, name string) (bool, error) {
+	l := log.Get()
+
+	// A presigned URL is only good for GET, HEAD is answered here. S3 also
+	// answers at most one range, several are sent from here. Links with a
+	// rate limit of their own are sent from here too, S3 would not keep to it
+	presigner, ok := a.store.(storage.IPresigner)
+	if !ok || !viper.GetBool("storage.s3.presign") || c.Method() == fiber.MethodHead || len(delivery.Ranges) > 1 || delivery.RateLimit > 0 {
+		return false, nil
+	}
+	rel := delivery.Object.Path
+	// Storage only has the ciphertext of an encrypted file, those are still sent through seclink
+	file, err := a.store.Open(rel)
+	if err != nil {
+		return false, err
+	}
+	encrypted := crypt.IsEncrypted(file)
+	file.Close()
+	if encrypted {
+		return false, nil
+	}
+
+	url, err := presigner.PresignGet(rel, name, viper.GetDuration("storage.s3.presignexpiry"))
+	if err != nil {
+		l.Error().Err(err).Str("Path", rel).Msg("An error occurred presigning a download")
+		return false, err
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return true, c.Redirect(url, fiber.StatusFound)
+}
+
+// SLoggedReader logs a failed read, which for an encrypted file means it was
+// damaged or tampered with. The headers are sent by then so the client only
+// sees the download stop short
+type SLoggedReader struct {
+	io.ReadSeekCloser
+	path string
+}
+
+func (r *SLoggedReader) Read(p []byte) (int, error) {
+	l := log.Get()
+
+	n, err := r.ReadSeekCloser.Read(p)
+	if err != nil && err != io.EOF {
+		l.Error().Err(err).Str("Path", r.path).Msg("An error occurred reading file content")
+	}
+	return n, err
+}
+
+// A new data key for staging an upload encrypted, wrapped by the master key
+func newStagingKey() ([]byte, error) {
+	key, err := crypt.Master()
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := crypt.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	return key.WrapKey(dataKey)
+}
+
+// The keystream for the staged bytes of upload from offset, nil when it is staged plain
+func stagingStream(upload db.SUpload, offset int64) (cipher.Stream, error) {
+	if upload.StagingKey == nil {
+		return nil, nil
+	}
+	key, err := crypt.Master()
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := key.UnwrapKey(upload.StagingKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.StagingStream(dataKey, offset)
+}
+
+// Wraps the staging file of upload so bytes appended at offset are staged the way the upload is
+func stagingWriter(upload db.SUpload, file io.Writer, offset int64) (io.Writer, error) {
+	stream, err := stagingStream(upload, offset)
+	if stream == nil || err != nil {
+		return file, err
+	}
+	return cipher.StreamWriter{S: stream, W: file}, nil
+}
+
+// Writes the staged content of a finished upload to rel in storage, encrypted
+// when encryption is enabled, and removes the staged file. Returns the checksum
+func (a *SSeclinkApi) sealUpload(upload db.SUpload, rel string) (string, error) {
+	staged, err := os.Open(a.stagingPath(upload.Id))
+	if err != nil {
+		return "", err
+	}
+	defer staged.Close()
+
+	stream, err := stagingStream(upload, 0)
+	if err != nil {
+		return "", err
+	}
+	var src io.Reader = staged
+	if stream != nil {
+		src = cipher.StreamReader{S: stream, R: staged}
+	}
+
+	sum, err := a.saveHashed(src, rel)
+	if err != nil {
+		return "", err
+	}
+	return sum, os.Remove(a.stagingPath(upload.Id))
+}
+
+// Hex SHA-256 of a plain staged file, read as it is
+func hashStagedFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return hashStream(file)
+}
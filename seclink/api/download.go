@@ -0,0 +1,468 @@
+package api
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"seclink/db"
+	"seclink/log"
+	"seclink/storage"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// Downloads of single files honour conditional requests and byte ranges as
+// RFC 9110 describes. Only the request that starts a download counts against
+// the link. The response to it carries a signed cookie that lets the client
+// fetch the rest with range requests for links.resumettl, even when that was
+// the last download of the link. A range from the start of the file always
+// counts again. A bundle counts one download per session: the first file a
+// client fetches starts it, and the other files it fetches from the bundle
+// until the session ends are part of that download. The zip is a download
+// of its own
+
+// More ranges than this in one request get the whole file instead
+const maxRanges = 32
+
+var errUnsatisfiableRange = errors.New("no range overlaps the file")
+
+// SByteRange is part of a file asked for with a Range header
+type SByteRange struct {
+	Start  int64
+	Length int64
+}
+
+func (r SByteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size)
+}
+
+// SDelivery is a file about to be sent for a link, once the request has been
+// checked against it
+type SDelivery struct {
+	Id        string // Of the link
+	RateLimit int64  // Of the link, see throttle.go
+	Object    storage.SObject
+	Size      int64 // Of the content, less than the object for an encrypted file
+	ETag      string
+	Ranges    []SByteRange // Empty to send the whole file
+	Counted   bool         // Whether sending it counts as a download, HEAD and resumed downloads do not
+}
+
+// Checks a request for the file object of link id against its conditional
+// and range headers. When the request is answered without the file, a 304 or
+// an error, a nil delivery is returned along with the error
+func (a *SSeclinkApi) prepareDelivery(c *fiber.Ctx, id string, record db.SLinkRecord, object storage.SObject) (*SDelivery, error) {
+	l := log.Get()
+
+	delivery := &SDelivery{Id: id, RateLimit: record.RateLimit, Object: object, Size: a.contentSize(object)}
+	delivery.ETag = contentETag(object, delivery.Size, a.fileChecksum(object))
+	c.Set(fiber.HeaderETag, delivery.ETag)
+	if !object.ModTime.IsZero() {
+		c.Set(fiber.HeaderLastModified, object.ModTime.UTC().Format(http.TimeFormat))
+	}
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+	switch checkPreconditions(c, delivery.ETag, object.ModTime) {
+	case fiber.StatusNotModified:
+		c.Status(fiber.StatusNotModified)
+		return nil, nil
+	case fiber.StatusPreconditionFailed:
+		return nil, fiber.NewError(fiber.StatusPreconditionFailed)
+	}
+
+	if c.Method() == fiber.MethodGet && rangeApplies(c, delivery.ETag, object.ModTime) {
+		ranges, err := parseRange(c.Get(fiber.HeaderRange), delivery.Size)
+		if err != nil {
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", delivery.Size))
+			return nil, fiber.NewError(fiber.StatusRequestedRangeNotSatisfiable)
+		}
+		delivery.Ranges = ranges
+	}
+
+	delivery.Counted = c.Method() != fiber.MethodHead
+	if len(delivery.Ranges) > 0 && a.canResume(c, id, object.Path, delivery.ETag, delivery.Ranges) {
+		l.Debug().
+			Str("ID", id).
+			Str("Path", object.Path).
+			Int("Ranges", len(delivery.Ranges)).
+			Msg("Resuming download")
+		delivery.Counted = false
+	}
+	return delivery, nil
+}
+
+// Cookie carrying the right to resume the downloads of a link
+const resumeCookieName = "seclink_resume"
+
+// The resume token the request holds for link id, from the signed cookie
+// set when one of its downloads was counted
+func (a *SSeclinkApi) resumeToken(c *fiber.Ctx, id string) (string, bool) {
+	payload, ok := a.verifyValue("resume", c.Cookies(resumeCookieName))
+	if !ok {
+		return "", false
+	}
+	linkId, token, found := strings.Cut(string(payload), "/")
+	return token, found && linkId == id && token != ""
+}
+
+// The resume session the client of the request holds for link id, with the
+// time it started. It lasts links.resumettl from then
+func (a *SSeclinkApi) resumeSession(c *fiber.Ctx, id string) (string, time.Time, bool) {
+	token, ok := a.resumeToken(c, id)
+	if !ok {
+		return "", time.Time{}, false
+	}
+	started, err := a.db.GetResumeSession(id, token)
+	return token, started, err == nil
+}
+
+// Whether the request continues a download of link id this client already
+// started, it may be for any file of the link
+func (a *SSeclinkApi) resuming(c *fiber.Ctx, id string) bool {
+	if c.Get(fiber.HeaderRange) == "" {
+		return false
+	}
+	return a.inSession(c, id)
+}
+
+// Whether the client of the request holds a resume session for link id
+func (a *SSeclinkApi) inSession(c *fiber.Ctx, id string) bool {
+	_, _, ok := a.resumeSession(c, id)
+	return ok
+}
+
+// Whether ranges continue a download of this version of the file at rel
+// from link id that the client of the request already started. A range
+// from the start of the file is a new download, not the rest of one
+func (a *SSeclinkApi) canResume(c *fiber.Ctx, id string, rel string, etag string, ranges []SByteRange) bool {
+	for _, r := range ranges {
+		if r.Start == 0 {
+			return false
+		}
+	}
+	token, ok := a.resumeToken(c, id)
+	if !ok {
+		return false
+	}
+	grant, err := a.db.GetResumeGrant(id, token, rel)
+	return err == nil && grant.ETag == etag
+}
+
+// Lets the client of the request resume the download it was just counted
+// for, starting a new session with the token to do so in an HttpOnly cookie
+func (a *SSeclinkApi) allowResume(c *fiber.Ctx, id string, delivery *SDelivery) {
+	l := log.Get()
+
+	token := randomString()
+	started := time.Now()
+	ttl := viper.GetDuration("links.resumettl")
+	if !a.grantResume(id, token, started, delivery, ttl) {
+		return
+	}
+
+	expires := started.Add(ttl)
+	value, err := a.signValue("resume", []byte(id+"/"+token), expires)
+	if err != nil {
+		l.Error().Err(err).Str("ID", id).Msg("Could not sign resume cookie")
+		return
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     resumeCookieName,
+		Value:    value,
+		Path:     fmt.Sprintf("/links/%s", id),
+		Expires:  expires,
+		Secure:   strings.HasPrefix(viper.GetString("server.externalurl"), "https://"),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// Adds the file of delivery to the session the client of the request already
+// holds for link id. It ends with the rest of the session, so fetching more
+// files never makes a session last longer
+func (a *SSeclinkApi) joinSession(id string, token string, started time.Time, delivery *SDelivery) {
+	ttl := time.Until(started.Add(viper.GetDuration("links.resumettl")))
+	if ttl > 0 {
+		a.grantResume(id, token, started, delivery, ttl)
+	}
+}
+
+// Records that the holder of token may resume the file of delivery from link
+// id for ttl, returning whether it was
+func (a *SSeclinkApi) grantResume(id string, token string, started time.Time, delivery *SDelivery, ttl time.Duration) bool {
+	l := log.Get()
+
+	err := a.db.SetResumeGrant(id, token, db.SResumeGrant{
+		Path: delivery.Object.Path,
+		ETag: delivery.ETag,
+		At:   started,
+	}, ttl)
+	if err != nil {
+		l.Error().Err(err).Str("ID", id).Msg("Could not record a download for resuming")
+		return false
+	}
+	return true
+}
+
+// A strong ETag for the content of object. The checksum identifies it when
+// there is one, otherwise its size and modification time do
+func contentETag(object storage.SObject, size int64, sum string) string {
+	if len(sum) >= 32 {
+		return `"` + sum[:32] + `"`
+	}
+	return fmt.Sprintf(`"%x-%x"`, object.ModTime.UnixNano(), size)
+}
+
+// Evaluates the conditional headers of a request in the order of RFC 9110
+// section 13.2.2. Returns the status to answer with instead of the file, 0
+// when the file should be sent
+func checkPreconditions(c *fiber.Ctx, etag string, modTime time.Time) int {
+	if match := c.Get(fiber.HeaderIfMatch); match != "" {
+		if !etagMatches(match, etag, false) {
+			return fiber.StatusPreconditionFailed
+		}
+	} else if modifiedSince(modTime, c.Get(fiber.HeaderIfUnmodifiedSince)) {
+		return fiber.StatusPreconditionFailed
+	}
+
+	read := c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead
+	if noneMatch := c.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		if !etagMatches(noneMatch, etag, true) {
+			return 0
+		}
+		if read {
+			return fiber.StatusNotModified
+		}
+		return fiber.StatusPreconditionFailed
+	}
+	if read && unmodifiedSince(modTime, c.Get(fiber.HeaderIfModifiedSince)) {
+		return fiber.StatusNotModified
+	}
+	return 0
+}
+
+// Whether modTime is later than the HTTP date since, false when since is not a date
+func modifiedSince(modTime time.Time, since string) bool {
+	t, err := http.ParseTime(since)
+	if err != nil || modTime.IsZero() {
+		return false
+	}
+	// HTTP dates only go down to the second
+	return modTime.Truncate(time.Second).After(t)
+}
+
+// Whether modTime is no later than the HTTP date since, false when since is not a date
+func unmodifiedSince(modTime time.Time, since string) bool {
+	t, err := http.ParseTime(since)
+	if err != nil || modTime.IsZero() {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(t)
+}
+
+// Whether etag is in the list of entity tags of an If-Match or If-None-Match
+// header. Weak comparison ignores the weak marker, strong comparison never
+// matches a weak tag
+func etagMatches(header string, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the Range header of a request still applies, with If-Range the
+// client asks for the whole file instead when it changed
+func rangeApplies(c *fiber.Ctx, etag string, modTime time.Time) bool {
+	ifRange := strings.TrimSpace(c.Get(fiber.HeaderIfRange))
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etagMatches(ifRange, etag, false)
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && !modTime.IsZero() && modTime.Truncate(time.Second).Equal(t)
+}
+
+// Parses a Range header for a file of size bytes, no ranges means the whole
+// file. A header that can not be parsed is ignored as RFC 9110 allows, one
+// where no range overlaps the file fails with errUnsatisfiableRange
+func parseRange(header string, size int64) ([]SByteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+
+	var ranges []SByteRange
+	var total int64
+	parsed := 0
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, nil
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		parsed++
+
+		var r SByteRange
+		if first == "" {
+			// A suffix range, the last bytes of the file
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			n = min(n, size)
+			if n == 0 {
+				continue
+			}
+			r = SByteRange{Start: size - n, Length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r = SByteRange{Start: start, Length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+		total += r.Length
+	}
+
+	if parsed == 0 {
+		return nil, nil
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	// Lots of small or overlapping ranges make the server work hard for
+	// little, those clients get the whole file
+	if len(ranges) > maxRanges || total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// SPartReader sends part of a file and closes the file once it is sent
+type SPartReader struct {
+	io.Reader
+	io.Closer
+}
+
+// Sends the content of a delivery as an attachment named name, the whole
+// file or the ranges that were asked for
+func (a *SSeclinkApi) sendContent(c *fiber.Ctx, delivery *SDelivery, name string) error {
+	c.Attachment(name)
+	if c.Method() == fiber.MethodHead {
+		c.Response().Header.SetContentLength(int(delivery.Size))
+		return nil
+	}
+
+	reader, _, err := openContent(a.store, delivery.Object.Path)
+	if err != nil {
+		return err
+	}
+	throttle := a.throttle(delivery.Id, delivery.RateLimit)
+	// Plain files on local disk are handed to fasthttp as they are, so it can
+	// send them without copying, unless they have to be throttled
+	var body io.ReadSeekCloser = &SLoggedReader{ReadSeekCloser: reader, path: delivery.Object.Path}
+	if file, ok := reader.(*storage.SLocalReader); ok && throttle == nil {
+		body = file.File
+	}
+
+	switch len(delivery.Ranges) {
+	case 0:
+		return c.SendStream(throttle.Reader(body), int(delivery.Size))
+	case 1:
+		r := delivery.Ranges[0]
+		_, err = body.Seek(r.Start, io.SeekStart)
+		if err != nil {
+			body.Close()
+			throttle.Release()
+			return err
+		}
+		c.Status(fiber.StatusPartialContent)
+		c.Set(fiber.HeaderContentRange, r.contentRange(delivery.Size))
+		if r.Start+r.Length == delivery.Size {
+			return c.SendStream(throttle.Reader(body), int(r.Length))
+		}
+		return c.SendStream(throttle.Reader(&SPartReader{Reader: io.LimitReader(body, r.Length), Closer: body}), int(r.Length))
+	}
+
+	// Several ranges go out as one multipart/byteranges body
+	contentType := string(c.Response().Header.ContentType())
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	c.Status(fiber.StatusPartialContent)
+	c.Set(fiber.HeaderContentType, "multipart/byteranges; boundary="+boundary)
+	c.Response().SetBodyStreamWriter(func(w *bufio.Writer) {
+		l := log.Get()
+
+		defer body.Close()
+		defer throttle.Release()
+		err := writeRanges(throttle.Writer(w), body, delivery, contentType, boundary)
+		if err != nil {
+			l.Error().Err(err).Str("Path", delivery.Object.Path).Msg("An error occurred sending ranges of a file")
+		}
+	})
+	return nil
+}
+
+// Writes the ranges of a delivery read from r as the parts of a multipart body
+func writeRanges(w io.Writer, r io.ReadSeeker, delivery *SDelivery, contentType string, boundary string) error {
+	parts := multipart.NewWriter(w)
+	err := parts.SetBoundary(boundary)
+	if err != nil {
+		return err
+	}
+	for _, byteRange := range delivery.Ranges {
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			fiber.HeaderContentType:  {contentType},
+			fiber.HeaderContentRange: {byteRange.contentRange(delivery.Size)},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = r.Seek(byteRange.Start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(part, r, byteRange.Length)
+		if err != nil {
+			return err
+		}
+	}
+	return parts.Close()
+}
@@ -0,0 +1,330 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"seclink/db"
+	"seclink/storage"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// An API with a fresh database and files directory, serving the public link routes
+func newDownloadTestApi(t *testing.T) (*SSeclinkApi, *fiber.App, string) {
+	t.Cleanup(viper.Reset)
+	viper.Set("server.datapath", t.TempDir())
+	viper.Set("links.resumettl", time.Hour)
+
+	database := db.NewSeclinkDb()
+	err := database.Start(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	files := t.TempDir()
+	a := NewSeclinkApi(database, storage.NewLocalStorage(files)).(*SSeclinkApi)
+	app := fiber.New(fiber.Config{ErrorHandler: a.PublicErrorHandler})
+	app.Get("/links/:id", a.GetLink)
+	app.Get("/links/:id/files/:index", a.GetBundleFile)
+	app.Get("/links/:id/zip", a.GetBundleArchive)
+	return a, app, files
+}
+
+// Shares a new file called name holding content, returning the link id
+func shareTestFile(t *testing.T, a *SSeclinkApi, files string, name string, content string, record db.SLinkRecord) string {
+	t.Helper()
+	err := os.WriteFile(filepath.Join(files, name), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := GenerateLink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record.Path = name
+	err = a.db.SetLink(id, record, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// Sends a GET for target with a Range header when byteRange is set
+func rangeRequest(t *testing.T, app *fiber.App, target string, byteRange string, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(fiber.MethodGet, target, nil)
+	if byteRange != "" {
+		req.Header.Set(fiber.HeaderRange, byteRange)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestResumeLastDownload(t *testing.T) {
+	a, app, files := newDownloadTestApi(t)
+	content := "the whole of a file shared once"
+	id := shareTestFile(t, a, files, "once.txt", content, db.SLinkRecord{MaxDownloads: 1})
+	target := "/links/" + id
+
+	// The download is cut off after the first few bytes
+	resp := rangeRequest(t, app, target, "")
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("first download gave status %d", resp.StatusCode)
+	}
+	cookie := responseCookie(resp, resumeCookieName)
+	if cookie == nil {
+		t.Fatal("first download did not hand out a resume cookie")
+	}
+	got := readBody(t, resp)[:10]
+
+	// Anyone else is told the link is used up
+	resp = rangeRequest(t, app, target, "bytes=10-")
+	if resp.StatusCode != fiber.StatusGone {
+		t.Fatalf("range without the resume cookie gave status %d", resp.StatusCode)
+	}
+
+	resp = rangeRequest(t, app, target, "bytes=10-", cookie)
+	if resp.StatusCode != fiber.StatusPartialContent {
+		t.Fatalf("resuming gave status %d", resp.StatusCode)
+	}
+	got += readBody(t, resp)
+	if got != content {
+		t.Fatalf("resumed download is %q, wanted %q", got, content)
+	}
+
+	// Starting over is another download, and there are none left
+	for _, byteRange := range []string{"", "bytes=0-"} {
+		resp = rangeRequest(t, app, target, byteRange, cookie)
+		if resp.StatusCode != fiber.StatusGone {
+			t.Fatalf("downloading again with range %q gave status %d", byteRange, resp.StatusCode)
+		}
+	}
+
+	links, err := a.db.GetAllLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 0 {
+		t.Fatalf("exhausted link is still listed: %+v", links)
+	}
+}
+
+func TestExhaustedLinkGone(t *testing.T) {
+	a, app, files := newDownloadTestApi(t)
+	id := shareTestFile(t, a, files, "gone.txt", "content", db.SLinkRecord{MaxDownloads: 1})
+
+	// Nothing can resume a download that is not kept, the link goes at once
+	_, err := a.db.ConsumeDownload(id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.db.GetLink(id)
+	if err != db.ErrLinkNotFound {
+		t.Fatalf("exhausted link was kept, err %v", err)
+	}
+	resp := rangeRequest(t, app, "/links/"+id, "")
+	if resp.StatusCode != fiber.StatusGone {
+		t.Fatalf("exhausted link gave status %d", resp.StatusCode)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	many := "bytes=0-0"
+	for i := 1; i <= maxRanges; i++ {
+		many += fmt.Sprintf(",%d-%d", i*2, i*2)
+	}
+
+	tests := []struct {
+		header string
+		size   int64
+		want   []SByteRange // Nil for the whole file
+		err    error
+	}{
+		{"", 100, nil, nil},
+		{"bytes=0-9", 100, []SByteRange{{0, 10}}, nil},
+		{"bytes=90-", 100, []SByteRange{{90, 10}}, nil},
+		{"bytes=-10", 100, []SByteRange{{90, 10}}, nil},
+		{"bytes=-200", 100, []SByteRange{{0, 100}}, nil},
+		{"bytes=95-200", 100, []SByteRange{{95, 5}}, nil},
+		{"bytes=0-0,99-99", 100, []SByteRange{{0, 1}, {99, 1}}, nil},
+		{"bytes= 0-9 , 20-29 ", 100, []SByteRange{{0, 10}, {20, 10}}, nil},
+		{"bytes=0-9,100-", 100, []SByteRange{{0, 10}}, nil},
+		{"bytes=0-9,,", 100, []SByteRange{{0, 10}}, nil},
+		{"bytes=100-", 100, nil, errUnsatisfiableRange},
+		{"bytes=100-200,300-", 100, nil, errUnsatisfiableRange},
+		{"bytes=-0", 100, nil, errUnsatisfiableRange},
+		{"bytes=0-", 0, nil, errUnsatisfiableRange},
+		{"bytes=-5", 0, nil, errUnsatisfiableRange},
+		{"bytes=10-5", 100, nil, nil},
+		{"bytes=abc", 100, nil, nil},
+		{"bytes=-", 100, nil, nil},
+		{"bytes=-1-5", 100, nil, nil},
+		{"bytes=0-9,x-", 100, nil, nil},
+		{"bytes=", 100, nil, nil},
+		{"items=0-9", 100, nil, nil},
+		{"bytes=0-99,0-99", 100, nil, nil},
+		{many, 1000, nil, nil},
+	}
+
+	for _, test := range tests {
+		got, err := parseRange(test.header, test.size)
+		if err != test.err {
+			t.Errorf("parseRange(%q, %d) gave error %v, wanted %v", test.header, test.size, err, test.err)
+			continue
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("parseRange(%q, %d) = %v, wanted %v", test.header, test.size, got, test.want)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	etag := `"0123456789abcdef"`
+	modTime := time.Date(2026, 3, 1, 12, 0, 0, 500, time.UTC)
+	before := modTime.Add(-time.Hour).Format(http.TimeFormat)
+	same := modTime.Format(http.TimeFormat)
+	after := modTime.Add(time.Hour).Format(http.TimeFormat)
+
+	app := fiber.New()
+	// The result goes in a header as HEAD responses have no body
+	app.All("/", func(c *fiber.Ctx) error {
+		c.Set("X-Precondition", strconv.Itoa(checkPreconditions(c, etag, modTime)))
+		return nil
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{"no conditions", fiber.MethodGet, nil, 0},
+		{"if-match", fiber.MethodGet, map[string]string{"If-Match": etag}, 0},
+		{"if-match in a list", fiber.MethodGet, map[string]string{"If-Match": `"other", ` + etag}, 0},
+		{"if-match any", fiber.MethodGet, map[string]string{"If-Match": "*"}, 0},
+		{"if-match other", fiber.MethodGet, map[string]string{"If-Match": `"other"`}, fiber.StatusPreconditionFailed},
+		{"if-match weak", fiber.MethodGet, map[string]string{"If-Match": "W/" + etag}, fiber.StatusPreconditionFailed},
+		{"if-unmodified-since later", fiber.MethodGet, map[string]string{"If-Unmodified-Since": after}, 0},
+		{"if-unmodified-since same second", fiber.MethodGet, map[string]string{"If-Unmodified-Since": same}, 0},
+		{"if-unmodified-since earlier", fiber.MethodGet, map[string]string{"If-Unmodified-Since": before}, fiber.StatusPreconditionFailed},
+		{"if-unmodified-since not a date", fiber.MethodGet, map[string]string{"If-Unmodified-Since": "yesterday"}, 0},
+		{"if-match wins over if-unmodified-since", fiber.MethodGet, map[string]string{"If-Match": etag, "If-Unmodified-Since": before}, 0},
+		{"if-none-match", fiber.MethodGet, map[string]string{"If-None-Match": etag}, fiber.StatusNotModified},
+		{"if-none-match head", fiber.MethodHead, map[string]string{"If-None-Match": etag}, fiber.StatusNotModified},
+		{"if-none-match weak", fiber.MethodGet, map[string]string{"If-None-Match": "W/" + etag}, fiber.StatusNotModified},
+		{"if-none-match any", fiber.MethodGet, map[string]string{"If-None-Match": "*"}, fiber.StatusNotModified},
+		{"if-none-match other", fiber.MethodGet, map[string]string{"If-None-Match": `"other"`}, 0},
+		{"if-none-match post", fiber.MethodPost, map[string]string{"If-None-Match": etag}, fiber.StatusPreconditionFailed},
+		{"if-none-match wins over if-modified-since", fiber.MethodGet, map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": after}, 0},
+		{"if-match checked before if-none-match", fiber.MethodGet, map[string]string{"If-Match": `"other"`, "If-None-Match": etag}, fiber.StatusPreconditionFailed},
+		{"if-modified-since same second", fiber.MethodGet, map[string]string{"If-Modified-Since": same}, fiber.StatusNotModified},
+		{"if-modified-since later", fiber.MethodGet, map[string]string{"If-Modified-Since": after}, fiber.StatusNotModified},
+		{"if-modified-since earlier", fiber.MethodGet, map[string]string{"If-Modified-Since": before}, 0},
+		{"if-modified-since post", fiber.MethodPost, map[string]string{"If-Modified-Since": after}, 0},
+		{"if-modified-since not a date", fiber.MethodGet, map[string]string{"If-Modified-Since": "yesterday"}, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/", nil)
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Header.Get("X-Precondition"); got != strconv.Itoa(test.want) {
+				t.Fatalf("got %s, wanted %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBundleSession(t *testing.T) {
+	a, app, files := newDownloadTestApi(t)
+	contents := []string{"first file", "second file"}
+	record := db.SLinkRecord{MaxDownloads: 1}
+	for i, content := range contents {
+		name := fmt.Sprintf("%d.txt", i)
+		err := os.WriteFile(filepath.Join(files, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record.Paths = append(record.Paths, name)
+	}
+	id, err := GenerateLink()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.db.SetLink(id, record, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/links/" + id
+
+	// The first file takes the only download and starts the session
+	resp := rangeRequest(t, app, target+"/files/0", "")
+	if resp.StatusCode != fiber.StatusOK || readBody(t, resp) != contents[0] {
+		t.Fatalf("first file gave status %d", resp.StatusCode)
+	}
+	cookie := responseCookie(resp, resumeCookieName)
+	if cookie == nil {
+		t.Fatal("first file did not hand out a resume cookie")
+	}
+
+	resp = rangeRequest(t, app, target+"/files/1", "")
+	if resp.StatusCode != fiber.StatusGone {
+		t.Fatalf("second file without the session gave status %d", resp.StatusCode)
+	}
+	for i, content := range contents {
+		resp = rangeRequest(t, app, fmt.Sprintf("%s/files/%d", target, i), "", cookie)
+		if resp.StatusCode != fiber.StatusOK || readBody(t, resp) != content {
+			t.Fatalf("file %d in the session gave status %d", i, resp.StatusCode)
+		}
+	}
+	resp = rangeRequest(t, app, target+"/files/1", "bytes=7-", cookie)
+	if resp.StatusCode != fiber.StatusPartialContent || readBody(t, resp) != contents[1][7:] {
+		t.Fatalf("resuming a file in the session gave status %d", resp.StatusCode)
+	}
+
+	// The zip is a download of its own
+	resp = rangeRequest(t, app, target+"/zip", "", cookie)
+	if resp.StatusCode != fiber.StatusGone {
+		t.Fatalf("zip after the last download gave status %d", resp.StatusCode)
+	}
+
+	kept, err := a.db.GetLink(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept.Downloads != 1 {
+		t.Fatalf("session counted %d downloads, wanted 1", kept.Downloads)
+	}
+}
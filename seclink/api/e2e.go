@@ -0,0 +1,135 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"seclink/db"
+	"seclink/log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// End-to-end links share a file the browser encrypted before uploading it.
+// The key only ever travels in the fragment of the link, which browsers do not
+// send, so seclink stores and serves nothing but ciphertext. e2e.js does the
+// encrypting in the admin UI and the decrypting on the public page
+//
+// The format written by e2e.js is the magic, the plaintext chunk size as a big
+// endian uint32, then the chunks each sealed with AES-256-GCM. A chunk's IV is
+// its index and its additional data flags the last chunk, so chunks can not
+// be reordered or the file cut short without decrypting failing
+
+const (
+	e2eHeaderSize = 12
+	e2eTagSize    = 16
+	e2eSuffix     = ".e2e"
+)
+
+var e2eMagic = []byte("SLE2E\x00\x00\x01")
+
+// Reads the header of the end-to-end encrypted file at rel, returning the
+// chunk size and the size of the whole file
+func (a *SSeclinkApi) readE2EHeader(rel string) (int64, int64, error) {
+	file, size, err := openContent(a.store, rel)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, e2eHeaderSize)
+	_, err = io.ReadFull(file, header)
+	if err != nil || !bytes.Equal(header[:len(e2eMagic)], e2eMagic) {
+		return 0, 0, fiber.NewError(fiber.StatusBadRequest, "the file was not encrypted end-to-end by seclink")
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[len(e2eMagic):]))
+	if chunkSize == 0 {
+		return 0, 0, fiber.NewError(fiber.StatusBadRequest, "the file was not encrypted end-to-end by seclink")
+	}
+	return chunkSize, size, nil
+}
+
+// The size of the file once decrypted, from the size of its ciphertext
+func e2ePlainSize(chunkSize int64, size int64) int64 {
+	sealed := size - e2eHeaderSize
+	chunks := (sealed + chunkSize + e2eTagSize - 1) / (chunkSize + e2eTagSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+	return max(sealed-chunks*e2eTagSize, 0)
+}
+
+// Checks a new end-to-end link shares a single file that was encrypted in the browser
+func (a *SSeclinkApi) checkE2EFile(input SCreateLink, exists bool) error {
+	l := log.Get()
+
+	if len(input.Paths) > 0 || input.Archive != "" {
+		return fiber.NewError(fiber.StatusBadRequest, "only a single file can be shared end-to-end")
+	}
+	if !exists {
+		return nil
+	}
+	_, _, err := a.readE2EHeader(input.Filepath)
+	if errors.Is(err, ErrUnsafePath) {
+		return fiber.NewError(fiber.StatusBadRequest, ErrUnsafePath.Error())
+	}
+	if err != nil {
+		l.Warn().Err(err).Str("FilePath", input.Filepath).Msg("Refusing an end-to-end link to a file that is not end-to-end encrypted")
+	}
+	return err
+}
+
+// The name to save an end-to-end file as once decrypted
+func e2eName(rel string) string {
+	return strings.TrimSuffix(path.Base(rel), e2eSuffix)
+}
+
+// Renders the page that fetches and decrypts an end-to-end link, nothing is
+// counted until the data is fetched
+func (a *SSeclinkApi) renderE2E(c *fiber.Ctx, id string, record db.SLinkRecord) error {
+	l := log.Get()
+
+	chunkSize, size, err := a.readE2EHeader(record.Path)
+	if err != nil {
+		l.Error().Err(err).Str("ID", id).Str("Path", record.Path).Msg("An end-to-end link no longer points at an end-to-end file")
+		return fiber.NewError(fiber.StatusNotFound, "file does not exist")
+	}
+	c.Set("Referrer-Policy", "no-referrer")
+	return a.Render(c, PublicE2EPage(id, e2eName(record.Path), e2ePlainSize(chunkSize, size), record.Message))
+}
+
+// Sends the ciphertext of an end-to-end link, counted as a download
+func (a *SSeclinkApi) GetE2EData(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	record, err := a.usableLink(c, id)
+	if record == nil {
+		return err
+	}
+	if !record.E2E {
+		return fiber.NewError(fiber.StatusNotFound, "file does not exist")
+	}
+
+	object, err := a.linkFile(c, id, record.Path)
+	if object == nil {
+		return err
+	}
+
+	delivery, err := a.prepareDelivery(c, id, *record, *object)
+	if delivery == nil {
+		return err
+	}
+	if delivery.Counted {
+		consumed, err := a.consumeDownload(c, id, true)
+		if consumed == nil {
+			return err
+		}
+		a.allowResume(c, id, delivery)
+		a.logDownload(c, id, record.Path, consumed, "Downloading end-to-end encrypted file")
+	}
+	c.Set("Cache-Control", "no-store")
+	return a.sendContent(c, delivery, path.Base(record.Path))
+}
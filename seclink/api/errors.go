@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"seclink/db"
+
+	"github.com/a-h/templ"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Requests on the public port end in one of these when a link can not be
+// used. PublicErrorHandler turns them, and any other error, into a page for
+// browsers or a problem details body (RFC 9457) for clients asking for JSON
+
+// SLinkError is a reason a link can not be used
+type SLinkError struct {
+	Status int
+	Code   string // Identifies the problem in the type of a problem details body
+	Title  string
+	Detail string
+}
+
+func (e *SLinkError) Error() string {
+	return e.Detail
+}
+
+var (
+	ErrLinkNotFound  = &SLinkError{fiber.StatusNotFound, "link-not-found", "Link not found", "This link does not exist, check it was copied whole."}
+	ErrLinkExpired   = &SLinkError{fiber.StatusGone, "link-expired", "Link expired", "This link has expired and is no longer available."}
+	ErrLinkExhausted = &SLinkError{fiber.StatusGone, "link-exhausted", "Link exhausted", "This link has reached its download limit and is no longer available."}
+	ErrLinkRevoked   = &SLinkError{fiber.StatusGone, "link-revoked", "Link revoked", "This link has been revoked and is no longer available."}
+	ErrLinkLocked    = &SLinkError{fiber.StatusLocked, "link-locked", "Link locked", "This link has been locked after too many incorrect passphrase attempts."}
+	ErrFileMissing   = &SLinkError{fiber.StatusGone, "file-missing", "File removed", "The file behind this link has been removed and is no longer available."}
+	ErrRateLimited   = &SLinkError{fiber.StatusTooManyRequests, "rate-limited", "Too many requests", "Too many requests came from your address, wait a moment and try again."}
+	ErrClientBanned  = &SLinkError{fiber.StatusTooManyRequests, "client-banned", "Temporarily blocked", "Too many requests for links that do not exist or with incorrect passphrases came from your address, try again later."}
+)
+
+// The error for a link that no longer exists, going by why it went
+func goneLinkError(gone db.SGoneLink) *SLinkError {
+	switch gone.Reason {
+	case db.LinkGoneExpired:
+		return ErrLinkExpired
+	case db.LinkGoneRevoked:
+		return ErrLinkRevoked
+	case db.LinkGoneFileRemoved:
+		return ErrFileMissing
+	case db.LinkGoneExhausted:
+		return ErrLinkExhausted
+	}
+	return ErrLinkNotFound
+}
+
+// SProblem is a problem details body, see RFC 9457
+type SProblem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Describes err without giving away anything internal, only link errors and
+// errors made with fiber.NewError carry their message through
+func newProblem(err error) SProblem {
+	var linkErr *SLinkError
+	if errors.As(err, &linkErr) {
+		return SProblem{
+			Type:   "tag:seclink,2024:" + linkErr.Code,
+			Title:  linkErr.Title,
+			Status: linkErr.Status,
+			Detail: linkErr.Detail,
+		}
+	}
+
+	problem := SProblem{Type: "about:blank", Status: fiber.StatusInternalServerError}
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		problem.Status = fiberErr.Code
+		problem.Detail = fiberErr.Message
+	}
+	problem.Title = utils.StatusMessage(problem.Status)
+	// Other errors can come from anywhere, what they say is only logged
+	if problem.Status >= fiber.StatusInternalServerError {
+		problem.Detail = "Something went wrong, try again later."
+	}
+	if problem.Detail == problem.Title {
+		problem.Detail = ""
+	}
+	return problem
+}
+
+// Whether the client would rather have a problem details body than a page
+func wantsProblem(c *fiber.Ctx) bool {
+	switch c.Accepts(fiber.MIMETextHTML, "application/problem+json", fiber.MIMEApplicationJSON) {
+	case "application/problem+json", fiber.MIMEApplicationJSON:
+		return true
+	}
+	return false
+}
+
+// Error handler of the public port. The error itself has already been logged
+// by the request logger
+func (a *SSeclinkApi) PublicErrorHandler(c *fiber.Ctx, err error) error {
+	problem := newProblem(err)
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	if wantsProblem(c) {
+		body, err := json.Marshal(problem)
+		if err != nil {
+			return err
+		}
+		c.Set(fiber.HeaderContentType, "application/problem+json")
+		return c.Status(problem.Status).Send(body)
+	}
+
+	message := problem.Detail
+	if message == "" {
+		message = "The page you asked for could not be shown."
+	}
+	return a.Render(c, PublicMessagePage(problem.Title, message), templ.WithStatus(problem.Status))
+}
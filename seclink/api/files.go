@@ -0,0 +1,397 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"seclink/auth"
+	"seclink/db"
+	"seclink/log"
+	"seclink/storage"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// Returned when a folder operation is given a file
+var ErrNotDirectory = storage.ErrNotDirectory
+
+// What happens to links sharing a file when it is deleted, set by files.deletepolicy
+const (
+	DeletePolicyBlock   = "block"   // Refuse to delete a file while active links share it
+	DeletePolicyCascade = "cascade" // Revoke every link sharing the file
+	DeletePolicyDangle  = "dangle"  // Leave links in place, they show a file removed page
+)
+
+// The configured delete policy, unknown values fall back to the safest
+func deletePolicy() string {
+	l := log.Get()
+
+	policy := viper.GetString("files.deletepolicy")
+	switch policy {
+	case DeletePolicyBlock, DeletePolicyCascade, DeletePolicyDangle:
+		return policy
+	}
+	l.Warn().Str("DeletePolicy", policy).Msg("Unknown files.deletepolicy, using block")
+	return DeletePolicyBlock
+}
+
+// Deletes a file from the files directory, links sharing it are handled
+// according to files.deletepolicy
+func (a *SSeclinkApi) DeleteFile(c *fiber.Ctx) error {
+	l := log.Get()
+
+	path, err := url.PathUnescape(c.Params("*"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid path")
+	}
+
+	path, err = cleanFilePath(path)
+	var object storage.SObject
+	if err == nil {
+		object, err = a.store.Stat(path)
+	}
+	if errors.Is(err, ErrUnsafePath) {
+		l.Warn().Err(err).Str("FilePath", path).Msg("Refusing to delete an unsafe path")
+		return fiber.NewError(fiber.StatusBadRequest, ErrUnsafePath.Error())
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return fiber.NewError(fiber.StatusNotFound, "file does not exist")
+	}
+	if err != nil {
+		l.Error().Err(err).Str("FilePath", path).Msg("An error occurred checking the file to delete")
+		return err
+	}
+	if object.IsDir {
+		return fiber.NewError(fiber.StatusBadRequest, "path is a directory")
+	}
+
+	links, err := a.checkFileRemoval(c, path)
+	if err != nil {
+		return err
+	}
+
+	err = a.store.Delete(path)
+	if err != nil {
+		l.Error().Err(err).Str("FilePath", path).Msg("An error occurred deleting the file")
+		return err
+	}
+	policy := deletePolicy()
+	l.Info().Str("FilePath", path).Str("DeletePolicy", policy).Msg("Deleted file")
+	a.adjustUsage(-object.Size)
+	err = a.db.DeleteFileRecord(path)
+	if err != nil && err != db.ErrFileNotFound {
+		l.Error().Err(err).Str("FilePath", path).Msg("An error occurred removing the record of a deleted file")
+	}
+	a.audit(c, db.AuditFileDeleted, path, policy)
+
+	err = a.revokeFileLinks(c, links, "file deleted")
+	if err != nil {
+		return err
+	}
+
+	return a.renderFileChange(c, fiber.StatusNoContent, parentDir(path), "", true)
+}
+
+// Checks the file at rel may be deleted or replaced, under the block policy
+// no active link may share it. Returns the links sharing it, for
+// revokeFileLinks once the file is gone
+func (a *SSeclinkApi) checkFileRemoval(c *fiber.Ctx, rel string) ([]db.SSharedLink, error) {
+	l := log.Get()
+
+	links, err := a.db.GetLinksByPath(rel)
+	if err != nil {
+		l.Error().Err(err).Str("FilePath", rel).Msg("An error occurred finding links for the file")
+		return nil, err
+	}
+
+	if deletePolicy() == DeletePolicyBlock {
+		active := 0
+		for _, link := range links {
+			if !link.Exhausted() {
+				active++
+			}
+		}
+		if active > 0 {
+			l.Info().Str("FilePath", rel).Int("ActiveLinks", active).Msg("Refusing to remove a file with active links")
+			return nil, fiber.NewError(fiber.StatusConflict, fmt.Sprintf("the file is shared by %d active links, revoke them first", active))
+		}
+	}
+	return links, nil
+}
+
+// Revokes links of a file that was deleted or replaced when the cascade
+// policy says so, detail goes in the audit log. Links to a folder the file
+// was in are kept, they still share the rest of the folder
+func (a *SSeclinkApi) revokeFileLinks(c *fiber.Ctx, links []db.SSharedLink, detail string) error {
+	l := log.Get()
+
+	if deletePolicy() != DeletePolicyCascade {
+		return nil
+	}
+	for _, link := range links {
+		if link.Archive != "" {
+			continue
+		}
+		err := a.db.DeleteLink(link.Id, db.LinkGoneFileRemoved)
+		if err != nil && err != db.ErrLinkNotFound {
+			l.Error().Err(err).Str("ID", link.Id).Msg("An error occurred revoking a link of a removed file")
+			return err
+		}
+		a.audit(c, db.AuditLinkRevoked, link.Id, detail)
+	}
+	return nil
+}
+
+// Checks the principal of c may upload to rel. Replacing a file already
+// there is held to the same rules as deleting it, files:delete and the
+// delete policy. Returns the links sharing the file being replaced
+func (a *SSeclinkApi) checkUploadTarget(c *fiber.Ctx, rel string) ([]db.SSharedLink, error) {
+	l := log.Get()
+
+	object, err := a.store.Stat(rel)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fileError(err)
+	}
+	if object.IsDir {
+		return nil, fiber.NewError(fiber.StatusConflict, "a folder already exists with that name")
+	}
+	if principal := getPrincipal(c); !principal.Can(auth.ScopeFilesDelete) {
+		l.Info().Str("FilePath", rel).Str("Principal", principal.Name).Msg("Refusing to replace a file without the delete scope")
+		return nil, fiber.NewError(fiber.StatusConflict, fmt.Sprintf("the file already exists, replacing it needs the %s scope", auth.ScopeFilesDelete))
+	}
+	return a.checkFileRemoval(c, rel)
+}
+
+// Returns the entries of dir, relative to the files directory, folders first.
+// Symlinks leading outside the files directory are left out
+func (a *SSeclinkApi) GetFileList(dir string) ([]SFile, error) {
+	objects, err := a.store.List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]SFile, 0, len(objects))
+	for _, object := range objects {
+		files = append(files, a.describeFile(object))
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].IsDir && !files[j].IsDir
+	})
+	return files, nil
+}
+
+// Describes the file or folder at rel
+func (a *SSeclinkApi) statFile(rel string) (SFile, error) {
+	object, err := a.store.Stat(rel)
+	if err != nil {
+		return SFile{}, err
+	}
+	return a.describeFile(object), nil
+}
+
+func (a *SSeclinkApi) describeFile(object storage.SObject) SFile {
+	file := SFile{
+		Path:      object.Path,
+		Name:      path.Base(object.Path),
+		IsDir:     object.IsDir,
+		ModTime:   object.ModTime,
+		TtlString: viper.GetDuration("links.defaultttl").String(),
+	}
+	if !file.IsDir {
+		file.Size = a.contentSize(object)
+		file.Sha256 = a.fileChecksum(object)
+	}
+	return file
+}
+
+// Lists a folder, the root when dir is not given
+func (a *SSeclinkApi) ListFiles(c *fiber.Ctx) error {
+	l := log.Get()
+
+	dir, err := cleanFilePath(c.Query("dir"))
+	if err != nil {
+		return fileError(err)
+	}
+	files, err := a.GetFileList(dir)
+	if err != nil {
+		l.Warn().Err(err).Str("Dir", dir).Msg("Could not list folder")
+		return fileError(err)
+	}
+
+	if isHtmx(c) {
+		return a.Render(c, AdminFileBrowser(getPrincipal(c), dir, files))
+	}
+	return c.JSON(SFileList{Dir: dir, Entries: files})
+}
+
+type SMakeDirectory struct {
+	Path string `json:"path"`
+}
+
+// Creates a folder, along with any missing parents
+func (a *SSeclinkApi) MakeDirectory(c *fiber.Ctx) error {
+	l := log.Get()
+
+	var input SMakeDirectory
+	if err := c.BodyParser(&input); err != nil {
+		l.Error().Err(err).Msg("Invalid input")
+		return err
+	}
+
+	dir, err := cleanFilePath(input.Path)
+	if err != nil {
+		return fileError(err)
+	}
+	if dir == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "a folder path is required")
+	}
+	err = a.store.MakeDir(dir)
+	if errors.Is(err, ErrUnsafePath) {
+		l.Warn().Err(err).Str("Dir", dir).Msg("Refusing to create an unsafe folder")
+		return fileError(err)
+	}
+	if errors.Is(err, storage.ErrExists) {
+		return fileError(err)
+	}
+	if err != nil {
+		l.Error().Err(err).Str("Dir", dir).Msg("An error occurred creating a folder")
+		return err
+	}
+	l.Info().Str("Dir", dir).Msg("Created folder")
+
+	return a.renderFileChange(c, fiber.StatusCreated, parentDir(dir), dir, false)
+}
+
+type SMoveFile struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Moves or renames a file or folder, links sharing it follow it to the new path
+func (a *SSeclinkApi) MoveFile(c *fiber.Ctx) error {
+	l := log.Get()
+
+	var input SMoveFile
+	if err := c.BodyParser(&input); err != nil {
+		l.Error().Err(err).Msg("Invalid input")
+		return err
+	}
+
+	from, err := cleanFilePath(input.From)
+	if err != nil {
+		return fileError(err)
+	}
+	to, err := cleanFilePath(input.To)
+	if err != nil {
+		return fileError(err)
+	}
+	if from == "" || to == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "both from and to are required")
+	}
+	if from == to {
+		return fiber.NewError(fiber.StatusBadRequest, "from and to are the same path")
+	}
+	if strings.HasPrefix(to, from+"/") {
+		return fiber.NewError(fiber.StatusBadRequest, "a folder can not be moved inside itself")
+	}
+
+	if folder, err := a.store.Stat(parentDir(to)); err != nil || !folder.IsDir {
+		if errors.Is(err, ErrUnsafePath) {
+			return fileError(err)
+		}
+		return fiber.NewError(fiber.StatusBadRequest, "the destination folder does not exist")
+	}
+
+	err = a.store.Move(from, to)
+	if errors.Is(err, storage.ErrExists) {
+		return fiber.NewError(fiber.StatusConflict, "a file or folder already exists at the destination")
+	}
+	if errors.Is(err, ErrUnsafePath) || errors.Is(err, fs.ErrNotExist) {
+		return fileError(err)
+	}
+	if err != nil {
+		l.Error().Err(err).Str("From", from).Str("To", to).Msg("An error occurred moving a file")
+		return err
+	}
+
+	moved, err := a.db.MoveLinkPaths(from, to)
+	if err != nil {
+		l.Error().Err(err).Str("From", from).Str("To", to).Msg("An error occurred updating links of a moved file")
+		return err
+	}
+	_, err = a.db.MoveFileRecords(from, to)
+	if err != nil {
+		l.Error().Err(err).Str("From", from).Str("To", to).Msg("An error occurred updating records of a moved file")
+		return err
+	}
+	l.Info().Str("From", from).Str("To", to).Int("Links", moved).Msg("Moved file")
+	a.audit(c, db.AuditFileMoved, from, to)
+
+	return a.renderFileChange(c, fiber.StatusOK, parentDir(from), to, moved > 0)
+}
+
+// Responds to a change in the files directory. API clients get the changed
+// entry, or just status when there is none, htmx gets dir re-rendered along
+// with the links table when links changed
+func (a *SSeclinkApi) renderFileChange(c *fiber.Ctx, status int, dir string, changed string, linksChanged bool) error {
+	l := log.Get()
+
+	if !isHtmx(c) {
+		if changed == "" {
+			return c.SendStatus(status)
+		}
+		file, err := a.statFile(changed)
+		if err != nil {
+			return fileError(err)
+		}
+		return c.Status(status).JSON(file)
+	}
+
+	data, err := a.GetUiData(getPrincipal(c), dir)
+	if err != nil {
+		l.Error().Err(err).Msg("failed to get required ui data")
+		return err
+	}
+	if linksChanged {
+		return a.Render(c, AdminFilesChanged(data.User, data.Dir, data.SharedLinks, data.Files))
+	}
+	return a.Render(c, AdminFileBrowser(data.User, data.Dir, data.Files))
+}
+
+// The folder holding a cleaned path, empty for the root
+func parentDir(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// Maps file system errors to responses
+func fileError(err error) error {
+	switch {
+	case errors.Is(err, ErrUnsafePath):
+		return fiber.NewError(fiber.StatusBadRequest, ErrUnsafePath.Error())
+	case errors.Is(err, ErrNotDirectory):
+		return fiber.NewError(fiber.StatusBadRequest, ErrNotDirectory.Error())
+	case errors.Is(err, storage.ErrExists):
+		return fiber.NewError(fiber.StatusConflict, storage.ErrExists.Error())
+	case errors.Is(err, fs.ErrNotExist):
+		return fiber.NewError(fiber.StatusNotFound, "file or folder does not exist")
+	}
+	return err
+}
+
+// The admin API URL of a file, each path segment is escaped
+func fileApiUrl(path string) string {
+	return "/api/v1/files/" + (&url.URL{Path: path}).EscapedPath()
+}
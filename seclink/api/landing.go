@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"path"
+	"seclink/db"
+	"seclink/log"
+	"seclink/storage"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Link previews in chat and mail clients fetch links as soon as they are
+// pasted. Landing links answer a GET with a page describing the file, the
+// download itself only starts on a POST from the button on that page
+
+// The longest message a link can carry for its recipients
+const maxLinkMessage = 2000
+
+// SFormBool accepts a JSON bool or a string, the json-enc htmx extension
+// sends a checked box as its value
+type SFormBool bool
+
+func (b *SFormBool) UnmarshalJSON(data []byte) error {
+	var value bool
+	if json.Unmarshal(data, &value) == nil {
+		*b = SFormBool(value)
+		return nil
+	}
+	var text string
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return err
+	}
+	if text == "on" {
+		*b = true
+		return nil
+	}
+	value, err = strconv.ParseBool(text)
+	*b = SFormBool(value)
+	return err
+}
+
+// What the landing page of a link shows
+type SLandingPage struct {
+	Id            string
+	Name          string
+	Folder        bool // Set for folder links, they have no size or checksum until streamed
+	Size          int64
+	Sha256        string
+	ExpiresAt     time.Time // Zero when the link never expires
+	DownloadsLeft int       // 0 when the link has no download limit
+	Message       string
+}
+
+// Renders the landing page of a link, nothing is counted until its button is pressed
+func (a *SSeclinkApi) renderLanding(c *fiber.Ctx, id string, record db.SLinkRecord, object storage.SObject) error {
+	l := log.Get()
+
+	link, err := a.db.GetSharedLink(id)
+	if err == db.ErrLinkNotFound {
+		return a.missingLink(id)
+	}
+	if err != nil {
+		l.Error().Err(err).Str("ID", id).Msg("Could not read link from database")
+		return err
+	}
+
+	page := SLandingPage{
+		Id:        id,
+		Name:      path.Base(record.Path),
+		ExpiresAt: link.ExpiresAt,
+		Message:   record.Message,
+	}
+	if record.Archive != "" {
+		page.Name += "." + record.Archive
+		page.Folder = true
+	} else {
+		page.Size = a.contentSize(object)
+		page.Sha256 = a.fileChecksum(object)
+	}
+	if record.MaxDownloads > 0 {
+		page.DownloadsLeft = record.MaxDownloads - record.Downloads
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return a.Render(c, PublicLandingPage(page))
+}
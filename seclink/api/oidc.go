@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"seclink/auth"
+	"seclink/db"
+	"seclink/log"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// Cookie carrying the state, nonce and PKCE verifier between login and callback
+	oidcCookieName = "seclink_oidc"
+	// How long the user has to complete the login at the IdP
+	oidcLoginTimeout = 10 * time.Minute
+	// How long discovery and the code exchange may wait on the IdP
+	oidcRequestTimeout = 30 * time.Second
+)
+
+// Login attempt details kept in the signed OIDC cookie
+type SOidcLogin struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	PkceVerifier string `json:"pkceVerifier"`
+}
+
+// Returns the OIDC provider, discovering it on first use so an IdP outage at
+// startup does not stop the server or local logins. Discovery is not tied to
+// the request that triggered it, the provider outlives it
+func (a *SSeclinkApi) getOidcProvider() (*auth.SOidcProvider, error) {
+	a.oidcMutex.Lock()
+	defer a.oidcMutex.Unlock()
+
+	if a.oidcProvider != nil {
+		return a.oidcProvider, nil
+	}
+
+	config, err := auth.GetOidcConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcRequestTimeout)
+	defer cancel()
+	provider, err := auth.NewOidcProvider(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	a.oidcProvider = provider
+	return provider, nil
+}
+
+// Starts an OIDC login by redirecting to the IdP
+func (a *SSeclinkApi) OidcLogin(c *fiber.Ctx) error {
+	l := log.Get()
+
+	provider, err := a.getOidcProvider()
+	if err != nil {
+		l.Error().Err(err).Msg("OIDC provider is unavailable")
+		return a.Render(c, AdminLoginPage("Single sign-on is currently unavailable", true), templ.WithStatus(fiber.StatusServiceUnavailable))
+	}
+
+	login := SOidcLogin{
+		State:        randomString(),
+		Nonce:        randomString(),
+		PkceVerifier: oauth2.GenerateVerifier(),
+	}
+	payload, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(oidcLoginTimeout)
+	value, err := a.signValue("oidc", payload, expires)
+	if err != nil {
+		l.Error().Err(err).Msg("Could not sign OIDC cookie")
+		return err
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     "/auth/oidc",
+		Expires:  expires,
+		Secure:   viper.GetBool("auth.securecookie"),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	return c.Redirect(provider.AuthCodeURL(login.State, login.Nonce, login.PkceVerifier), fiber.StatusSeeOther)
+}
+
+// Completes an OIDC login when the IdP redirects back
+func (a *SSeclinkApi) OidcCallback(c *fiber.Ctx) error {
+	l := log.Get()
+
+	payload, ok := a.verifyValue("oidc", c.Cookies(oidcCookieName))
+	c.ClearCookie(oidcCookieName)
+	var login SOidcLogin
+	if !ok || json.Unmarshal(payload, &login) != nil || c.Query("state") != login.State {
+		l.Warn().Str("IP", a.clientIP(c)).Msg("OIDC callback with a missing or mismatched state")
+		return a.Render(c, AdminLoginPage("Your sign-in attempt expired, please try again", true), templ.WithStatus(fiber.StatusBadRequest))
+	}
+
+	if idpError := c.Query("error"); idpError != "" {
+		l.Warn().
+			Str("Error", idpError).
+			Str("Description", c.Query("error_description")).
+			Msg("IdP returned an error to the OIDC callback")
+		return a.Render(c, AdminLoginPage("Sign-in was cancelled or refused by the identity provider", true), templ.WithStatus(fiber.StatusUnauthorized))
+	}
+
+	provider, err := a.getOidcProvider()
+	if err != nil {
+		l.Error().Err(err).Msg("OIDC provider is unavailable")
+		return a.Render(c, AdminLoginPage("Single sign-on is currently unavailable", true), templ.WithStatus(fiber.StatusServiceUnavailable))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), oidcRequestTimeout)
+	defer cancel()
+	principal, err := provider.Exchange(ctx, c.Query("code"), login.Nonce, login.PkceVerifier)
+	if err == auth.ErrGroupNotAllowed {
+		l.Warn().Str("IP", a.clientIP(c)).Msg("OIDC user is not in an allowed group")
+		a.auditAs(c, "", db.AuditLoginFailed, "", "oidc user not in an allowed group")
+		return a.Render(c, AdminLoginPage("You are not allowed to use seclink", true), templ.WithStatus(fiber.StatusForbidden))
+	}
+	if err != nil {
+		l.Error().Err(err).Msg("OIDC login failed")
+		a.auditAs(c, "", db.AuditLoginFailed, "", "oidc login failed")
+		return a.Render(c, AdminLoginPage("Single sign-on failed, please try again", true), templ.WithStatus(fiber.StatusUnauthorized))
+	}
+
+	err = a.startSession(c, principal)
+	if err != nil {
+		return err
+	}
+	return c.Redirect("/admin", fiber.StatusSeeOther)
+}
+
+// A random URL safe string for OIDC state and nonce values
+func randomString() string {
+	raw := make([]byte, 32)
+	_, _ = rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
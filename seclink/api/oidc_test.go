@@ -0,0 +1,390 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"seclink/auth"
+	"seclink/db"
+	"seclink/storage"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+const (
+	testClientId    = "seclink"
+	testRedirectUrl = "http://seclink.test/auth/oidc/callback"
+)
+
+// SMockIssuer is an OpenID provider that signs in whoever it is told to,
+// checking the client and PKCE the way a real one would
+type SMockIssuer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	mutex    sync.Mutex
+	grants   map[string]SMockGrant // Issued codes, each can be used once
+	username string
+	groups   []string
+	nonce    string // When set, put in ID tokens instead of the nonce asked for
+}
+
+type SMockGrant struct {
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *SMockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &SMockIssuer{key: key, grants: make(map[string]SMockGrant), username: "alice", groups: []string{"staff", "admins"}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", issuer.discovery)
+	mux.HandleFunc("/authorize", issuer.authorize)
+	mux.HandleFunc("/token", issuer.token)
+	mux.HandleFunc("/keys", issuer.keys)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (i *SMockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                i.URL,
+		"authorization_endpoint":                i.URL + "/authorize",
+		"token_endpoint":                        i.URL + "/token",
+		"jwks_uri":                              i.URL + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// Signs the user straight in and sends the browser back with a code
+func (i *SMockIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != testClientId || query.Get("redirect_uri") != testRedirectUrl ||
+		query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	i.mutex.Lock()
+	i.grants[code] = SMockGrant{nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	i.mutex.Unlock()
+
+	callback := url.Values{"code": {code}, "state": {query.Get("state")}}
+	http.Redirect(w, r, testRedirectUrl+"?"+callback.Encode(), http.StatusFound)
+}
+
+func (i *SMockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	clientId, secret, ok := r.BasicAuth()
+	if !ok {
+		clientId, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if clientId != testClientId || secret != "secret" {
+		tokenError(w, "invalid_client")
+		return
+	}
+
+	i.mutex.Lock()
+	grant, ok := i.grants[r.FormValue("code")]
+	delete(i.grants, r.FormValue("code"))
+	i.mutex.Unlock()
+	if !ok || r.FormValue("grant_type") != "authorization_code" {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+
+	nonce := grant.nonce
+	if i.nonce != "" {
+		nonce = i.nonce
+	}
+	now := time.Now()
+	idToken := i.sign(map[string]any{
+		"iss":                i.URL,
+		"sub":                "user-1",
+		"aud":                testClientId,
+		"iat":                now.Unix(),
+		"exp":                now.Add(time.Hour).Unix(),
+		"nonce":              nonce,
+		"preferred_username": i.username,
+		"groups":             i.groups,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func (i *SMockIssuer) keys(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+// An RS256 JWT of claims
+func (i *SMockIssuer) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// An API with a fresh database, configured to log in through issuer
+func newOidcTestApi(t *testing.T, issuer *SMockIssuer) (*SSeclinkApi, *fiber.App) {
+	t.Cleanup(viper.Reset)
+	viper.Set("server.datapath", t.TempDir())
+	viper.Set("auth.sessionttl", time.Hour)
+	viper.Set("auth.oidc.enabled", true)
+	viper.Set("auth.oidc.issuer", issuer.URL)
+	viper.Set("auth.oidc.clientid", testClientId)
+	viper.Set("auth.oidc.clientsecret", "secret")
+	viper.Set("auth.oidc.redirecturl", testRedirectUrl)
+	viper.Set("auth.oidc.usernameclaim", "preferred_username")
+	viper.Set("auth.oidc.groupsclaim", "groups")
+	viper.Set("auth.oidc.allowedgroups", []string{"staff"})
+	viper.Set("auth.oidc.rolemapping", []map[string]string{{"group": "admins", "role": auth.RoleAdmin}})
+	viper.Set("auth.oidc.defaultrole", auth.RoleViewer)
+
+	database := db.NewSeclinkDb()
+	err := database.Start(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	a := NewSeclinkApi(database, storage.NewLocalStorage(t.TempDir())).(*SSeclinkApi)
+	app := fiber.New()
+	app.Get("/auth/oidc/login", a.OidcLogin)
+	app.Get("/auth/oidc/callback", a.OidcCallback)
+	return a, app
+}
+
+func testRequest(t *testing.T, app *fiber.App, target string, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(fiber.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func responseCookie(resp *http.Response, name string) *http.Cookie {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == name && cookie.Value != "" {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// Starts a login, returning the login cookie and where the browser was sent
+func startOidcLogin(t *testing.T, app *fiber.App) (*http.Cookie, *url.URL) {
+	t.Helper()
+	resp := testRequest(t, app, "/auth/oidc/login")
+	if resp.StatusCode != fiber.StatusSeeOther {
+		t.Fatalf("login gave status %d", resp.StatusCode)
+	}
+	cookie := responseCookie(resp, oidcCookieName)
+	if cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("login did not set an HttpOnly %s cookie", oidcCookieName)
+	}
+	location, err := url.Parse(resp.Header.Get(fiber.HeaderLocation))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cookie, location
+}
+
+// Follows the redirect to the IdP, returning the query it sends back to the callback
+func authorizeAt(t *testing.T, location *url.URL) url.Values {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(location.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("IdP refused the authorization request with status %d", resp.StatusCode)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback.Query()
+}
+
+func callback(t *testing.T, app *fiber.App, query url.Values, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	if cookie == nil {
+		return testRequest(t, app, "/auth/oidc/callback?"+query.Encode())
+	}
+	return testRequest(t, app, "/auth/oidc/callback?"+query.Encode(), cookie)
+}
+
+func TestOidcLogin(t *testing.T) {
+	issuer := newMockIssuer(t)
+	a, app := newOidcTestApi(t, issuer)
+
+	cookie, location := startOidcLogin(t, app)
+	if !strings.HasPrefix(location.String(), issuer.URL+"/authorize") {
+		t.Fatalf("login redirected to %s", location)
+	}
+	for _, param := range []string{"state", "nonce", "code_challenge"} {
+		if location.Query().Get(param) == "" {
+			t.Fatalf("authorization request has no %s", param)
+		}
+	}
+
+	resp := callback(t, app, authorizeAt(t, location), cookie)
+	if resp.StatusCode != fiber.StatusSeeOther || resp.Header.Get(fiber.HeaderLocation) != "/admin" {
+		t.Fatalf("callback gave status %d to %q", resp.StatusCode, resp.Header.Get(fiber.HeaderLocation))
+	}
+	sessionCookie := responseCookie(resp, sessionCookieName)
+	if sessionCookie == nil {
+		t.Fatal("callback did not start a session")
+	}
+	session, err := a.db.GetSession(sessionCookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Username != "alice" || session.Provider != auth.OidcProviderName || session.Role != auth.RoleAdmin {
+		t.Fatalf("unexpected session %+v", session)
+	}
+}
+
+func TestOidcCallbackRejects(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		setup  func(issuer *SMockIssuer)
+		// Changes the callback the way an attacker or a broken IdP might
+		tamper func(t *testing.T, app *fiber.App, query url.Values, cookie *http.Cookie) (url.Values, *http.Cookie)
+	}{
+		"mismatched state": {
+			status: fiber.StatusBadRequest,
+			tamper: func(t *testing.T, app *fiber.App, query url.Values, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				query.Set("state", randomString())
+				return query, cookie
+			},
+		},
+		"missing login cookie": {
+			status: fiber.StatusBadRequest,
+			tamper: func(t *testing.T, app *fiber.App, query url.Values, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				return query, nil
+			},
+		},
+		"forged login cookie": {
+			status: fiber.StatusBadRequest,
+			tamper: func(t *testing.T, app *fiber.App, query url.Values, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				payload, _ := json.Marshal(SOidcLogin{State: query.Get("state"), Nonce: "n", PkceVerifier: "v"})
+				forged := base64.RawURLEncoding.EncodeToString(payload) + "." + "9999999999" + ".forged"
+				return query, &http.Cookie{Name: oidcCookieName, Value: forged}
+			},
+		},
+		"code from another login": {
+			// The code was issued against another PKCE challenge, so the
+			// verifier in this login's cookie does not match it
+			status: fiber.StatusUnauthorized,
+			tamper: func(t *testing.T, app *fiber.App, query url.Values, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				_, otherLocation := startOidcLogin(t, app)
+				query.Set("code", authorizeAt(t, otherLocation).Get("code"))
+				return query, cookie
+			},
+		},
+		"mismatched nonce": {
+			status: fiber.StatusUnauthorized,
+			setup: func(issuer *SMockIssuer) {
+				issuer.nonce = "replayed"
+			},
+		},
+		"group not allowed": {
+			status: fiber.StatusForbidden,
+			setup: func(issuer *SMockIssuer) {
+				issuer.groups = []string{"contractors"}
+			},
+		},
+		"error from the IdP": {
+			status: fiber.StatusUnauthorized,
+			tamper: func(t *testing.T, app *fiber.App, query url.Values, cookie *http.Cookie) (url.Values, *http.Cookie) {
+				query.Del("code")
+				query.Set("error", "access_denied")
+				return query, cookie
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			issuer := newMockIssuer(t)
+			if test.setup != nil {
+				test.setup(issuer)
+			}
+			_, app := newOidcTestApi(t, issuer)
+
+			cookie, location := startOidcLogin(t, app)
+			query := authorizeAt(t, location)
+			if test.tamper != nil {
+				query, cookie = test.tamper(t, app, query, cookie)
+			}
+
+			resp := callback(t, app, query, cookie)
+			if resp.StatusCode != test.status {
+				t.Fatalf("callback gave status %d, wanted %d", resp.StatusCode, test.status)
+			}
+			if responseCookie(resp, sessionCookieName) != nil {
+				t.Fatal("a session was started")
+			}
+		})
+	}
+}
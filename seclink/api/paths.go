@@ -0,0 +1,25 @@
+package api
+
+import (
+	"path"
+	"path/filepath"
+	"seclink/storage"
+)
+
+// Returned when a user supplied path would point outside the files directory
+var ErrUnsafePath = storage.ErrUnsafePath
+
+// Cleans a user supplied relative path to the form links and listings use,
+// forward slashes with no trailing slash and the root as empty. Storage still
+// checks where the result leads before touching anything
+func cleanFilePath(rel string) (string, error) {
+	err := storage.CheckPath(rel)
+	if err != nil {
+		return "", err
+	}
+	rel = path.Clean(filepath.ToSlash(rel))
+	if rel == "." {
+		return "", nil
+	}
+	return rel, nil
+}
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"seclink/db"
+	"seclink/log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+	"github.com/spf13/viper"
+)
+
+// Link IDs can not be guessed, but nothing else stops a client trying. Each
+// client address may make protection.ratelimit requests for links a minute,
+// and one that keeps asking for links that do not exist or giving incorrect
+// passphrases is banned for a while, longer each time it comes back to it
+
+// SClientFailures counts the failed requests of a client since the first one
+type SClientFailures struct {
+	count int
+	since time.Time
+}
+
+// Parses protection.trustedproxies, each an address or a range such as 10.0.0.0/8
+func parseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %s is not a valid range: %w", value, err)
+			}
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %s is not a valid address: %w", value, err)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+func (a *SSeclinkApi) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range a.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// The address of the client making the request. Behind trusted proxies it
+// is read from protection.proxyheader, walking back from the nearest hop so
+// whatever the client put in the header itself is not believed
+func (a *SSeclinkApi) clientIP(c *fiber.Ctx) string {
+	addr, ok := netip.AddrFromSlice(c.Context().RemoteIP())
+	if !ok {
+		return c.IP()
+	}
+	addr = addr.Unmap()
+	if !a.trustedProxy(addr) {
+		return addr.String()
+	}
+
+	hops := strings.Split(c.Get(viper.GetString("protection.proxyheader")), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := parseHop(hops[i])
+		if err != nil {
+			break
+		}
+		addr = hop
+		if !a.trustedProxy(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// Parses an address from a forwarding header, some proxies add the port
+func parseHop(value string) (netip.Addr, error) {
+	value = strings.TrimSpace(value)
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		addrPort, portErr := netip.ParseAddrPort(value)
+		if portErr != nil {
+			return addr, err
+		}
+		addr = addrPort.Addr()
+	}
+	return addr.Unmap(), nil
+}
+
+// Limits the requests each client makes for links, nil when protection.ratelimit is 0
+func (a *SSeclinkApi) linkRateLimiter() fiber.Handler {
+	requests := viper.GetInt("protection.ratelimit")
+	if requests <= 0 {
+		return nil
+	}
+	return limiter.New(limiter.Config{
+		Max:               requests,
+		Expiration:        time.Minute,
+		KeyGenerator:      a.clientIP,
+		LimiterMiddleware: limiter.SlidingWindow{},
+		LimitReached: func(c *fiber.Ctx) error {
+			l := log.Get()
+			l.Debug().Str("IP", a.clientIP(c)).Str("Path", c.Path()).Msg("Client is over the rate limit")
+			return ErrRateLimited
+		},
+	})
+}
+
+// Turns away banned clients, and counts requests for links that do not
+// exist against the client making them
+func (a *SSeclinkApi) protectLinks(c *fiber.Ctx) error {
+	l := log.Get()
+	ip := a.clientIP(c)
+
+	ban, err := a.db.GetBan(ip)
+	if err != nil && err != db.ErrBanNotFound {
+		// Better to serve the request than to turn everyone away
+		l.Error().Err(err).Str("IP", ip).Msg("Could not read ban from database")
+	}
+	if err == nil && ban.Active() {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(time.Until(ban.Until).Seconds()))))
+		return ErrClientBanned
+	}
+
+	err = c.Next()
+	var fiberErr *fiber.Error
+	if errors.Is(err, ErrLinkNotFound) || (errors.As(err, &fiberErr) && fiberErr.Code == fiber.StatusNotFound) {
+		a.recordFailure(c, "link not found")
+	}
+	return err
+}
+
+// Counts a failed request against the client, banning it once it has made
+// protection.maxfailures of them within protection.failurewindow
+func (a *SSeclinkApi) recordFailure(c *fiber.Ctx, reason string) {
+	maxFailures := viper.GetInt("protection.maxfailures")
+	if maxFailures <= 0 {
+		return
+	}
+	ip := a.clientIP(c)
+	now := time.Now()
+
+	a.failuresMutex.Lock()
+	failures, ok := a.failures[ip]
+	if !ok || now.Sub(failures.since) > viper.GetDuration("protection.failurewindow") {
+		failures = &SClientFailures{since: now}
+		a.failures[ip] = failures
+	}
+	failures.count++
+	count := failures.count
+	if count >= maxFailures {
+		delete(a.failures, ip)
+	}
+	a.failuresMutex.Unlock()
+
+	if count >= maxFailures {
+		a.banClient(c, ip, reason)
+	}
+}
+
+// The configured protection.bantime and protection.maxbantime, a ban must
+// last a while and can not be capped below its first length
+func banTimes() (time.Duration, time.Duration, error) {
+	banTime := viper.GetDuration("protection.bantime")
+	maxBanTime := viper.GetDuration("protection.maxbantime")
+	if banTime <= 0 {
+		return 0, 0, fmt.Errorf("protection.bantime must be a positive duration, got %s", banTime)
+	}
+	if maxBanTime < banTime {
+		return 0, 0, fmt.Errorf("protection.maxbantime %s is shorter than protection.bantime %s", maxBanTime, banTime)
+	}
+	return banTime, maxBanTime, nil
+}
+
+// Bans a client for protection.bantime, doubled for each earlier ban it is
+// still remembered for, up to protection.maxbantime
+func (a *SSeclinkApi) banClient(c *fiber.Ctx, ip string, reason string) {
+	l := log.Get()
+
+	length, maxBanTime, err := banTimes()
+	if err != nil {
+		l.Error().Err(err).Str("IP", ip).Msg("Could not ban client")
+		return
+	}
+
+	ban, err := a.db.GetBan(ip)
+	if err != nil && err != db.ErrBanNotFound {
+		l.Error().Err(err).Str("IP", ip).Msg("Could not read ban from database")
+		return
+	}
+	ban.Ip = ip
+	ban.Strikes++
+	ban.Reason = reason
+	ban.BannedAt = time.Now()
+
+	for i := 1; i < ban.Strikes && length < maxBanTime; i++ {
+		length *= 2
+	}
+	length = min(length, maxBanTime)
+	ban.Until = ban.BannedAt.Add(length)
+
+	// Strikes are forgotten once the client keeps clear for maxbantime
+	err = a.db.SetBan(ban, length+maxBanTime)
+	if err != nil {
+		l.Error().Err(err).Str("IP", ip).Msg("Could not store ban")
+		return
+	}
+
+	l.Warn().
+		Str("IP", ip).
+		Str("Reason", reason).
+		Int("Strikes", ban.Strikes).
+		Time("Until", ban.Until).
+		Msg("Banned client from the public port")
+	a.auditAs(c, "", db.AuditClientBanned, ip, fmt.Sprintf("%s, banned for %s", reason, length))
+}
+
+// Forgets failures once they are too old to lead to a ban
+func (a *SSeclinkApi) expireFailures() {
+	for {
+		window := viper.GetDuration("protection.failurewindow")
+		a.failuresMutex.Lock()
+		for ip, failures := range a.failures {
+			if time.Since(failures.since) > window {
+				delete(a.failures, ip)
+			}
+		}
+		a.failuresMutex.Unlock()
+
+		time.Sleep(max(window, time.Minute))
+	}
+}
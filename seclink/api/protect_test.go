@@ -0,0 +1,37 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestBanTimes(t *testing.T) {
+	t.Cleanup(viper.Reset)
+
+	tests := []struct {
+		banTime    time.Duration
+		maxBanTime time.Duration
+		valid      bool
+	}{
+		{5 * time.Minute, 24 * time.Hour, true},
+		{time.Hour, time.Hour, true},
+		{0, 24 * time.Hour, false},
+		{-time.Minute, 24 * time.Hour, false},
+		{5 * time.Minute, 0, false},
+		{time.Hour, time.Minute, false},
+	}
+
+	for _, test := range tests {
+		viper.Set("protection.bantime", test.banTime)
+		viper.Set("protection.maxbantime", test.maxBanTime)
+		banTime, maxBanTime, err := banTimes()
+		if test.valid && (err != nil || banTime != test.banTime || maxBanTime != test.maxBanTime) {
+			t.Errorf("bantime %s, maxbantime %s gave %s, %s, %v", test.banTime, test.maxBanTime, banTime, maxBanTime, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("bantime %s, maxbantime %s was accepted", test.banTime, test.maxBanTime)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// End-to-end encrypted links, see e2e.go. Files are encrypted here before
+// they are uploaded and decrypted here after they are downloaded, the key
+// only ever lives in the fragment of the link
+(function () {
+	const magic = new Uint8Array([0x53, 0x4c, 0x45, 0x32, 0x45, 0x00, 0x00, 0x01]); // SLE2E\0\0\1
+	const headerSize = 12;
+	const tagSize = 16;
+	const chunkSize = 1024 * 1024;
+	const suffix = ".e2e";
+
+	function base64url(bytes) {
+		let binary = "";
+		new Uint8Array(bytes).forEach((b) => (binary += String.fromCharCode(b)));
+		return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+	}
+
+	function fromBase64url(text) {
+		const binary = atob(text.replace(/-/g, "+").replace(/_/g, "/"));
+		return Uint8Array.from(binary, (c) => c.charCodeAt(0));
+	}
+
+	// The IV of a chunk is its index, every file has its own key so they never repeat
+	function chunkParams(index, last) {
+		const iv = new Uint8Array(12);
+		new DataView(iv.buffer).setBigUint64(4, BigInt(index));
+		return { name: "AES-GCM", iv: iv, additionalData: new Uint8Array([last ? 1 : 0]) };
+	}
+
+	// Encrypts file chunk by chunk, resolving with the parts of the encrypted file
+	async function encrypt(file, key, progress) {
+		const header = new Uint8Array(headerSize);
+		header.set(magic);
+		new DataView(header.buffer).setUint32(magic.length, chunkSize);
+		const parts = [header];
+
+		const chunks = Math.max(1, Math.ceil(file.size / chunkSize));
+		for (let i = 0; i < chunks; i++) {
+			const plain = await file.slice(i * chunkSize, (i + 1) * chunkSize).arrayBuffer();
+			parts.push(await crypto.subtle.encrypt(chunkParams(i, i === chunks - 1), key, plain));
+			progress(Math.min((i + 1) * chunkSize, file.size));
+		}
+		return parts;
+	}
+
+	// Decrypts the encrypted file in blob, resolving with the parts of the original
+	async function decrypt(blob, key) {
+		const header = new Uint8Array(await blob.slice(0, headerSize).arrayBuffer());
+		if (header.length < headerSize || !magic.every((b, i) => header[i] === b)) {
+			throw new Error("this is not an end-to-end encrypted file");
+		}
+		const sealedSize = new DataView(header.buffer).getUint32(magic.length) + tagSize;
+
+		const parts = [];
+		let index = 0;
+		for (let offset = headerSize; offset < blob.size || index === 0; offset += sealedSize, index++) {
+			const sealed = await blob.slice(offset, offset + sealedSize).arrayBuffer();
+			const last = offset + sealedSize >= blob.size;
+			try {
+				parts.push(await crypto.subtle.decrypt(chunkParams(index, last), key, sealed));
+			} catch (err) {
+				throw new Error("the file could not be decrypted, check the link was copied whole");
+			}
+		}
+		return parts;
+	}
+
+	// Fetches url, reporting how much has arrived
+	async function download(url, progress) {
+		const response = await fetch(url, { cache: "no-store" });
+		if (!response.ok) {
+			throw new Error(response.status === 404 ? "the file is no longer available" : "download failed with status " + response.status);
+		}
+		const total = parseInt(response.headers.get("Content-Length"), 10) || 0;
+		const reader = response.body.getReader();
+		const parts = [];
+		let done = 0;
+		for (;;) {
+			const result = await reader.read();
+			if (result.done) {
+				break;
+			}
+			parts.push(result.value);
+			done += result.value.length;
+			progress(done, total);
+		}
+		return new Blob(parts);
+	}
+
+	function save(parts, name) {
+		const url = URL.createObjectURL(new Blob(parts, { type: "application/octet-stream" }));
+		const a = document.createElement("a");
+		a.href = url;
+		a.download = name;
+		document.body.appendChild(a);
+		a.click();
+		a.remove();
+		setTimeout(() => URL.revokeObjectURL(url), 60000);
+	}
+
+	function keyFromFragment() {
+		const params = new URLSearchParams(location.hash.slice(1));
+		return params.get("key");
+	}
+
+	// Public page: fetches the ciphertext of the link and decrypts it with the key from the fragment
+	window.seclinkE2EDownload = async function (box) {
+		const button = box.querySelector("button");
+		const bar = box.querySelector(".progress-bar");
+		const status = box.querySelector(".e2e-status");
+		const text = keyFromFragment();
+		if (!text) {
+			status.textContent = "The link is missing its key, ask for the whole link including the part after #.";
+			return;
+		}
+
+		button.disabled = true;
+		try {
+			const key = await crypto.subtle.importKey("raw", fromBase64url(text), "AES-GCM", false, ["decrypt"]);
+			bar.parentElement.hidden = false;
+			const blob = await download(box.dataset.url, (done, total) => {
+				bar.style.width = total ? Math.floor((done / total) * 100) + "%" : "100%";
+			});
+			status.textContent = "Decrypting";
+			save(await decrypt(blob, key), box.dataset.name);
+			status.textContent = "Done";
+		} catch (err) {
+			status.textContent = err.message;
+			button.disabled = false;
+		}
+	};
+
+	// Admin UI: encrypts the picked file, uploads it into the folder being browsed and shares it
+	window.seclinkE2EShare = async function (form) {
+		const file = form.elements.e2eFile.files[0];
+		const button = form.querySelector("button[type=submit]");
+		const status = document.getElementById("e2eStatus");
+		const result = document.getElementById("e2eResult");
+		const current = document.querySelector("#uploadForm [name=dir]");
+		const dir = current ? current.value : "";
+		if (!file) {
+			return;
+		}
+
+		button.disabled = true;
+		result.hidden = true;
+		try {
+			const key = await crypto.subtle.generateKey({ name: "AES-GCM", length: 256 }, true, ["encrypt"]);
+			const parts = await encrypt(file, key, (done) => {
+				status.textContent = "Encrypting " + file.name + " " + (file.size ? Math.floor((done / file.size) * 100) : 100) + "%";
+			});
+			const sealed = new File(parts, file.name + suffix, { type: "application/octet-stream" });
+			await window.seclinkTusUpload(sealed, dir, (done) => {
+				status.textContent = "Uploading " + file.name + " " + Math.floor((done / sealed.size) * 100) + "%";
+			});
+
+			const response = await fetch("/api/v1/links/share", {
+				method: "POST",
+				headers: { "Content-Type": "application/json" },
+				body: JSON.stringify({
+					path: (dir ? dir + "/" : "") + sealed.name,
+					ttl: form.elements.ttl.value,
+					maxdownloads: form.elements.maxdownloads.value,
+					ratelimit: form.elements.ratelimit.value,
+					notes: form.elements.notes.value,
+					message: form.elements.message.value,
+					passphrase: form.elements.passphrase.value,
+					e2e: true,
+				}),
+			});
+			if (!response.ok) {
+				throw new Error(await response.text());
+			}
+			const link = await response.json();
+
+			result.querySelector("input").value = link.url + "#key=" + base64url(await crypto.subtle.exportKey("raw", key));
+			result.hidden = false;
+			status.textContent = "";
+			form.elements.e2eFile.value = "";
+			htmx.ajax("GET", "/api/v1/links", "#sharedLinksTable");
+			htmx.ajax("GET", "/api/v1/files?dir=" + encodeURIComponent(dir), "#fileTable");
+		} catch (err) {
+			status.textContent = file.name + ": " + err.message;
+		}
+		button.disabled = false;
+	};
+})();
@@ -0,0 +1,162 @@
+// Resumable uploads to the seclink tus endpoint. Files go up in chunks so a
+// dropped connection only costs the chunk in flight, and an upload interrupted
+// by closing the page carries on from where it stopped when the same file is
+// picked again
+(function () {
+	const endpoint = "/api/v1/uploads";
+	const chunkSize = 8 * 1024 * 1024;
+	const retryDelays = [1000, 3000, 5000, 10000];
+
+	function encodeMetadata(value) {
+		let binary = "";
+		new TextEncoder().encode(value).forEach((b) => (binary += String.fromCharCode(b)));
+		return btoa(binary);
+	}
+
+	function sleep(ms) {
+		return new Promise((resolve) => setTimeout(resolve, ms));
+	}
+
+	// Resolves with the finished request whatever its status, rejects only when the network fails
+	function request(method, url, headers, body, onProgress) {
+		return new Promise((resolve, reject) => {
+			const xhr = new XMLHttpRequest();
+			xhr.open(method, url);
+			xhr.setRequestHeader("Tus-Resumable", "1.0.0");
+			for (const [name, value] of Object.entries(headers || {})) {
+				xhr.setRequestHeader(name, value);
+			}
+			if (onProgress) {
+				xhr.upload.onprogress = (event) => onProgress(event.loaded);
+			}
+			xhr.onload = () => resolve(xhr);
+			xhr.onerror = () => reject(new Error("network error"));
+			xhr.send(body || null);
+		});
+	}
+
+	function failure(xhr) {
+		return new Error(xhr.responseText || "upload failed with status " + xhr.status);
+	}
+
+	// Identifies a file picked for dir, used to find its unfinished upload
+	function fingerprint(file, dir) {
+		return ["seclink-upload", dir, file.name, file.size, file.lastModified].join(":");
+	}
+
+	// The offset to carry on from, null when the upload is gone
+	async function currentOffset(url, length) {
+		const xhr = await request("HEAD", url);
+		if (xhr.status !== 200 || parseInt(xhr.getResponseHeader("Upload-Length"), 10) !== length) {
+			return null;
+		}
+		return parseInt(xhr.getResponseHeader("Upload-Offset"), 10);
+	}
+
+	async function create(file, dir) {
+		const xhr = await request("POST", endpoint, {
+			"Upload-Length": String(file.size),
+			"Upload-Metadata": "filename " + encodeMetadata(file.name) + ",dir " + encodeMetadata(dir),
+		});
+		if (xhr.status !== 201) {
+			throw failure(xhr);
+		}
+		return xhr.getResponseHeader("Location");
+	}
+
+	async function upload(file, dir, progress) {
+		const key = fingerprint(file, dir);
+		let url = localStorage.getItem(key);
+		let offset = null;
+		if (url) {
+			offset = await currentOffset(url, file.size).catch(() => null);
+		}
+		if (offset === null) {
+			url = await create(file, dir);
+			offset = 0;
+			localStorage.setItem(key, url);
+		}
+		progress(offset);
+
+		let attempt = 0;
+		while (offset < file.size) {
+			const start = offset;
+			const xhr = await request(
+				"PATCH",
+				url,
+				{ "Upload-Offset": String(start), "Content-Type": "application/offset+octet-stream" },
+				file.slice(start, start + chunkSize),
+				(loaded) => progress(start + loaded),
+			).catch(() => null);
+
+			if (xhr && xhr.status === 204) {
+				offset = parseInt(xhr.getResponseHeader("Upload-Offset"), 10);
+				attempt = 0;
+				progress(offset);
+				continue;
+			}
+			// A conflicting offset or a busy upload is sorted out by asking again, other client errors are final
+			if (xhr && xhr.status >= 400 && xhr.status < 500 && xhr.status !== 409 && xhr.status !== 423) {
+				localStorage.removeItem(key);
+				throw failure(xhr);
+			}
+			if (attempt >= retryDelays.length) {
+				throw new Error("upload stopped, pick the file again to resume it");
+			}
+			await sleep(retryDelays[attempt++]);
+
+			// Part of the failed chunk may have landed
+			const resumed = await currentOffset(url, file.size).catch(() => null);
+			if (resumed !== null) {
+				offset = resumed;
+			}
+		}
+		localStorage.removeItem(key);
+	}
+
+	function showProgress(text, percent) {
+		const bar = document.querySelector("#uploadProgress .progress-bar");
+		const status = document.getElementById("uploadStatus");
+		if (bar) {
+			bar.parentElement.hidden = percent === null;
+			bar.style.width = percent + "%";
+		}
+		if (status) {
+			status.textContent = text;
+		}
+	}
+
+	// Also used by e2e.js to upload what it encrypted
+	window.seclinkTusUpload = upload;
+
+	// Uploads the files picked in form into the folder it was rendered for
+	window.seclinkUpload = async function (form) {
+		const dir = form.elements.dir.value;
+		const files = Array.from(form.elements.binaryFile.files);
+		const button = form.querySelector("button[type=submit]");
+		if (files.length === 0) {
+			return;
+		}
+
+		button.disabled = true;
+		let message = "";
+		for (const file of files) {
+			try {
+				await upload(file, dir, (done) => {
+					const percent = file.size === 0 ? 100 : Math.floor((done / file.size) * 100);
+					showProgress(file.name + " " + percent + "%", percent);
+				});
+			} catch (err) {
+				message = file.name + ": " + err.message;
+				break;
+			}
+		}
+		button.disabled = false;
+
+		// Refresh whichever folder is being browsed now, the form may have been swapped out meanwhile
+		const current = document.querySelector("#uploadForm [name=dir]");
+		htmx.ajax("GET", "/api/v1/files?dir=" + encodeURIComponent(current ? current.value : dir), "#fileTable").then(() =>
+			showProgress(message, null),
+		);
+	};
+})();
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signs payload with the named server secret, producing a cookie safe
+// "<payload>.<expiry>.<hmac>" value that verifyValue accepts until expires
+func (a *SSeclinkApi) signValue(secretName string, payload []byte, expires time.Time) (string, error) {
+	signed := fmt.Sprintf("%s.%d", base64.RawURLEncoding.EncodeToString(payload), expires.Unix())
+
+	mac, err := a.mac(secretName, signed)
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + mac, nil
+}
+
+// Returns the payload of a value produced by signValue, ok is false when the
+// signature does not match or the value has expired
+func (a *SSeclinkApi) verifyValue(secretName string, value string) ([]byte, bool) {
+	// Neither base64url nor the expiry contain dots
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+
+	expected, err := a.mac(secretName, parts[0]+"."+parts[1])
+	if err != nil || !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return nil, false
+	}
+
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().After(time.Unix(unix, 0)) {
+		return nil, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	return payload, true
+}
+
+func (a *SSeclinkApi) mac(secretName string, signed string) (string, error) {
+	secret, err := a.db.GetSecret(secretName)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
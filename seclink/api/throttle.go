@@ -0,0 +1,212 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/time/rate"
+)
+
+// Downloads can be held to bandwidth.global across all of them,
+// bandwidth.perconnection each and the rate limit of their link, shared by
+// every download of that link. Each cap is a token bucket of bytes that the
+// response body waits on as it goes out
+
+// Largest piece of a body sent in one go, and the burst allowed above a cap
+const throttleChunk = 32 * 1024
+
+// A token bucket letting through bytesPerSecond, nil when it is 0 or less
+func newByteLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(min(bytesPerSecond, throttleChunk)))
+}
+
+// Parses the rate limit of a link, a size a second such as 2MB. Empty or 0
+// is unlimited
+func parseRateLimit(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	size, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, err
+	}
+	if size > math.MaxInt64 {
+		return 0, fmt.Errorf("rate limit %s is too large", value)
+	}
+	return int64(size), nil
+}
+
+// SLinkLimiter is the bucket shared by the downloads of one link
+type SLinkLimiter struct {
+	limiter *rate.Limiter
+	users   int // Downloads using it, it is dropped when the last one ends
+}
+
+// SThrottle holds a response body to the caps that apply to it
+type SThrottle struct {
+	limiters []*rate.Limiter
+	chunk    int
+	release  func()
+	once     sync.Once
+}
+
+// The throttle for a download from link id limited to linkRate bytes a
+// second, 0 for no limit of its own. Nil when no cap applies, otherwise
+// Release must be called once the body is sent
+func (a *SSeclinkApi) throttle(id string, linkRate int64) *SThrottle {
+	var limiters []*rate.Limiter
+	if a.bandwidth != nil {
+		limiters = append(limiters, a.bandwidth)
+	}
+	if connection := newByteLimiter(configSize("bandwidth.perconnection")); connection != nil {
+		limiters = append(limiters, connection)
+	}
+	release := func() {}
+	if linkRate > 0 {
+		limiters = append(limiters, a.acquireLinkLimiter(id, linkRate))
+		release = func() { a.releaseLinkLimiter(id) }
+	}
+	if len(limiters) == 0 {
+		return nil
+	}
+
+	chunk := throttleChunk
+	for _, limiter := range limiters {
+		chunk = min(chunk, limiter.Burst())
+	}
+	return &SThrottle{limiters: limiters, chunk: chunk, release: release}
+}
+
+// The bucket of link id, made on first use. The rate follows the link when it is changed
+func (a *SSeclinkApi) acquireLinkLimiter(id string, linkRate int64) *rate.Limiter {
+	a.linkLimitersMutex.Lock()
+	defer a.linkLimitersMutex.Unlock()
+
+	shared, ok := a.linkLimiters[id]
+	if !ok {
+		shared = &SLinkLimiter{limiter: newByteLimiter(linkRate)}
+		a.linkLimiters[id] = shared
+	} else if shared.limiter.Limit() != rate.Limit(linkRate) {
+		shared.limiter.SetLimit(rate.Limit(linkRate))
+		shared.limiter.SetBurst(int(min(linkRate, throttleChunk)))
+	}
+	shared.users++
+	return shared.limiter
+}
+
+func (a *SSeclinkApi) releaseLinkLimiter(id string) {
+	a.linkLimitersMutex.Lock()
+	defer a.linkLimitersMutex.Unlock()
+
+	shared, ok := a.linkLimiters[id]
+	if !ok {
+		return
+	}
+	shared.users--
+	if shared.users <= 0 {
+		delete(a.linkLimiters, id)
+	}
+}
+
+// Waits until n more bytes may go out. A link rate lowered part way through
+// a download shrinks its burst, so n is taken in pieces the bucket can hold
+func (t *SThrottle) wait(n int) error {
+	for _, limiter := range t.limiters {
+		for left := n; left > 0; {
+			take := min(left, limiter.Burst())
+			err := limiter.WaitN(context.Background(), take)
+			if err != nil {
+				return err
+			}
+			left -= take
+		}
+	}
+	return nil
+}
+
+// Gives back the link bucket, safe to call more than once. The methods of
+// a throttle all do nothing on a nil one, so callers need not check for it
+func (t *SThrottle) Release() {
+	if t == nil {
+		return
+	}
+	t.once.Do(t.release)
+}
+
+// Wraps a body being streamed from r, releasing the throttle when it is closed
+func (t *SThrottle) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &SThrottledReader{Reader: r, throttle: t}
+}
+
+// Wraps a body being written to w, for archives built as they stream
+func (t *SThrottle) Writer(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return &SThrottledWriter{Writer: w, throttle: t}
+}
+
+// SThrottledReader reads a body no faster than its throttle allows
+type SThrottledReader struct {
+	io.Reader
+	throttle *SThrottle
+}
+
+func (r *SThrottledReader) Read(p []byte) (int, error) {
+	if len(p) > r.throttle.chunk {
+		p = p[:r.throttle.chunk]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		waitErr := r.throttle.wait(n)
+		if err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// Closes what is read, when it can be closed, and releases the throttle
+func (r *SThrottledReader) Close() error {
+	r.throttle.Release()
+	if closer, ok := r.Reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// SThrottledWriter writes a body no faster than its throttle allows
+type SThrottledWriter struct {
+	io.Writer
+	throttle *SThrottle
+}
+
+func (w *SThrottledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), w.throttle.chunk)
+		err := w.throttle.wait(n)
+		if err != nil {
+			return written, err
+		}
+		n, err = w.Writer.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
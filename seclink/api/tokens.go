@@ -0,0 +1,163 @@
+package api
+
+import (
+	"fmt"
+	"seclink/auth"
+	"seclink/db"
+	"seclink/log"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type SCreateToken struct {
+	Name      string   `json:"name" form:"name"`
+	Scopes    []string `json:"scopes" form:"scopes"`
+	TtlString string   `json:"ttl" form:"ttl"` // Empty for a token that never expires
+}
+
+// Returned once on creation, the token itself can not be recovered later
+type SCreatedToken struct {
+	Token string       `json:"token"`
+	Info  db.SApiToken `json:"info"`
+}
+
+// Builds a new API token from input, used by the API and the token CLI
+func NewApiToken(input SCreateToken, createdBy string) (string, db.SApiToken, error) {
+	if input.Name == "" {
+		return "", db.SApiToken{}, fmt.Errorf("a token name is required")
+	}
+	if len(input.Scopes) == 0 {
+		return "", db.SApiToken{}, fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range input.Scopes {
+		if !slices.Contains(auth.TokenScopes, scope) {
+			return "", db.SApiToken{}, fmt.Errorf("unknown token scope %s", scope)
+		}
+	}
+
+	var expiresAt time.Time
+	if input.TtlString != "" {
+		ttl, err := time.ParseDuration(input.TtlString)
+		if err != nil || ttl <= 0 {
+			return "", db.SApiToken{}, fmt.Errorf("ttl must be a positive duration")
+		}
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	id, token, secretHash, err := auth.GenerateToken()
+	if err != nil {
+		return "", db.SApiToken{}, err
+	}
+
+	return token, db.SApiToken{
+		Id:         id,
+		Name:       input.Name,
+		SecretHash: secretHash,
+		Scopes:     input.Scopes,
+		CreatedBy:  createdBy,
+		CreatedAt:  time.Now(),
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+// Lists API tokens, without their secrets
+func (a *SSeclinkApi) GetTokens(c *fiber.Ctx) error {
+	l := log.Get()
+
+	tokens, err := a.db.GetAllTokens()
+	if err != nil {
+		l.Error().Err(err).Msg("failed to get tokens from db")
+		return err
+	}
+	for i := range tokens {
+		tokens[i].SecretHash = ""
+	}
+
+	return c.JSON(tokens)
+}
+
+// Creates an API token, the full token is only ever shown in this response
+func (a *SSeclinkApi) CreateToken(c *fiber.Ctx) error {
+	l := log.Get()
+
+	var input SCreateToken
+	if err := c.BodyParser(&input); err != nil {
+		l.Error().Err(err).Msg("Invalid input")
+		return err
+	}
+
+	token, info, err := NewApiToken(input, getPrincipal(c).Name)
+	if err != nil {
+		l.Error().Err(err).Str("Name", input.Name).Msg("Invalid token request")
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	err = a.db.SetToken(info)
+	if err != nil {
+		l.Error().Err(err).Str("Name", input.Name).Msg("An error occurred storing token")
+		return err
+	}
+	l.Info().
+		Str("TokenId", info.Id).
+		Str("Name", info.Name).
+		Strs("Scopes", info.Scopes).
+		Msg("Created API token")
+	a.audit(c, db.AuditTokenCreated, info.Id, info.Name)
+
+	if isHtmx(c) {
+		return a.renderTokenTable(c, token)
+	}
+	info.SecretHash = ""
+	return c.Status(fiber.StatusCreated).JSON(SCreatedToken{Token: token, Info: info})
+}
+
+// Revokes an API token
+func (a *SSeclinkApi) RevokeToken(c *fiber.Ctx) error {
+	l := log.Get()
+	id := c.Params("id")
+
+	err := a.db.DeleteToken(id)
+	if err == db.ErrTokenNotFound {
+		l.Error().Str("TokenId", id).Msg("Could not find token to revoke")
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		l.Error().Err(err).Str("TokenId", id).Msg("An error occurred revoking a token")
+		return err
+	}
+	l.Info().Str("TokenId", id).Msg("Revoked API token")
+	a.audit(c, db.AuditTokenRevoked, id, "")
+
+	if isHtmx(c) {
+		return a.renderTokenTable(c, "")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Admin UI page for managing API tokens
+func (a *SSeclinkApi) AdminTokensUI(c *fiber.Ctx) error {
+	l := log.Get()
+
+	tokens, err := a.db.GetAllTokens()
+	if err != nil {
+		l.Error().Err(err).Msg("failed to get tokens from db")
+		return err
+	}
+
+	return a.Render(c, AdminTokensPage(getPrincipal(c), tokens))
+}
+
+// Renders the token table fragment, newToken is shown once when not empty
+func (a *SSeclinkApi) renderTokenTable(c *fiber.Ctx, newToken string) error {
+	l := log.Get()
+
+	tokens, err := a.db.GetAllTokens()
+	if err != nil {
+		l.Error().Err(err).Msg("failed to get tokens from db")
+		return err
+	}
+
+	return a.Render(c, AdminTokenTable(tokens, newToken))
+}
@@ -0,0 +1,439 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"seclink/crypt"
+	"seclink/db"
+	"seclink/log"
+	"seclink/storage"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// Resumable uploads following the tus 1.0 protocol, see https://tus.io/protocols/resumable-upload
+// Bytes are appended straight to a staging file under datapath/uploads and
+// the file is moved into the files directory once the last byte arrives
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,termination,expiration"
+	tusContentType = "application/offset+octet-stream"
+
+	uploadSweepInterval = 10 * time.Minute // How often expireUploads looks for abandoned uploads
+)
+
+// Rejects tus requests for another protocol version, every response carries
+// the version in use
+func requireTusVersion(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	if c.Method() != fiber.MethodOptions && c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return fiber.NewError(fiber.StatusPreconditionFailed, "unsupported tus version")
+	}
+	return c.Next()
+}
+
+// Tells tus clients what this server supports
+func (a *SSeclinkApi) TusOptions(c *fiber.Ctx) error {
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	if max := maxUploadSize(); max > 0 {
+		c.Set("Tus-Max-Size", strconv.FormatInt(max, 10))
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Starts an upload. The destination comes from the filename and dir keys of
+// Upload-Metadata and is checked now so a bad name fails before any bytes are sent
+func (a *SSeclinkApi) CreateUpload(c *fiber.Ctx) error {
+	l := log.Get()
+
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Upload-Length must be a positive number")
+	}
+
+	metadata, err := parseTusMetadata(c.Get("Upload-Metadata"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "Upload-Metadata is not valid")
+	}
+	rel, err := a.uploadPath(metadata["dir"], metadata["filename"])
+	if err != nil {
+		l.Warn().Err(err).Str("Filename", metadata["filename"]).Msg("Refusing to start an upload to an unsafe path")
+		return err
+	}
+	_, err = a.checkUploadTarget(c, rel)
+	if err != nil {
+		return err
+	}
+
+	upload := db.SUpload{
+		Id:        randomString(),
+		Path:      rel,
+		Length:    length,
+		CreatedBy: getPrincipal(c).Name,
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(viper.GetDuration("uploads.expiry")),
+	}
+	if crypt.Enabled() {
+		upload.StagingKey, err = newStagingKey()
+		if err != nil {
+			l.Error().Err(err).Str("Path", rel).Msg("An error occurred creating an upload staging key")
+			return err
+		}
+	}
+
+	// The whole length is reserved against the quotas up front. The record
+	// goes before the staging file, expireUploads removes files without one
+	err = a.reserveUpload(upload)
+	if _, ok := err.(*fiber.Error); ok {
+		return err
+	}
+	if err != nil {
+		l.Error().Err(err).Str("Path", rel).Msg("An error occurred storing an upload")
+		return err
+	}
+	file, err := os.OpenFile(a.stagingPath(upload.Id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		l.Error().Err(err).Str("Path", rel).Msg("An error occurred creating an upload staging file")
+		return err
+	}
+	file.Close()
+
+	l.Info().Str("UploadId", upload.Id).Str("Path", rel).Int64("Length", length).Msg("Started upload")
+
+	c.Set(fiber.HeaderLocation, "/api/v1/uploads/"+upload.Id)
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+
+	// An empty file is complete as soon as it is created
+	if length == 0 {
+		err = a.completeUpload(c, upload, hex.EncodeToString(sha256.New().Sum(nil)))
+		if err != nil {
+			return err
+		}
+	}
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// Reports how much of an upload has arrived so a client can resume it
+func (a *SSeclinkApi) HeadUpload(c *fiber.Ctx) error {
+	upload, offset, err := a.getUpload(c.Params("id"))
+	if err != nil {
+		return err
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// Appends the request body to an upload at Upload-Offset. A dropped
+// connection keeps whatever arrived, the client asks for the offset and
+// carries on from there
+func (a *SSeclinkApi) PatchUpload(c *fiber.Ctx) error {
+	l := log.Get()
+	id := c.Params("id")
+
+	if c.Get(fiber.HeaderContentType) != tusContentType {
+		return fiber.NewError(fiber.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType)
+	}
+	clientOffset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset < 0 {
+		return fiber.NewError(fiber.StatusBadRequest, "Upload-Offset must be a positive number")
+	}
+
+	unlock, ok := a.lockUpload(id)
+	if !ok {
+		return fiber.NewError(fiber.StatusLocked, "the upload is already being written to")
+	}
+	defer unlock()
+
+	upload, offset, err := a.getUpload(id)
+	if err != nil {
+		return err
+	}
+	if clientOffset != offset {
+		return fiber.NewError(fiber.StatusConflict, fmt.Sprintf("Upload-Offset does not match the current offset %d", offset))
+	}
+
+	file, err := os.OpenFile(a.stagingPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		l.Error().Err(err).Str("UploadId", id).Msg("An error occurred opening an upload staging file")
+		return err
+	}
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+
+	dst, err := stagingWriter(upload, file, offset)
+	if err != nil {
+		file.Close()
+		l.Error().Err(err).Str("UploadId", id).Msg("An error occurred preparing to stage an upload")
+		return err
+	}
+
+	// The checksum is worked out as the bytes go by rather than reading the file back at the end
+	h := resumeHash(upload, offset)
+	if h != nil {
+		dst = io.MultiWriter(dst, h)
+	}
+	written, copyErr := io.Copy(dst, io.LimitReader(body, upload.Length-offset))
+	err = file.Close()
+	if copyErr == nil {
+		copyErr = err
+	}
+	offset += written
+	if h != nil && copyErr == nil {
+		saveHash(&upload, h, offset)
+	}
+
+	// Anything that arrived counts as progress, stale uploads are the ones that stop moving
+	upload.ExpiresAt = time.Now().Add(viper.GetDuration("uploads.expiry"))
+	err = a.db.SetUpload(upload)
+	if err != nil {
+		l.Error().Err(err).Str("UploadId", id).Msg("An error occurred extending an upload")
+		return err
+	}
+	if copyErr != nil {
+		l.Warn().Err(copyErr).Str("UploadId", id).Int64("Offset", offset).Msg("Upload interrupted")
+		return copyErr
+	}
+
+	l.Debug().Str("UploadId", id).Int64("Offset", offset).Int64("Length", upload.Length).Msg("Upload progressed")
+	if offset == upload.Length {
+		var sum string
+		if h != nil {
+			sum = hex.EncodeToString(h.Sum(nil))
+		}
+		err = a.completeUpload(c, upload, sum)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Abandons an upload, throwing away what arrived so far
+func (a *SSeclinkApi) TerminateUpload(c *fiber.Ctx) error {
+	l := log.Get()
+	id := c.Params("id")
+
+	unlock, ok := a.lockUpload(id)
+	if !ok {
+		return fiber.NewError(fiber.StatusLocked, "the upload is being written to")
+	}
+	defer unlock()
+
+	err := a.db.DeleteUpload(id)
+	if err == db.ErrUploadNotFound {
+		return fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		l.Error().Err(err).Str("UploadId", id).Msg("An error occurred terminating an upload")
+		return err
+	}
+	err = os.Remove(a.stagingPath(id))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		l.Error().Err(err).Str("UploadId", id).Msg("An error occurred removing an upload staging file")
+	}
+
+	l.Info().Str("UploadId", id).Msg("Terminated upload")
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Moves a finished upload into the files directory, replacing any file
+// already there when checkUploadTarget allows it. sum is the checksum when
+// it kept up with every byte
+func (a *SSeclinkApi) completeUpload(c *fiber.Ctx, upload db.SUpload, sum string) error {
+	l := log.Get()
+
+	// Checked again as the folders may have changed while the upload ran
+	_, err := a.store.Stat(upload.Path)
+	if errors.Is(err, ErrUnsafePath) {
+		l.Warn().Err(err).Str("UploadId", upload.Id).Str("Path", upload.Path).Msg("Upload destination is no longer safe")
+		return fileError(err)
+	}
+	replacing, err := a.checkUploadTarget(c, upload.Path)
+	if err != nil {
+		return err
+	}
+
+	replaced := a.fileSize(upload.Path)
+	local, isLocal := a.store.(storage.ILocalStorage)
+	if upload.StagingKey != nil || crypt.Enabled() || !isLocal {
+		// The staged bytes are copied into storage, hashed again on the way
+		sum, err = a.sealUpload(upload, upload.Path)
+	} else {
+		var savePath string
+		savePath, err = local.LocalPath(upload.Path)
+		if err == nil && sum == "" {
+			sum, err = hashStagedFile(a.stagingPath(upload.Id))
+		}
+		if err == nil {
+			err = os.Rename(a.stagingPath(upload.Id), savePath)
+		}
+	}
+	if err != nil {
+		l.Error().Err(err).Str("UploadId", upload.Id).Str("Path", upload.Path).Msg("An error occurred moving a finished upload")
+		return err
+	}
+	err = a.db.DeleteUpload(upload.Id)
+	if err != nil && err != db.ErrUploadNotFound {
+		l.Error().Err(err).Str("UploadId", upload.Id).Msg("An error occurred removing a finished upload")
+	}
+
+	l.Info().Str("UploadId", upload.Id).Str("Path", upload.Path).Int64("Length", upload.Length).Msg("Finished upload")
+	a.recordUpload(upload.Path, upload.CreatedBy, sum, replaced)
+	a.audit(c, db.AuditFileUploaded, upload.Path, "tus")
+	return a.revokeFileLinks(c, replacing, "file replaced")
+}
+
+// Loads an upload and its current offset
+func (a *SSeclinkApi) getUpload(id string) (db.SUpload, int64, error) {
+	l := log.Get()
+
+	upload, err := a.db.GetUpload(id)
+	if err == db.ErrUploadNotFound {
+		return upload, 0, fiber.NewError(fiber.StatusNotFound, err.Error())
+	}
+	if err != nil {
+		l.Error().Err(err).Str("UploadId", id).Msg("An error occurred reading an upload")
+		return upload, 0, err
+	}
+
+	info, err := os.Stat(a.stagingPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return upload, 0, fiber.NewError(fiber.StatusNotFound, db.ErrUploadNotFound.Error())
+	}
+	if err != nil {
+		return upload, 0, err
+	}
+	return upload, info.Size(), nil
+}
+
+// The checked destination of an upload of name into dir, relative to the files directory
+func (a *SSeclinkApi) uploadPath(dir string, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fiber.NewError(fiber.StatusBadRequest, "a filename without any folders is required")
+	}
+	dir, err := cleanFilePath(dir)
+	if err != nil {
+		return "", fileError(err)
+	}
+
+	rel := path.Join(dir, name)
+	_, err = a.store.Stat(rel)
+	if errors.Is(err, ErrUnsafePath) {
+		return "", fileError(err)
+	}
+	folder, err := a.store.Stat(dir)
+	if err != nil || !folder.IsDir {
+		return "", fiber.NewError(fiber.StatusBadRequest, "the destination folder does not exist")
+	}
+	return rel, nil
+}
+
+// Where the bytes of an upload are staged
+func (a *SSeclinkApi) stagingPath(id string) string {
+	return filepath.Join(a.uploadsPath, filepath.Base(id))
+}
+
+// Stops two requests writing to the same upload at once, ok is false when
+// another request already holds it
+func (a *SSeclinkApi) lockUpload(id string) (func(), bool) {
+	value, _ := a.uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	mutex := value.(*sync.Mutex)
+	if !mutex.TryLock() {
+		return nil, false
+	}
+	return mutex.Unlock, true
+}
+
+// Periodically removes staging files of uploads that expired without finishing
+func (a *SSeclinkApi) expireUploads() {
+	l := log.Get()
+
+	for {
+		// List the files before the records, a record is always stored before its file
+		entries, err := os.ReadDir(a.uploadsPath)
+		if err != nil {
+			l.Error().Err(err).Msg("An error occurred listing upload staging files")
+		}
+		uploads, err := a.db.GetAllUploads()
+		if err != nil {
+			l.Error().Err(err).Msg("An error occurred listing uploads")
+			entries = nil
+		}
+
+		active := make(map[string]bool)
+		for _, upload := range uploads {
+			active[upload.Id] = true
+		}
+		for _, entry := range entries {
+			if active[entry.Name()] {
+				continue
+			}
+			err = os.Remove(filepath.Join(a.uploadsPath, entry.Name()))
+			if err != nil {
+				l.Error().Err(err).Str("UploadId", entry.Name()).Msg("An error occurred removing an expired upload")
+				continue
+			}
+			l.Info().Str("UploadId", entry.Name()).Msg("Removed expired upload")
+		}
+
+		// Finished and terminated uploads leave their lock behind
+		a.uploadLocks.Range(func(key, value any) bool {
+			mutex := value.(*sync.Mutex)
+			if !active[key.(string)] && mutex.TryLock() {
+				a.uploadLocks.Delete(key)
+				mutex.Unlock()
+			}
+			return true
+		})
+
+		time.Sleep(uploadSweepInterval)
+	}
+}
+
+// Parses an Upload-Metadata header, comma separated keys each followed by a
+// space and the base64 value. Keys may have no value
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if header == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"seclink/auth"
+	"seclink/db"
+	"seclink/storage"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// An API with a fresh database and files directory serving the tus routes
+// to an admin, returning the files directory
+func newTusTestApi(t *testing.T) (*fiber.App, string) {
+	t.Cleanup(viper.Reset)
+	dataPath := t.TempDir()
+	viper.Set("server.datapath", dataPath)
+	viper.Set("uploads.expiry", time.Hour)
+	err := os.Mkdir(filepath.Join(dataPath, "uploads"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database := db.NewSeclinkDb()
+	err = database.Start(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	files := t.TempDir()
+	a := NewSeclinkApi(database, storage.NewLocalStorage(files)).(*SSeclinkApi)
+	app := fiber.New()
+	app.Use(func(c *fiber.Ctx) error {
+		c.Locals(principalKey, auth.SPrincipal{Name: "alice", Role: auth.RoleAdmin, Scopes: auth.AllScopes})
+		return c.Next()
+	})
+	app.Post("/uploads", requireTusVersion, a.CreateUpload)
+	app.Head("/uploads/:id", requireTusVersion, a.HeadUpload)
+	app.Patch("/uploads/:id", requireTusVersion, a.PatchUpload)
+	app.Delete("/uploads/:id", requireTusVersion, a.TerminateUpload)
+	return app, files
+}
+
+func tusRequest(t *testing.T, app *fiber.App, method string, target string, headers map[string]string, body string) *http.Response {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// Starts an upload of length bytes to name, returning the response
+func createUpload(t *testing.T, app *fiber.App, name string, length int) *http.Response {
+	t.Helper()
+	return tusRequest(t, app, fiber.MethodPost, "/uploads", map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(name)),
+	}, "")
+}
+
+func patchUpload(t *testing.T, app *fiber.App, location string, offset int, body string) *http.Response {
+	t.Helper()
+	return tusRequest(t, app, fiber.MethodPatch, location, map[string]string{
+		fiber.HeaderContentType: tusContentType,
+		"Upload-Offset":         strconv.Itoa(offset),
+	}, body)
+}
+
+func TestTusUpload(t *testing.T) {
+	app, files := newTusTestApi(t)
+	content := "0123456789"
+
+	resp := createUpload(t, app, "file.txt", len(content))
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("create gave status %d", resp.StatusCode)
+	}
+	location := strings.TrimPrefix(resp.Header.Get(fiber.HeaderLocation), "/api/v1")
+
+	steps := []struct {
+		name   string
+		offset int
+		body   string
+		status int
+		want   string // Upload-Offset afterwards
+	}{
+		{"first part", 0, content[:4], fiber.StatusNoContent, "4"},
+		{"offset behind", 0, content[:4], fiber.StatusConflict, "4"},
+		{"offset ahead", 6, content[6:], fiber.StatusConflict, "4"},
+		{"empty part", 4, "", fiber.StatusNoContent, "4"},
+		{"more than the length", 4, content[4:] + "extra", fiber.StatusNoContent, "10"},
+	}
+	for _, step := range steps {
+		resp = patchUpload(t, app, location, step.offset, step.body)
+		if resp.StatusCode != step.status {
+			t.Fatalf("%s: status %d, wanted %d", step.name, resp.StatusCode, step.status)
+		}
+		if step.status == fiber.StatusNoContent && resp.Header.Get("Upload-Offset") != step.want {
+			t.Fatalf("%s: offset %s, wanted %s", step.name, resp.Header.Get("Upload-Offset"), step.want)
+		}
+		if step.want != "10" {
+			head := tusRequest(t, app, fiber.MethodHead, location, nil, "")
+			if head.Header.Get("Upload-Offset") != step.want || head.Header.Get("Upload-Length") != "10" {
+				t.Fatalf("%s: HEAD gave offset %s of %s", step.name, head.Header.Get("Upload-Offset"), head.Header.Get("Upload-Length"))
+			}
+		}
+	}
+
+	saved, err := os.ReadFile(filepath.Join(files, "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != content {
+		t.Fatalf("saved %q, wanted %q", saved, content)
+	}
+	resp = tusRequest(t, app, fiber.MethodHead, location, nil, "")
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Fatalf("finished upload is still there, HEAD gave status %d", resp.StatusCode)
+	}
+}
+
+func TestTusRejects(t *testing.T) {
+	app, _ := newTusTestApi(t)
+	resp := createUpload(t, app, "file.txt", 10)
+	location := strings.TrimPrefix(resp.Header.Get(fiber.HeaderLocation), "/api/v1")
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		headers map[string]string
+		status  int
+	}{
+		{"wrong version", fiber.MethodPost, "/uploads", map[string]string{"Tus-Resumable": "0.2.0", "Upload-Length": "1"}, fiber.StatusPreconditionFailed},
+		{"no length", fiber.MethodPost, "/uploads", map[string]string{"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("a"))}, fiber.StatusBadRequest},
+		{"negative length", fiber.MethodPost, "/uploads", map[string]string{"Upload-Length": "-1"}, fiber.StatusBadRequest},
+		{"no filename", fiber.MethodPost, "/uploads", map[string]string{"Upload-Length": "1"}, fiber.StatusBadRequest},
+		{"folder in filename", fiber.MethodPost, "/uploads", map[string]string{"Upload-Length": "1", "Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("../a"))}, fiber.StatusBadRequest},
+		{"wrong content type", fiber.MethodPatch, location, map[string]string{fiber.HeaderContentType: "text/plain", "Upload-Offset": "0"}, fiber.StatusUnsupportedMediaType},
+		{"no offset", fiber.MethodPatch, location, map[string]string{fiber.HeaderContentType: tusContentType}, fiber.StatusBadRequest},
+		{"negative offset", fiber.MethodPatch, location, map[string]string{fiber.HeaderContentType: tusContentType, "Upload-Offset": "-1"}, fiber.StatusBadRequest},
+		{"unknown upload", fiber.MethodPatch, "/uploads/missing", map[string]string{fiber.HeaderContentType: tusContentType, "Upload-Offset": "0"}, fiber.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		resp := tusRequest(t, app, test.method, test.target, test.headers, "")
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: status %d, wanted %d", test.name, resp.StatusCode, test.status)
+		}
+	}
+}
+
+func TestTusQuota(t *testing.T) {
+	app, _ := newTusTestApi(t)
+	viper.Set("uploads.maxsize", "60B")
+	viper.Set("uploads.quota", "100B")
+
+	resp := createUpload(t, app, "big.txt", 61)
+	if resp.StatusCode != fiber.StatusRequestEntityTooLarge {
+		t.Fatalf("upload over the size limit gave status %d", resp.StatusCode)
+	}
+
+	// Unfinished uploads hold their whole length against the quota
+	resp = createUpload(t, app, "first.txt", 60)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("first upload gave status %d", resp.StatusCode)
+	}
+	first := strings.TrimPrefix(resp.Header.Get(fiber.HeaderLocation), "/api/v1")
+	resp = createUpload(t, app, "second.txt", 50)
+	if resp.StatusCode != fiber.StatusInsufficientStorage {
+		t.Fatalf("upload over the reserved quota gave status %d", resp.StatusCode)
+	}
+
+	resp = tusRequest(t, app, fiber.MethodDelete, first, nil, "")
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("terminate gave status %d", resp.StatusCode)
+	}
+	resp = createUpload(t, app, "second.txt", 50)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("upload after the reservation was dropped gave status %d", resp.StatusCode)
+	}
+	second := strings.TrimPrefix(resp.Header.Get(fiber.HeaderLocation), "/api/v1")
+	resp = patchUpload(t, app, second, 0, strings.Repeat("x", 50))
+	if resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("finishing the upload gave status %d", resp.StatusCode)
+	}
+
+	// Stored files count just the same
+	resp = createUpload(t, app, "third.txt", 51)
+	if resp.StatusCode != fiber.StatusInsufficientStorage {
+		t.Fatalf("upload over the used quota gave status %d", resp.StatusCode)
+	}
+	resp = createUpload(t, app, "third.txt", 50)
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("upload filling the quota gave status %d", resp.StatusCode)
+	}
+}
@@ -1,13 +1,149 @@
 package api
 
-import "seclink/db"
+import (
+	"fmt"
+	"net/url"
+	"seclink/auth"
+	"seclink/db"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type SUiData struct {
+	User        auth.SPrincipal
 	SharedLinks []db.SSharedLink
+	Dir         string // The folder Files lists, empty for the root
 	Files       []SFile
 }
 
 type SFile struct {
-	Path      string
-	TtlString string
+	Path      string    `json:"path"` // Relative to the files directory, always with forward slashes
+	Name      string    `json:"name"`
+	IsDir     bool      `json:"isDir"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	Sha256    string    `json:"sha256,omitempty"` // Only while the file matches its recorded checksum
+	TtlString string    `json:"ttl"`
+}
+
+// The contents of one folder
+type SFileList struct {
+	Dir     string  `json:"dir"`
+	Entries []SFile `json:"entries"`
+}
+
+type SBreadcrumb struct {
+	Name string
+	Path string
+}
+
+// The breadcrumbs leading to dir, starting with the root folder
+func breadcrumbs(dir string) []SBreadcrumb {
+	crumbs := []SBreadcrumb{{Name: "files", Path: ""}}
+	if dir == "" {
+		return crumbs
+	}
+
+	parts := strings.Split(dir, "/")
+	for i, part := range parts {
+		crumbs = append(crumbs, SBreadcrumb{Name: part, Path: strings.Join(parts[:i+1], "/")})
+	}
+	return crumbs
+}
+
+// Where new folders go by default, inside dir
+func folderPrefix(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
+
+// Formats a file size for display
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// The admin page showing dir
+func adminDirUrl(dir string) string {
+	if dir == "" {
+		return "/admin"
+	}
+	return "/admin?dir=" + url.QueryEscape(dir)
+}
+
+// The admin API URL listing dir
+func fileListUrl(dir string) string {
+	return "/api/v1/files?dir=" + url.QueryEscape(dir)
+}
+
+// Whether user may revoke or edit a link created by createdBy
+func canManageLink(user auth.SPrincipal, createdBy string) bool {
+	return user.Can(auth.ScopeLinksManage) && (user.Can(auth.ScopeLinksAll) || createdBy == user.Name)
+}
+
+// Value of the max downloads input, unlimited links leave it empty
+func maxDownloadsValue(maxDownloads int) string {
+	if maxDownloads == 0 {
+		return ""
+	}
+	return strconv.Itoa(maxDownloads)
+}
+
+// Value of the rate limit input, exact so saving the row leaves it as it was
+func rateLimitValue(rateLimit int64) string {
+	switch {
+	case rateLimit == 0:
+		return ""
+	case rateLimit%(1<<20) == 0:
+		return fmt.Sprintf("%dMiB", rateLimit>>20)
+	case rateLimit%1000000 == 0:
+		return fmt.Sprintf("%dMB", rateLimit/1000000)
+	case rateLimit%(1<<10) == 0:
+		return fmt.Sprintf("%dKiB", rateLimit>>10)
+	case rateLimit%1000 == 0:
+		return fmt.Sprintf("%dKB", rateLimit/1000)
+	}
+	return strconv.FormatInt(rateLimit, 10)
+}
+
+// Formats t for display, zero times show fallback instead
+func formatTime(t time.Time, fallback string) string {
+	if t.IsZero() {
+		return fallback
+	}
+	return t.Format(time.RFC3339)
+}
+
+// One line describing disk use against the limits that are set
+func usageSummary(usage SUsage) string {
+	summary := "Using " + formatSize(usage.Used+usage.Reserved)
+	if usage.Quota > 0 {
+		summary += " of " + formatSize(usage.Quota)
+	}
+	if usage.UserQuota > 0 {
+		summary += fmt.Sprintf(", %s of your %s", formatSize(usage.UserUsed), formatSize(usage.UserQuota))
+	}
+	if usage.MaxUploadSize > 0 {
+		summary += ", uploads up to " + formatSize(usage.MaxUploadSize)
+	}
+	return summary
+}
+
+// The start of a checksum, enough to compare by eye
+func shortChecksum(sum string) string {
+	if len(sum) > 12 {
+		return sum[:12]
+	}
+	return sum
 }
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"fmt"
+	"seclink/auth"
+	"seclink/db"
+	"seclink/log"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// Cookie set once a protected link has been unlocked
+const unlockCookieName = "seclink_unlock"
+
+// Checks a passphrase attempt against an unlock form POST and sets the
+// unlock cookie on success. Failed attempts are counted on the link record
+// and the link is locked once links.maxunlockattempts is reached, 0 never
+// locks it. An admin can unlock it again with a PATCH of the link
+func (a *SSeclinkApi) UnlockLink(c *fiber.Ctx) error {
+	l := log.Get()
+	id := c.Params("id")
+
+	record, err := a.db.GetLink(id)
+	if err == db.ErrLinkNotFound {
+		return a.missingLink(id)
+	}
+	if err != nil {
+		l.Error().
+			Err(err).
+			Str("ID", id).
+			Msg("Could not read link from database")
+		return err
+	}
+
+	if record.Locked {
+		return ErrLinkLocked
+	}
+	if record.PassphraseHash == "" {
+		return c.Redirect(fmt.Sprintf("/links/%s", id), fiber.StatusSeeOther)
+	}
+
+	if !auth.CheckPassword(record.PassphraseHash, c.FormValue("passphrase")) {
+		record, err = a.db.UpdateLink(id, func(record *db.SLinkRecord) error {
+			record.FailedAttempts++
+			max := viper.GetInt("links.maxunlockattempts")
+			if max > 0 && record.FailedAttempts >= max {
+				record.Locked = true
+			}
+			return nil
+		})
+		if err != nil {
+			l.Error().Err(err).Str("ID", id).Msg("Could not record failed unlock attempt")
+			return err
+		}
+
+		l.Warn().
+			Str("ID", id).
+			Str("IP", a.clientIP(c)).
+			Int("FailedAttempts", record.FailedAttempts).
+			Bool("Locked", record.Locked).
+			Msg("Incorrect passphrase for link")
+		a.recordFailure(c, "wrong passphrase")
+
+		if record.Locked {
+			a.auditAs(c, "", db.AuditLinkDenied, id, "wrong passphrase, link locked")
+			return ErrLinkLocked
+		}
+		a.auditAs(c, "", db.AuditLinkDenied, id, "wrong passphrase")
+		return a.Render(c, PublicUnlockPage(id, "Incorrect passphrase"), templ.WithStatus(fiber.StatusUnauthorized))
+	}
+
+	if record.FailedAttempts > 0 {
+		_, err = a.db.UpdateLink(id, func(record *db.SLinkRecord) error {
+			record.FailedAttempts = 0
+			return nil
+		})
+		if err != nil {
+			l.Error().Err(err).Str("ID", id).Msg("Could not reset failed unlock attempts")
+			return err
+		}
+	}
+
+	expires := time.Now().Add(viper.GetDuration("links.unlockttl"))
+	value, err := a.signValue("unlock", []byte(id), expires)
+	if err != nil {
+		l.Error().Err(err).Str("ID", id).Msg("Could not sign unlock cookie")
+		return err
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     unlockCookieName,
+		Value:    value,
+		Path:     fmt.Sprintf("/links/%s", id),
+		Expires:  expires,
+		Secure:   strings.HasPrefix(viper.GetString("server.externalurl"), "https://"),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+
+	l.Info().Str("ID", id).Msg("Link unlocked")
+	a.auditAs(c, "", db.AuditLinkUnlocked, id, "")
+	return c.Redirect(fmt.Sprintf("/links/%s", id), fiber.StatusSeeOther)
+}
+
+// Whether the request carries a valid, unexpired unlock cookie for the link
+func (a *SSeclinkApi) isUnlocked(c *fiber.Ctx, id string) bool {
+	payload, ok := a.verifyValue("unlock", c.Cookies(unlockCookieName))
+	return ok && string(payload) == id
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"seclink/db"
+	"seclink/log"
+	"seclink/storage"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/gofiber/fiber/v2"
+	"github.com/spf13/viper"
+)
+
+// Disk use of the files directory against the configured limits. Sizes are
+// in bytes and a limit of 0 is unlimited
+type SUsage struct {
+	Used          int64  `json:"used"`
+	Reserved      int64  `json:"reserved"` // Promised to uploads still in progress
+	Quota         int64  `json:"quota"`
+	User          string `json:"user,omitempty"`
+	UserUsed      int64  `json:"userUsed"`
+	UserQuota     int64  `json:"userQuota"`
+	MaxUploadSize int64  `json:"maxUploadSize"`
+}
+
+// Reads a size such as 500MB or 2GiB from config, 0 when unset or invalid
+func configSize(key string) int64 {
+	l := log.Get()
+
+	value := viper.GetString(key)
+	if value == "" || value == "0" {
+		return 0
+	}
+	size, err := humanize.ParseBytes(value)
+	if err != nil || size > math.MaxInt64 {
+		l.Warn().Err(err).Str("Key", key).Str("Value", value).Msg("Invalid size in config, treating it as unlimited")
+		return 0
+	}
+	return int64(size)
+}
+
+// The largest file that may be uploaded in one go, from uploads.maxsize
+func maxUploadSize() int64 {
+	return configSize("uploads.maxsize")
+}
+
+// The admin app body limit, enough for a multipart upload of the largest
+// allowed file plus the form around it
+func adminBodyLimit() int {
+	size := maxUploadSize()
+	if size == 0 || size > math.MaxInt-multipartOverhead {
+		return math.MaxInt
+	}
+	return int(size) + multipartOverhead
+}
+
+const multipartOverhead = 1024 * 1024
+
+// Works out disk use overall and for user. Usage per user only counts files
+// uploaded through seclink, as only those have an owner
+func (a *SSeclinkApi) usage(user string) (SUsage, error) {
+	usage := SUsage{
+		Quota:         configSize("uploads.quota"),
+		User:          user,
+		UserQuota:     configSize("uploads.userquota"),
+		MaxUploadSize: maxUploadSize(),
+	}
+
+	var err error
+	usage.Used, err = a.storeUsage()
+	if err != nil {
+		return usage, err
+	}
+
+	uploads, err := a.db.GetAllUploads()
+	if err != nil {
+		return usage, err
+	}
+	for _, upload := range uploads {
+		usage.Reserved += upload.Length
+		if upload.CreatedBy == user {
+			usage.UserUsed += upload.Length
+		}
+	}
+
+	records, err := a.db.GetAllFileRecords()
+	if err != nil {
+		return usage, err
+	}
+	for _, record := range records {
+		if record.UploadedBy != user {
+			continue
+		}
+		usage.UserUsed += a.fileSize(record.Path)
+	}
+	return usage, nil
+}
+
+// How long a walked total of storage is trusted. Changes made through seclink
+// keep it up to date, walking again picks up files changed behind its back
+const usageCacheTime = 5 * time.Minute
+
+// Bytes held in storage. Walking a large store takes a while, so the total
+// is kept and adjusted as uploads and deletes go through
+func (a *SSeclinkApi) storeUsage() (int64, error) {
+	a.storeUsedMutex.Lock()
+	defer a.storeUsedMutex.Unlock()
+
+	if !a.storeUsedAt.IsZero() && time.Since(a.storeUsedAt) < usageCacheTime {
+		return a.storeUsed, nil
+	}
+
+	// Symlinked folders are not walked into, what they hold is counted where it lives
+	var used int64
+	err := a.store.Walk("", func(object storage.SObject) error {
+		if !object.IsDir {
+			used += object.Size
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	a.storeUsed = used
+	a.storeUsedAt = time.Now()
+	return used, nil
+}
+
+// Moves the kept total of storage on by the bytes a change added or removed
+func (a *SSeclinkApi) adjustUsage(delta int64) {
+	a.storeUsedMutex.Lock()
+	a.storeUsed += delta
+	a.storeUsedMutex.Unlock()
+}
+
+// Size of the file at rel as stored, 0 when there is none
+func (a *SSeclinkApi) fileSize(rel string) int64 {
+	object, err := a.store.Stat(rel)
+	if err != nil || object.IsDir {
+		return 0
+	}
+	return object.Size
+}
+
+// Checks an upload of size bytes to rel by user against the size limit and
+// quotas, before anything is written. A file being replaced gives its space back
+func (a *SSeclinkApi) checkUpload(user string, rel string, size int64) error {
+	l := log.Get()
+
+	max := maxUploadSize()
+	if max > 0 && size > max {
+		return fiber.NewError(fiber.StatusRequestEntityTooLarge, fmt.Sprintf("uploads are limited to %s", formatSize(max)))
+	}
+
+	usage, err := a.usage(user)
+	if err != nil {
+		l.Error().Err(err).Msg("An error occurred working out disk usage")
+		return err
+	}
+
+	replaced := a.fileSize(rel)
+	if usage.Quota > 0 && usage.Used+usage.Reserved-replaced+size > usage.Quota {
+		l.Info().Str("Path", rel).Int64("Size", size).Int64("Used", usage.Used).Int64("Quota", usage.Quota).Msg("Refusing an upload over the storage quota")
+		return fiber.NewError(fiber.StatusInsufficientStorage, fmt.Sprintf("the upload would exceed the storage quota of %s", formatSize(usage.Quota)))
+	}
+
+	if usage.UserQuota > 0 {
+		record, err := a.db.GetFileRecord(rel)
+		if err != nil && !errors.Is(err, db.ErrFileNotFound) {
+			return err
+		}
+		if err != nil || record.UploadedBy != user {
+			replaced = 0
+		}
+		if usage.UserUsed-replaced+size > usage.UserQuota {
+			l.Info().Str("Path", rel).Str("User", user).Int64("Size", size).Int64("Used", usage.UserUsed).Int64("Quota", usage.UserQuota).Msg("Refusing an upload over the user quota")
+			return fiber.NewError(fiber.StatusInsufficientStorage, fmt.Sprintf("the upload would exceed your quota of %s", formatSize(usage.UserQuota)))
+		}
+	}
+	return nil
+}
+
+// Checks an upload against the quotas and reserves its length by storing its
+// record, both under quotaMutex so another upload can not be checked in
+// between. The reservation lasts until the record is deleted or expires
+func (a *SSeclinkApi) reserveUpload(upload db.SUpload) error {
+	a.quotaMutex.Lock()
+	defer a.quotaMutex.Unlock()
+
+	err := a.checkUpload(upload.CreatedBy, upload.Path, upload.Length)
+	if err != nil {
+		return err
+	}
+	return a.db.SetUpload(upload)
+}
+
+// Drops the reservation of an upload that was written straight to storage
+// rather than staged through tus
+func (a *SSeclinkApi) releaseUpload(id string) {
+	l := log.Get()
+
+	err := a.db.DeleteUpload(id)
+	if err != nil && err != db.ErrUploadNotFound {
+		l.Error().Err(err).Str("UploadId", id).Msg("An error occurred releasing an upload reservation")
+	}
+}
+
+// Disk use against the limits, for the signed in user
+func (a *SSeclinkApi) GetUsage(c *fiber.Ctx) error {
+	l := log.Get()
+
+	usage, err := a.usage(getPrincipal(c).Name)
+	if err != nil {
+		l.Error().Err(err).Msg("An error occurred working out disk usage")
+		return err
+	}
+
+	if isHtmx(c) {
+		return a.Render(c, AdminUsage(usage))
+	}
+	return c.JSON(usage)
+}
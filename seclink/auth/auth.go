@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Returned by providers when a username or password is wrong, deliberately
+// vague so a login form never reveals which one it was
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// SPrincipal is the authenticated identity behind an admin request
+type SPrincipal struct {
+	Name     string
+	Provider string
+	Role     string
+	Scopes   []string
+}
+
+// IPasswordProvider authenticates admin users by username and password, the
+// login page tries each configured provider in turn
+type IPasswordProvider interface {
+	Name() string
+	Authenticate(username string, password string) (SPrincipal, error)
+}
+
+// Hashes a password or passphrase for storage
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Checks a password against a hash produced by HashPassword
+func CheckPassword(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"seclink/db"
+	"sync"
+)
+
+// Name of the local users provider, recorded on sessions
+const LocalProviderName = "local"
+
+// SLocalProvider authenticates against users stored in the seclink db,
+// managed with the `seclink user` command
+type SLocalProvider struct {
+	db db.ISeclinkDb
+}
+
+func (p *SLocalProvider) Name() string {
+	return LocalProviderName
+}
+
+func (p *SLocalProvider) Authenticate(username string, password string) (SPrincipal, error) {
+	user, err := p.db.GetUser(username)
+	if err == db.ErrUserNotFound {
+		// Still pay for a hash comparison so unknown usernames take as long as wrong passwords
+		CheckPassword(dummyHash(), password)
+		return SPrincipal{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return SPrincipal{}, err
+	}
+
+	if !CheckPassword(user.PasswordHash, password) {
+		return SPrincipal{}, ErrInvalidCredentials
+	}
+
+	return SPrincipal{
+		Name:     user.Username,
+		Provider: LocalProviderName,
+		Role:     user.Role,
+		Scopes:   ScopesForRole(user.Role),
+	}, nil
+}
+
+var dummyHash = sync.OnceValue(func() string {
+	hash, _ := HashPassword("seclink-dummy-password")
+	return hash
+})
+
+// New local users provider
+func NewLocalProvider(db db.ISeclinkDb) IPasswordProvider {
+	return &SLocalProvider{db: db}
+}
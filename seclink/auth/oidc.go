@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+// Name of the OpenID Connect provider, recorded on sessions
+const OidcProviderName = "oidc"
+
+// Returned when the IdP authenticated the user but none of their groups are allowed in
+var ErrGroupNotAllowed = errors.New("user is not in an allowed group")
+
+// SOidcRoleMapping grants Role to users whose groups claim contains Group
+type SOidcRoleMapping struct {
+	Group string
+	Role  string
+}
+
+// SOidcConfig is the auth.oidc section of seclink.yaml
+type SOidcConfig struct {
+	Enabled       bool
+	Issuer        string
+	ClientId      string
+	ClientSecret  string
+	RedirectUrl   string
+	Scopes        []string
+	UsernameClaim string
+	GroupsClaim   string
+	AllowedGroups []string
+	RoleMapping   []SOidcRoleMapping // Checked in order, the first matching group wins
+	DefaultRole   string             // Role for allowed users matching no mapping
+}
+
+// SOidcProvider logs admin users in with the OpenID Connect authorization
+// code flow, using PKCE and a nonce
+type SOidcProvider struct {
+	config   SOidcConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// Reads the auth.oidc config section. Keys are read one by one as
+// UnmarshalKey on a section ignores defaults set for keys within it
+func GetOidcConfig() (SOidcConfig, error) {
+	config := SOidcConfig{
+		Enabled:       viper.GetBool("auth.oidc.enabled"),
+		Issuer:        viper.GetString("auth.oidc.issuer"),
+		ClientId:      viper.GetString("auth.oidc.clientid"),
+		ClientSecret:  viper.GetString("auth.oidc.clientsecret"),
+		RedirectUrl:   viper.GetString("auth.oidc.redirecturl"),
+		Scopes:        viper.GetStringSlice("auth.oidc.scopes"),
+		UsernameClaim: viper.GetString("auth.oidc.usernameclaim"),
+		GroupsClaim:   viper.GetString("auth.oidc.groupsclaim"),
+		AllowedGroups: viper.GetStringSlice("auth.oidc.allowedgroups"),
+		DefaultRole:   viper.GetString("auth.oidc.defaultrole"),
+	}
+	err := viper.UnmarshalKey("auth.oidc.rolemapping", &config.RoleMapping)
+	return config, err
+}
+
+// Builds the URL to send the browser to, state, nonce and the PKCE verifier
+// must be kept by the caller to complete the login
+func (p *SOidcProvider) AuthCodeURL(state string, nonce string, pkceVerifier string) string {
+	return p.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(pkceVerifier))
+}
+
+// Exchanges the authorization code from the callback for a verified ID
+// token and maps its claims to a principal
+func (p *SOidcProvider) Exchange(ctx context.Context, code string, nonce string, pkceVerifier string) (SPrincipal, error) {
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(pkceVerifier))
+	if err != nil {
+		return SPrincipal{}, fmt.Errorf("exchanging authorization code: %w", err)
+	}
+
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return SPrincipal{}, fmt.Errorf("token response did not contain an id_token")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return SPrincipal{}, fmt.Errorf("verifying id_token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return SPrincipal{}, fmt.Errorf("id_token nonce does not match")
+	}
+
+	var claims map[string]any
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return SPrincipal{}, fmt.Errorf("decoding id_token claims: %w", err)
+	}
+
+	name, _ := claims[p.config.UsernameClaim].(string)
+	if name == "" {
+		name = idToken.Subject
+	}
+
+	groups := claimStrings(claims[p.config.GroupsClaim])
+	if len(p.config.AllowedGroups) > 0 && !slices.ContainsFunc(groups, func(group string) bool {
+		return slices.Contains(p.config.AllowedGroups, group)
+	}) {
+		return SPrincipal{}, ErrGroupNotAllowed
+	}
+
+	role := p.role(groups)
+	return SPrincipal{
+		Name:     name,
+		Provider: OidcProviderName,
+		Role:     role,
+		Scopes:   ScopesForRole(role),
+	}, nil
+}
+
+// Maps the users groups to a seclink role
+func (p *SOidcProvider) role(groups []string) string {
+	for _, mapping := range p.config.RoleMapping {
+		if slices.Contains(groups, mapping.Group) {
+			return mapping.Role
+		}
+	}
+	return p.config.DefaultRole
+}
+
+// Groups claims are usually a list of strings, some IdPs send a single string
+func claimStrings(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// New OIDC provider, discovers the issuer configuration so needs the IdP to be reachable
+func NewOidcProvider(ctx context.Context, config SOidcConfig) (*SOidcProvider, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovering OIDC issuer %s: %w", config.Issuer, err)
+	}
+
+	return &SOidcProvider{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientId,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectUrl,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID}, config.Scopes...),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientId}),
+	}, nil
+}
@@ -0,0 +1,45 @@
+package auth
+
+import "slices"
+
+// Roles for admin users, each role holds every scope of the roles before it
+const (
+	RoleViewer   = "viewer"
+	RoleSharer   = "sharer"
+	RoleUploader = "uploader"
+	RoleAdmin    = "admin"
+)
+
+// All roles, least privileged first
+var Roles = []string{RoleViewer, RoleSharer, RoleUploader, RoleAdmin}
+
+var roleScopes = map[string][]string{
+	RoleViewer: {
+		ScopeFilesRead,
+		ScopeLinksRead,
+	},
+	RoleSharer: {
+		ScopeFilesRead,
+		ScopeLinksRead,
+		ScopeLinksCreate,
+		ScopeLinksManage,
+	},
+	RoleUploader: {
+		ScopeFilesRead,
+		ScopeLinksRead,
+		ScopeLinksCreate,
+		ScopeLinksManage,
+		ScopeFilesWrite,
+	},
+	RoleAdmin: AllScopes,
+}
+
+// Whether role is one of Roles
+func ValidRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
+
+// The scopes granted by role, unknown roles get none
+func ScopesForRole(role string) []string {
+	return roleScopes[role]
+}
@@ -0,0 +1,49 @@
+package auth
+
+import "slices"
+
+// Scopes guard the admin API, sessions and API tokens both carry a set of them
+const (
+	ScopeFilesRead    = "files:read"
+	ScopeFilesWrite   = "files:write"
+	ScopeFilesDelete  = "files:delete"
+	ScopeLinksRead    = "links:read"
+	ScopeLinksCreate  = "links:create"
+	ScopeLinksManage  = "links:manage"
+	ScopeLinksAll     = "links:all" // Read and manage links created by anyone, not just your own
+	ScopeTokensManage = "tokens:manage"
+	ScopeAuditRead    = "audit:read"
+	ScopeBansManage   = "bans:manage" // View and lift bans of public clients
+)
+
+// Every scope, held by the admin role
+var AllScopes = []string{
+	ScopeFilesRead,
+	ScopeFilesWrite,
+	ScopeFilesDelete,
+	ScopeLinksRead,
+	ScopeLinksCreate,
+	ScopeLinksManage,
+	ScopeLinksAll,
+	ScopeTokensManage,
+	ScopeAuditRead,
+	ScopeBansManage,
+}
+
+// Scopes that can be granted to an API token, tokens can never mint more tokens
+var TokenScopes = []string{
+	ScopeFilesRead,
+	ScopeFilesWrite,
+	ScopeFilesDelete,
+	ScopeLinksRead,
+	ScopeLinksCreate,
+	ScopeLinksManage,
+	ScopeLinksAll,
+	ScopeAuditRead,
+	ScopeBansManage,
+}
+
+// Whether the principal holds scope
+func (p SPrincipal) Can(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// Name of the API token provider, recorded on token principals
+const TokenProviderName = "token"
+
+// Prefix of every API token, makes them easy to spot in secret scanners
+const tokenPrefix = "slk_"
+
+// Generates a new API token, returning the id it is stored under, the full
+// token to hand to the user and the hash of its secret to store
+func GenerateToken() (id string, token string, secretHash string, err error) {
+	idBytes := make([]byte, 8)
+	secretBytes := make([]byte, 32)
+	if _, err = rand.Read(idBytes); err != nil {
+		return
+	}
+	if _, err = rand.Read(secretBytes); err != nil {
+		return
+	}
+
+	id = hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	return id, tokenPrefix + id + "_" + secret, HashTokenSecret(secret), nil
+}
+
+// Splits a token presented by a client into its id and secret
+func ParseToken(token string) (id string, secret string, ok bool) {
+	rest, found := strings.CutPrefix(token, tokenPrefix)
+	if !found {
+		return "", "", false
+	}
+	return strings.Cut(rest, "_")
+}
+
+// Token secrets are long and random so a fast hash is enough
+func HashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Compares a presented secret against a stored hash in constant time
+func CheckTokenSecret(secretHash string, secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(secretHash), []byte(HashTokenSecret(secret))) == 1
+}
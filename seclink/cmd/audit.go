@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"seclink/api"
+	"seclink/db"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var auditFilter db.SAuditFilter
+var auditSince string
+var auditUntil string
+var auditFormat string
+var auditOutput string
+
+// auditCmd represents the audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Works with the audit log of link, file and login events",
+}
+
+var auditExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports audit events, oldest first, as JSON Lines or CSV",
+	Long: `Exports audit events, oldest first, as JSON Lines or CSV. The audit log
+	is stored in the seclink database, so the server must be stopped while
+	running this command.`,
+	Annotations: map[string]string{logsToStderr: "true"},
+	Args:        cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if auditFormat != "jsonl" && auditFormat != "csv" {
+			return fmt.Errorf("unknown format %s, must be jsonl or csv", auditFormat)
+		}
+
+		var err error
+		if auditSince != "" {
+			auditFilter.Since, err = api.ParseAuditTime(auditSince)
+			if err != nil {
+				return fmt.Errorf("since must be an RFC 3339 time or a duration such as 24h")
+			}
+		}
+		if auditUntil != "" {
+			auditFilter.Until, err = api.ParseAuditTime(auditUntil)
+			if err != nil {
+				return fmt.Errorf("until must be an RFC 3339 time or a duration such as 24h")
+			}
+		}
+
+		var out io.Writer = os.Stdout
+		if auditOutput != "" {
+			file, err := os.OpenFile(auditOutput, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			out = file
+		}
+
+		return withDb(func(d db.ISeclinkDb) error {
+			var count int
+			var err error
+			if auditFormat == "csv" {
+				count, err = exportAuditCsv(d, out)
+			} else {
+				count, err = exportAuditJsonl(d, out)
+			}
+			if err != nil {
+				return err
+			}
+			l.Info().Int("Events", count).Str("Format", auditFormat).Msg("Exported audit events")
+			return nil
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditExportCmd)
+
+	auditExportCmd.Flags().StringVarP(&auditFormat, "format", "f", "jsonl", "the export format, jsonl or csv")
+	auditExportCmd.Flags().StringVarP(&auditOutput, "output", "o", "", "the file to write, stdout when not given")
+	auditExportCmd.Flags().StringVar(&auditSince, "since", "", "only events after this RFC 3339 time, or this long ago such as 168h")
+	auditExportCmd.Flags().StringVar(&auditUntil, "until", "", "only events before this RFC 3339 time, or this long ago")
+	auditExportCmd.Flags().StringVar(&auditFilter.Action, "action", "", "only events with this action, such as link.downloaded")
+	auditExportCmd.Flags().StringVar(&auditFilter.Actor, "actor", "", "only events by this actor")
+	auditExportCmd.Flags().StringVar(&auditFilter.Target, "target", "", "only events for this link id or path")
+}
+
+// Writes one JSON object per line
+func exportAuditJsonl(d db.ISeclinkDb, out io.Writer) (int, error) {
+	count := 0
+	encoder := json.NewEncoder(out)
+	err := d.EachAuditEvent(auditFilter, func(event db.SAuditEvent) error {
+		count++
+		return encoder.Encode(event)
+	})
+	return count, err
+}
+
+// Writes a CSV with a header row
+func exportAuditCsv(d db.ISeclinkDb, out io.Writer) (int, error) {
+	count := 0
+	writer := csv.NewWriter(out)
+	err := writer.Write([]string{"id", "time", "action", "actor", "target", "detail", "clientIp", "userAgent"})
+	if err != nil {
+		return count, err
+	}
+
+	err = d.EachAuditEvent(auditFilter, func(event db.SAuditEvent) error {
+		count++
+		return writer.Write([]string{
+			event.Id,
+			event.Time.Format(time.RFC3339Nano),
+			event.Action,
+			event.Actor,
+			event.Target,
+			event.Detail,
+			event.ClientIp,
+			event.UserAgent,
+		})
+	})
+	if err != nil {
+		return count, err
+	}
+
+	writer.Flush()
+	return count, writer.Error()
+}
@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"seclink/crypt"
+	"seclink/db"
+	"seclink/storage"
+
+	"github.com/spf13/cobra"
+)
+
+var keysNewKey string
+var keysNewKeyFile string
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manages the master key used for encryption at rest",
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Prints a new random master key",
+	Long: `Prints a new random master key in base64. Put it in a key file referenced
+	by encryption.keyfile, in encryption.key or in ` + crypt.MasterKeyEnv + `.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := crypt.GenerateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	},
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Rewraps every data key with a new master key",
+	Long: `Rewraps the data key of every encrypted file, and of every unfinished
+	upload, from the configured master key to a new one. File contents are not
+	re-encrypted. Once it finishes configure the new key in place of the old.
+	A rotation that is interrupted can be run again, keys already under the new
+	key are skipped. Unfinished uploads are stored in the seclink database, so
+	the server must be stopped while running this command.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, err := crypt.LoadMasterKey()
+		if err != nil {
+			return err
+		}
+
+		var to *crypt.SMasterKey
+		switch {
+		case keysNewKey != "" && keysNewKeyFile != "":
+			return fmt.Errorf("give either --new-key or --new-keyfile, not both")
+		case keysNewKey != "":
+			to, err = crypt.ParseMasterKey(keysNewKey)
+		case keysNewKeyFile != "":
+			to, err = crypt.ReadMasterKeyFile(keysNewKeyFile)
+		default:
+			return fmt.Errorf("the new key is required, use --new-key or --new-keyfile")
+		}
+		if err != nil {
+			return err
+		}
+
+		store, err := storage.NewStorage()
+		if err != nil {
+			return err
+		}
+		return withDb(func(d db.ISeclinkDb) error {
+			return rotateKeys(d, store, from, to)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysGenerateCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+
+	keysRotateCmd.Flags().StringVar(&keysNewKey, "new-key", "", "the new master key in base64")
+	keysRotateCmd.Flags().StringVar(&keysNewKeyFile, "new-keyfile", "", "a file holding the new master key in base64")
+}
+
+func rotateKeys(d db.ISeclinkDb, store storage.IStorage, from *crypt.SMasterKey, to *crypt.SMasterKey) error {
+	var files, skipped int
+	err := store.Walk("", func(object storage.SObject) error {
+		if object.IsDir {
+			return nil
+		}
+		// Listings and stats do not always agree on modification times, the
+		// file record was made from a stat
+		before, err := store.Stat(object.Path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", object.Path, err)
+		}
+		changed, err := rewrapStored(store, object.Path, from, to)
+		if err != nil {
+			return fmt.Errorf("%s: %w", object.Path, err)
+		}
+		if !changed {
+			skipped++
+			return nil
+		}
+		files++
+		err = refreshFileRecord(d, store, before)
+		if err != nil {
+			return fmt.Errorf("%s: %w", object.Path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	uploads, err := d.GetAllUploads()
+	if err != nil {
+		return err
+	}
+	rewrapped := 0
+	for _, upload := range uploads {
+		if upload.StagingKey == nil {
+			continue
+		}
+		wrapped, changed, err := crypt.Rewrap(upload.StagingKey, from, to)
+		if err != nil {
+			return fmt.Errorf("upload %s: %w", upload.Id, err)
+		}
+		if !changed {
+			continue
+		}
+		upload.StagingKey = wrapped
+		err = d.SetUpload(upload)
+		if err != nil {
+			return err
+		}
+		rewrapped++
+	}
+
+	l.Info().
+		Int("Files", files).
+		Int("AlreadyRotated", skipped).
+		Int("Uploads", rewrapped).
+		Msg("Rewrapped data keys, configure the new master key before starting the server")
+	return nil
+}
+
+// Rewraps the data key of the file at rel if it is encrypted. On local disk
+// the header is rewritten in place, elsewhere the file is written again with
+// the new header, which only replaces the old one once all of it is written
+func rewrapStored(store storage.IStorage, rel string, from *crypt.SMasterKey, to *crypt.SMasterKey) (bool, error) {
+	if local, ok := store.(storage.ILocalStorage); ok {
+		absolutePath, err := local.LocalPath(rel)
+		if err != nil {
+			return false, err
+		}
+		file, err := store.Open(rel)
+		if err != nil {
+			return false, err
+		}
+		encrypted := crypt.IsEncrypted(file)
+		file.Close()
+		if !encrypted {
+			return false, nil
+		}
+		return crypt.RewrapFile(absolutePath, from, to)
+	}
+
+	file, err := store.Open(rel)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	if !crypt.IsEncrypted(file) {
+		return false, nil
+	}
+	header, changed, err := crypt.RewrapHeader(file, from, to)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	w, err := store.Create(rel)
+	if err != nil {
+		return false, err
+	}
+	body := io.NewSectionReader(file, crypt.HeaderSize, file.Size()-crypt.HeaderSize)
+	_, err = io.Copy(w, io.MultiReader(bytes.NewReader(header), body))
+	if err != nil {
+		w.Abort()
+		return false, err
+	}
+	return true, w.Close()
+}
+
+// Rewriting a file gives it a new modification time, which would leave the
+// checksum recorded for it looking out of date. The content is the same, so
+// a record that was current before is moved on to the rewritten file
+func refreshFileRecord(d db.ISeclinkDb, store storage.IStorage, before storage.SObject) error {
+	record, err := d.GetFileRecord(before.Path)
+	if err == db.ErrFileNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !record.Current(before.Size, before.ModTime) {
+		return nil
+	}
+
+	after, err := store.Stat(before.Path)
+	if err != nil {
+		return err
+	}
+	if record.Current(after.Size, after.ModTime) {
+		return nil
+	}
+	record.Size = after.Size
+	record.ModTime = after.ModTime
+	return d.SetFileRecord(record)
+}
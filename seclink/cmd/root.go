@@ -5,6 +5,7 @@ package cmd
 
 import (
 	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"seclink/log"
@@ -52,9 +53,17 @@ func init() {
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 }
 
+// Annotation for commands that write what they produce to stdout, their log
+// lines go to stderr so they do not end up mixed in with it
+const logsToStderr = "logsToStderr"
+
 // initLog creates the logger, the verbosity is set on the command line via global flag -v
 func initLog() {
-	log.InitLog(cliConfig.LogLevel)
+	var out io.Writer = os.Stdout
+	if cmd, _, err := rootCmd.Find(os.Args[1:]); err == nil && cmd.Annotations[logsToStderr] != "" {
+		out = os.Stderr
+	}
+	log.InitLog(cliConfig.LogLevel, out)
 	l = log.Get()
 }
 
@@ -73,6 +82,39 @@ func initConfig() {
 
 	viper.AutomaticEnv() // read in environment variables that match
 
+	// Defaults for settings that older config files will not have
+	viper.SetDefault("links.maxunlockattempts", 5)
+	viper.SetDefault("links.unlockttl", "10m")
+	viper.SetDefault("links.resumettl", "24h")
+	viper.SetDefault("files.deletepolicy", "block")
+	viper.SetDefault("audit.retention", "0s")
+	viper.SetDefault("uploads.expiry", "24h")
+	viper.SetDefault("uploads.maxsize", "2000MiB")
+	viper.SetDefault("uploads.quota", "0")
+	viper.SetDefault("uploads.userquota", "0")
+	viper.SetDefault("bandwidth.global", "0")
+	viper.SetDefault("bandwidth.perconnection", "0")
+	viper.SetDefault("protection.trustedproxies", []string{})
+	viper.SetDefault("protection.proxyheader", "X-Forwarded-For")
+	viper.SetDefault("protection.ratelimit", 60)
+	viper.SetDefault("protection.maxfailures", 10)
+	viper.SetDefault("protection.failurewindow", "10m")
+	viper.SetDefault("protection.bantime", "5m")
+	viper.SetDefault("protection.maxbantime", "24h")
+	viper.SetDefault("encryption.enabled", false)
+	viper.SetDefault("storage.backend", "local")
+	viper.SetDefault("storage.s3.usessl", true)
+	viper.SetDefault("storage.s3.presign", false)
+	viper.SetDefault("storage.s3.presignexpiry", "5m")
+	viper.SetDefault("auth.enabled", true)
+	viper.SetDefault("auth.sessionttl", "12h")
+	viper.SetDefault("auth.securecookie", false)
+	viper.SetDefault("auth.local.enabled", true)
+	viper.SetDefault("auth.oidc.enabled", false)
+	viper.SetDefault("auth.oidc.scopes", []string{"profile", "email"})
+	viper.SetDefault("auth.oidc.usernameclaim", "preferred_username")
+	viper.SetDefault("auth.oidc.groupsclaim", "groups")
+
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		l.Info().Str("ConfigFile", viper.ConfigFileUsed()).Msg("Config file used")
@@ -89,25 +131,56 @@ func printConfig() {
 		Str("DataPath", viper.GetString("server.datapath")).
 		Str("ExternalURL", viper.GetString("server.externalurl")).
 		Str("DefaultTTL", viper.GetDuration("links.defaultttl").String()).
+		Int("MaxUnlockAttempts", viper.GetInt("links.maxunlockattempts")).
+		Str("UnlockTTL", viper.GetDuration("links.unlockttl").String()).
+		Str("ResumeTTL", viper.GetDuration("links.resumettl").String()).
+		Str("DeletePolicy", viper.GetString("files.deletepolicy")).
+		Str("AuditRetention", viper.GetDuration("audit.retention").String()).
+		Str("UploadExpiry", viper.GetDuration("uploads.expiry").String()).
+		Str("MaxUploadSize", viper.GetString("uploads.maxsize")).
+		Str("StorageQuota", viper.GetString("uploads.quota")).
+		Str("UserQuota", viper.GetString("uploads.userquota")).
+		Str("GlobalBandwidth", viper.GetString("bandwidth.global")).
+		Str("ConnectionBandwidth", viper.GetString("bandwidth.perconnection")).
+		Strs("TrustedProxies", viper.GetStringSlice("protection.trustedproxies")).
+		Str("ProxyHeader", viper.GetString("protection.proxyheader")).
+		Int("RateLimit", viper.GetInt("protection.ratelimit")).
+		Int("MaxFailures", viper.GetInt("protection.maxfailures")).
+		Str("FailureWindow", viper.GetDuration("protection.failurewindow").String()).
+		Str("BanTime", viper.GetDuration("protection.bantime").String()).
+		Str("MaxBanTime", viper.GetDuration("protection.maxbantime").String()).
+		Bool("EncryptionEnabled", viper.GetBool("encryption.enabled")).
+		Str("EncryptionKeyFile", viper.GetString("encryption.keyfile")).
+		Str("StorageBackend", viper.GetString("storage.backend")).
+		Str("S3Endpoint", viper.GetString("storage.s3.endpoint")).
+		Str("S3Bucket", viper.GetString("storage.s3.bucket")).
+		Bool("S3Presign", viper.GetBool("storage.s3.presign")).
+		Bool("AuthEnabled", viper.GetBool("auth.enabled")).
+		Str("SessionTTL", viper.GetDuration("auth.sessionttl").String()).
+		Bool("LocalAuthEnabled", viper.GetBool("auth.local.enabled")).
+		Bool("OidcEnabled", viper.GetBool("auth.oidc.enabled")).
+		Str("OidcIssuer", viper.GetString("auth.oidc.issuer")).
 		Msg("Printing configuration")
 }
 
-// initPath sets up the data directory, if it doesnt already exist, as well as the files subfolder
+// initPath sets up the data directory, if it doesnt already exist, as well as the files and uploads subfolders
 func initPath() {
 
-	dataFilepath := filepath.Join(viper.GetString("server.datapath"), "files")
-
-	// Does data path and sub-folder files exist?
-	if exists, _ := pathExists(dataFilepath); !exists {
-		l.Info().
-			Str("datafilepath", dataFilepath).
-			Msg("the files sub-directory and/or data path does not exist, attempting to create")
-		err := os.MkdirAll(dataFilepath, 0700)
-		if err != nil {
-			l.Fatal().
-				Err(err).
+	for _, sub := range []string{"files", "uploads"} {
+		dataFilepath := filepath.Join(viper.GetString("server.datapath"), sub)
+
+		// Does data path and sub-folder exist?
+		if exists, _ := pathExists(dataFilepath); !exists {
+			l.Info().
 				Str("datafilepath", dataFilepath).
-				Msg("error creating data path and files sub directory")
+				Msg("the sub-directory and/or data path does not exist, attempting to create")
+			err := os.MkdirAll(dataFilepath, 0700)
+			if err != nil {
+				l.Fatal().
+					Err(err).
+					Str("datafilepath", dataFilepath).
+					Msg("error creating data path and sub directory")
+			}
 		}
 	}
 
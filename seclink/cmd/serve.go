@@ -7,6 +7,7 @@ import (
 	"seclink/api"
 	"seclink/db"
 	"seclink/log"
+	"seclink/storage"
 
 	"github.com/spf13/cobra"
 )
@@ -33,7 +34,12 @@ func Serve() error {
 		l.Error().Err(err).Msg("An error occurred opening the database")
 		return err
 	}
-	api := api.NewSeclinkApi(db)
+	store, err := storage.NewStorage()
+	if err != nil {
+		l.Error().Err(err).Msg("An error occurred opening storage")
+		return err
+	}
+	api := api.NewSeclinkApi(db, store)
 	err = api.Start()
 	if err != nil {
 		l.Error().Err(err).Msg("An error occurred starting the API")
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"fmt"
+	"seclink/api"
+	"seclink/auth"
+	"seclink/db"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var tokenInput api.SCreateToken
+
+// tokenCmd represents the token command
+var tokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Manages API tokens for automation against the admin API",
+	Long: `Manages long lived API tokens, presented as "Authorization: Bearer <token>"
+	to the admin API. Tokens are stored in the seclink database, so the server
+	must be stopped while running these commands.`,
+}
+
+var tokenCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Creates an API token and prints it, it can not be shown again",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withDb(func(d db.ISeclinkDb) error {
+			token, info, err := api.NewApiToken(tokenInput, "cli")
+			if err != nil {
+				return err
+			}
+			err = d.SetToken(info)
+			if err != nil {
+				return err
+			}
+			l.Info().Str("TokenId", info.Id).Str("Name", info.Name).Msg("Created API token")
+			fmt.Println(token)
+			return nil
+		})
+	},
+}
+
+var tokenListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists API tokens",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withDb(func(d db.ISeclinkDb) error {
+			tokens, err := d.GetAllTokens()
+			if err != nil {
+				return err
+			}
+			for _, token := range tokens {
+				fmt.Printf("%s\t%s\t%s\texpires %s\tlast used %s\n",
+					token.Id,
+					token.Name,
+					strings.Join(token.Scopes, ","),
+					formatCliTime(token.ExpiresAt),
+					formatCliTime(token.LastUsedAt))
+			}
+			return nil
+		})
+	},
+}
+
+var tokenRevokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revokes an API token",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withDb(func(d db.ISeclinkDb) error {
+			err := d.DeleteToken(args[0])
+			if err != nil {
+				return err
+			}
+			l.Info().Str("TokenId", args[0]).Msg("Revoked API token")
+			return nil
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+	tokenCmd.AddCommand(tokenCreateCmd, tokenListCmd, tokenRevokeCmd)
+
+	tokenCreateCmd.Flags().StringVarP(&tokenInput.Name, "name", "n", "", "a name describing what the token is for")
+	tokenCreateCmd.Flags().StringSliceVarP(&tokenInput.Scopes, "scope", "s", nil,
+		fmt.Sprintf("scopes to grant, repeatable, one of %s", strings.Join(auth.TokenScopes, ", ")))
+	tokenCreateCmd.Flags().StringVar(&tokenInput.TtlString, "ttl", "", "how long the token is valid for, never expires when not given")
+	tokenCreateCmd.MarkFlagRequired("name")
+	tokenCreateCmd.MarkFlagRequired("scope")
+}
+
+// Formats t for CLI output, zero times print as never
+func formatCliTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
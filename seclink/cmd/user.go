@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"seclink/auth"
+	"seclink/db"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var userPassword string
+var userRole string
+
+// userCmd represents the user command
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manages local admin users",
+	Long: `Manages the local users that can log in to the admin UI and API.
+	Users are stored in the seclink database, so the server must be stopped
+	while running these commands.`,
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add <username>",
+	Short: "Adds a local admin user",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withDb(func(d db.ISeclinkDb) error {
+			_, err := d.GetUser(args[0])
+			if err == nil {
+				return fmt.Errorf("user %s already exists", args[0])
+			}
+			if err != db.ErrUserNotFound {
+				return err
+			}
+			if !auth.ValidRole(userRole) {
+				return fmt.Errorf("unknown role %s, must be one of %s", userRole, strings.Join(auth.Roles, ", "))
+			}
+			return setUserPassword(d, db.SUser{Username: args[0], Role: userRole, CreatedAt: time.Now()})
+		})
+	},
+}
+
+var userPasswdCmd = &cobra.Command{
+	Use:   "passwd <username>",
+	Short: "Changes the password of a local admin user",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withDb(func(d db.ISeclinkDb) error {
+			user, err := d.GetUser(args[0])
+			if err != nil {
+				return err
+			}
+			return setUserPassword(d, user)
+		})
+	},
+}
+
+var userDeleteCmd = &cobra.Command{
+	Use:   "delete <username>",
+	Short: "Deletes a local admin user, ending any sessions they have",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withDb(func(d db.ISeclinkDb) error {
+			err := d.DeleteUser(args[0])
+			if err != nil {
+				return err
+			}
+			l.Info().Str("Username", args[0]).Msg("Deleted user")
+			return nil
+		})
+	},
+}
+
+var userRoleCmd = &cobra.Command{
+	Use:   "role <username> <role>",
+	Short: "Changes the role of a local admin user",
+	Long: `Changes the role of a local admin user, one of viewer, sharer, uploader or admin.
+	The new role applies to any sessions the user already has.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !auth.ValidRole(args[1]) {
+			return fmt.Errorf("unknown role %s, must be one of %s", args[1], strings.Join(auth.Roles, ", "))
+		}
+		return withDb(func(d db.ISeclinkDb) error {
+			user, err := d.GetUser(args[0])
+			if err != nil {
+				return err
+			}
+			user.Role = args[1]
+			err = d.SetUser(user)
+			if err != nil {
+				return err
+			}
+			l.Info().Str("Username", user.Username).Str("Role", user.Role).Msg("Changed user role")
+			return nil
+		})
+	},
+}
+
+var userListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists local admin users",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withDb(func(d db.ISeclinkDb) error {
+			users, err := d.GetAllUsers()
+			if err != nil {
+				return err
+			}
+			for _, user := range users {
+				fmt.Printf("%s\t%s\tcreated %s\n", user.Username, user.Role, user.CreatedAt.Format(time.RFC3339))
+			}
+			return nil
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(userCmd)
+	userCmd.AddCommand(userAddCmd, userPasswdCmd, userRoleCmd, userDeleteCmd, userListCmd)
+
+	userAddCmd.Flags().StringVar(&userRole, "role", auth.RoleViewer, "the role of the user, one of viewer, sharer, uploader or admin")
+
+	for _, c := range []*cobra.Command{userAddCmd, userPasswdCmd} {
+		c.Flags().StringVarP(&userPassword, "password", "p", "", "the password to set, read from stdin when not given")
+	}
+}
+
+// Hashes the password from the flag or stdin onto user and saves it
+func setUserPassword(d db.ISeclinkDb, user db.SUser) error {
+	password := userPassword
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("could not read password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		return fmt.Errorf("the password cannot be empty")
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = hash
+
+	err = d.SetUser(user)
+	if err != nil {
+		return err
+	}
+	l.Info().Str("Username", user.Username).Msg("Saved user")
+	return nil
+}
+
+// Opens the db for the duration of fn
+func withDb(fn func(d db.ISeclinkDb) error) error {
+	d := db.NewSeclinkDb()
+	err := d.Start(false, false)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return fn(d)
+}
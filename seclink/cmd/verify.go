@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"seclink/api"
+	"seclink/db"
+	"seclink/storage"
+
+	"github.com/spf13/cobra"
+)
+
+var verifyRecord bool
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Checks every file against the checksum recorded when it was uploaded",
+	Long: `Rescans the files directory, hashing every file and comparing it with the
+	SHA-256 recorded when it was written through seclink. Files that changed or
+	went missing are reported and the command fails. Files without a checksum,
+	such as those copied in by hand, are listed and can be given one with
+	--record. The checksums are stored in the seclink database, so the server
+	must be stopped while running this command.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true, // A failed check is not a usage mistake
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := storage.NewStorage()
+		if err != nil {
+			return err
+		}
+		return withDb(func(d db.ISeclinkDb) error {
+			return verifyFiles(d, store)
+		})
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().BoolVar(&verifyRecord, "record", false, "record a checksum for files that have none")
+}
+
+func verifyFiles(d db.ISeclinkDb, store storage.IStorage) error {
+	records, err := d.GetAllFileRecords()
+	if err != nil {
+		return err
+	}
+	byPath := make(map[string]db.SFileRecord)
+	for _, record := range records {
+		byPath[record.Path] = record
+	}
+
+	var checked, modified, unreadable, unrecorded int
+	err = store.Walk("", func(object storage.SObject) error {
+		if object.IsDir {
+			return nil
+		}
+		rel := object.Path
+
+		record, ok := byPath[rel]
+		delete(byPath, rel)
+		// An encrypted file that fails to decrypt has been damaged or needs another key
+		sum, err := api.HashFile(store, rel)
+		if err != nil {
+			unreadable++
+			l.Error().Err(err).Str("Path", rel).Msg("File could not be read")
+			return nil
+		}
+
+		if !ok || record.Sha256 == "" {
+			unrecorded++
+			if !verifyRecord {
+				l.Warn().Str("Path", rel).Msg("No checksum recorded")
+				return nil
+			}
+			record.Path = rel
+			record.Sha256 = sum
+			record.Size = object.Size
+			record.ModTime = object.ModTime
+			l.Info().Str("Path", rel).Str("Sha256", sum).Msg("Recorded checksum")
+			return d.SetFileRecord(record)
+		}
+
+		checked++
+		if sum != record.Sha256 {
+			modified++
+			l.Error().Str("Path", rel).Str("Expected", record.Sha256).Str("Actual", sum).Msg("File does not match its checksum")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Whatever was not found on the walk has gone, its record is kept as evidence
+	missing := 0
+	for rel := range byPath {
+		_, err := store.Stat(rel)
+		if errors.Is(err, fs.ErrNotExist) {
+			missing++
+			l.Error().Str("Path", rel).Msg("File with a recorded checksum is missing")
+		}
+	}
+
+	l.Info().
+		Int("Checked", checked).
+		Int("Modified", modified).
+		Int("Missing", missing).
+		Int("Unreadable", unreadable).
+		Int("Unrecorded", unrecorded).
+		Bool("Recorded", verifyRecord).
+		Msg("Verified files")
+	if modified > 0 || missing > 0 || unreadable > 0 {
+		return fmt.Errorf("%d files modified, %d missing and %d unreadable", modified, missing, unreadable)
+	}
+	return nil
+}
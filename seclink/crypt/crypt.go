@@ -0,0 +1,183 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Envelope encryption of stored files. Every file gets its own random data
+// key, which encrypts the content, and the data key is kept in the file
+// header wrapped by the master key. Changing the master key only means
+// rewrapping the data keys, the content is left alone
+
+const (
+	keySize      = 32 // AES-256
+	keyIdSize    = 8
+	wrappedSize  = keyIdSize + 12 + keySize + 16 // Key id, nonce, sealed key and tag
+	MasterKeyEnv = "SECLINK_ENCRYPTION_KEY"
+)
+
+var (
+	ErrNoMasterKey = errors.New("no master key is configured, set encryption.key, encryption.keyfile or " + MasterKeyEnv)
+	ErrWrongKey    = errors.New("the data key was wrapped by a different master key")
+	ErrCorrupt     = errors.New("encrypted data is damaged or has been tampered with")
+)
+
+// SMasterKey wraps and unwraps data keys. Its id, derived from the key, is
+// stored with every wrapped key so the right master key can be asked for
+type SMasterKey struct {
+	Id   []byte
+	aead cipher.AEAD
+}
+
+// A master key from its 32 raw bytes
+func NewMasterKey(raw []byte) (*SMasterKey, error) {
+	if len(raw) != keySize {
+		return nil, fmt.Errorf("a master key must be %d bytes, got %d", keySize, len(raw))
+	}
+	aead, err := newGcm(raw)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &SMasterKey{Id: sum[:keyIdSize], aead: aead}, nil
+}
+
+// A master key from its base64 form, as written by GenerateKey
+func ParseMasterKey(text string) (*SMasterKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("a master key must be base64: %w", err)
+	}
+	return NewMasterKey(raw)
+}
+
+// Reads a base64 master key from a file
+func ReadMasterKeyFile(path string) (*SMasterKey, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMasterKey(string(text))
+}
+
+// A new random master key in base64
+func GenerateKey() (string, error) {
+	raw, err := randomBytes(keySize)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// Loads the configured master key, the environment wins over a key file,
+// which wins over a key written into the config
+func LoadMasterKey() (*SMasterKey, error) {
+	if text := os.Getenv(MasterKeyEnv); text != "" {
+		return ParseMasterKey(text)
+	}
+	if path := viper.GetString("encryption.keyfile"); path != "" {
+		return ReadMasterKeyFile(path)
+	}
+	if text := viper.GetString("encryption.key"); text != "" {
+		return ParseMasterKey(text)
+	}
+	return nil, ErrNoMasterKey
+}
+
+var (
+	master      *SMasterKey
+	masterMutex sync.Mutex
+)
+
+// The configured master key, loaded on first use
+func Master() (*SMasterKey, error) {
+	masterMutex.Lock()
+	defer masterMutex.Unlock()
+
+	if master != nil {
+		return master, nil
+	}
+	key, err := LoadMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	master = key
+	return master, nil
+}
+
+// Whether new files are written encrypted, set by encryption.enabled. Files
+// already encrypted are read whatever this says, as long as the key is there
+func Enabled() bool {
+	return viper.GetBool("encryption.enabled")
+}
+
+// A new random data key
+func NewDataKey() ([]byte, error) {
+	return randomBytes(keySize)
+}
+
+// Seals dataKey under the master key, the result carries the master key id
+func (k *SMasterKey) WrapKey(dataKey []byte) ([]byte, error) {
+	nonce, err := randomBytes(k.aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	wrapped := append(append([]byte{}, k.Id...), nonce...)
+	return k.aead.Seal(wrapped, nonce, dataKey, k.Id), nil
+}
+
+// Opens a data key sealed by WrapKey
+func (k *SMasterKey) UnwrapKey(wrapped []byte) ([]byte, error) {
+	if len(wrapped) != wrappedSize {
+		return nil, ErrCorrupt
+	}
+	if !bytes.Equal(wrapped[:keyIdSize], k.Id) {
+		return nil, ErrWrongKey
+	}
+	nonce := wrapped[keyIdSize : keyIdSize+k.aead.NonceSize()]
+	dataKey, err := k.aead.Open(nil, nonce, wrapped[keyIdSize+k.aead.NonceSize():], k.Id)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return dataKey, nil
+}
+
+// Moves a wrapped data key from one master key to another. Keys already
+// under to are returned as they are, so an interrupted rotation can be rerun
+func Rewrap(wrapped []byte, from *SMasterKey, to *SMasterKey) ([]byte, bool, error) {
+	if len(wrapped) == wrappedSize && bytes.Equal(wrapped[:keyIdSize], to.Id) {
+		return wrapped, false, nil
+	}
+	dataKey, err := from.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, false, err
+	}
+	rewrapped, err := to.WrapKey(dataKey)
+	return rewrapped, err == nil, err
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
@@ -0,0 +1,348 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Layout of an encrypted file
+//
+//	magic    8 bytes
+//	wrapped  68 bytes, the data key wrapped by the master key
+//	size     8 bytes, big endian length of the plain content, all ones if unknown
+//	chunks   each ChunkSize bytes of content sealed with AES-256-GCM
+//
+// Chunk n is sealed with n as its nonce and a flag marking the last chunk as
+// additional data, so chunks can not be reordered, dropped or cut short
+// without it being noticed. As every chunk but the last is the same size any
+// part of the content can be read without touching what comes before it
+
+const (
+	ChunkSize  = 64 * 1024
+	tagSize    = 16
+	magicSize  = 8
+	sizeOffset = magicSize + wrappedSize
+	HeaderSize = sizeOffset + 8
+)
+
+var magic = []byte("SLENC\x00\x00\x01")
+
+// Written in place of the size when the destination can not be written to
+// again once the content is in, the size is then worked out from the length
+const unknownSize = ^uint64(0)
+
+// Whether the content r reads is in the encrypted layout
+func IsEncrypted(r io.ReaderAt) bool {
+	head := make([]byte, magicSize)
+	_, err := r.ReadAt(head, 0)
+	return err == nil && bytes.Equal(head, magic)
+}
+
+// The length of the plain content of an encrypted file of length bytes, read from its header
+func PlainSize(r io.ReaderAt, length int64) (int64, error) {
+	header, err := readHeader(r)
+	if err != nil {
+		return 0, err
+	}
+	return headerSize(header, length)
+}
+
+func readHeader(r io.ReaderAt) ([]byte, error) {
+	header := make([]byte, HeaderSize)
+	_, err := r.ReadAt(header, 0)
+	if err != nil || !bytes.Equal(header[:magicSize], magic) {
+		return nil, ErrCorrupt
+	}
+	return header, nil
+}
+
+// The plain size recorded in header, or worked out from the length of the
+// file when none was. Every chunk but the last is full and any file has at
+// least one chunk, so the length gives away the number of chunks
+func headerSize(header []byte, length int64) (int64, error) {
+	size := binary.BigEndian.Uint64(header[sizeOffset:])
+	if size != unknownSize {
+		return int64(size), nil
+	}
+	sealed := length - HeaderSize
+	if sealed < tagSize {
+		return 0, ErrCorrupt
+	}
+	chunks := (sealed + ChunkSize + tagSize - 1) / (ChunkSize + tagSize)
+	return sealed - chunks*tagSize, nil
+}
+
+func chunkNonce(aead cipher.AEAD, index int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+func chunkData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// SWriter encrypts everything written to it into w
+type SWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index int64
+	size  int64
+}
+
+// Starts an encrypted file in w, ready to take the plain content. Close must
+// be called to finish the file, it closes w too when w is a Closer
+func NewWriter(w io.Writer, key *SMasterKey) (*SWriter, error) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := key.WrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGcm(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The size is filled in by Close when w allows it
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, unknownSize)
+	header := append(append(append([]byte{}, magic...), wrapped...), size...)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &SWriter{w: w, aead: aead, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (w *SWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more arrives, it may be the last
+		if len(w.buf) == ChunkSize {
+			err := w.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *SWriter) seal(last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.aead, w.index), w.buf, chunkData(last))
+	_, err := w.w.Write(sealed)
+	if err != nil {
+		return err
+	}
+	w.size += int64(len(w.buf))
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Seals the last chunk, records the size when w can be written at and closes w
+func (w *SWriter) Close() error {
+	err := w.seal(true)
+	if at, ok := w.w.(io.WriterAt); ok && err == nil {
+		size := make([]byte, 8)
+		binary.BigEndian.PutUint64(size, uint64(w.size))
+		_, err = at.WriteAt(size, sizeOffset)
+	}
+	// Writers that only keep what they were given once closed are dropped instead
+	if aborter, ok := w.w.(interface{ Abort() }); ok && err != nil {
+		aborter.Abort()
+		return err
+	}
+	closer, ok := w.w.(io.Closer)
+	if !ok {
+		return err
+	}
+	closeErr := closer.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// SReader reads the plain content of an encrypted file, it can seek so any
+// range can be served
+type SReader struct {
+	r      io.ReaderAt
+	aead   cipher.AEAD
+	size   int64
+	pos    int64
+	chunk  []byte
+	loaded int64 // Index of the chunk held in chunk, -1 for none
+}
+
+// Opens the encrypted file of length bytes r reads with the configured master
+// key. Closing the reader closes r when it is a Closer
+func NewReader(r io.ReaderAt, length int64) (*SReader, error) {
+	key, err := Master()
+	if err != nil {
+		return nil, err
+	}
+	return NewReaderWith(r, length, key)
+}
+
+// Opens the encrypted file of length bytes r reads with key
+func NewReaderWith(r io.ReaderAt, length int64, key *SMasterKey) (*SReader, error) {
+	header, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	size, err := headerSize(header, length)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := key.UnwrapKey(header[magicSize:sizeOffset])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGcm(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SReader{
+		r:      r,
+		aead:   aead,
+		size:   size,
+		loaded: -1,
+	}, nil
+}
+
+// Length of the plain content
+func (r *SReader) Size() int64 {
+	return r.size
+}
+
+func (r *SReader) chunks() int64 {
+	if r.size == 0 {
+		return 1
+	}
+	return (r.size + ChunkSize - 1) / ChunkSize
+}
+
+func (r *SReader) load(index int64) error {
+	if index == r.loaded {
+		return nil
+	}
+
+	length := int64(ChunkSize)
+	if remaining := r.size - index*ChunkSize; remaining < length {
+		length = remaining
+	}
+	sealed := make([]byte, length+tagSize)
+	_, err := r.r.ReadAt(sealed, HeaderSize+index*(ChunkSize+tagSize))
+	if err != nil {
+		return ErrCorrupt
+	}
+	chunk, err := r.aead.Open(r.chunk[:0], chunkNonce(r.aead, index), sealed, chunkData(index == r.chunks()-1))
+	if err != nil {
+		r.loaded = -1
+		return ErrCorrupt
+	}
+	r.chunk = chunk
+	r.loaded = index
+	return nil
+}
+
+func (r *SReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	index := r.pos / ChunkSize
+	err := r.load(index)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, r.chunk[r.pos-index*ChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *SReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *SReader) Close() error {
+	if closer, ok := r.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// The header of the encrypted file r reads with its data key moved from one
+// master key to another, the content is not touched. Returns whether the
+// header changed, it has to be written over the old one when it has
+func RewrapHeader(r io.ReaderAt, from *SMasterKey, to *SMasterKey) ([]byte, bool, error) {
+	header, err := readHeader(r)
+	if err != nil {
+		return nil, false, err
+	}
+	wrapped, changed, err := Rewrap(header[magicSize:sizeOffset], from, to)
+	if err != nil || !changed {
+		return nil, false, err
+	}
+	copy(header[magicSize:sizeOffset], wrapped)
+	return header, true, nil
+}
+
+// Rewraps the data key of the encrypted file at path in place, see RewrapHeader.
+// The content is unchanged so the modification time is put back, checksums
+// recorded against it stay valid
+func RewrapFile(path string, from *SMasterKey, to *SMasterKey) (bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	header, changed, err := RewrapHeader(file, from, to)
+	if err != nil || !changed {
+		return false, err
+	}
+	_, err = file.WriteAt(header, 0)
+	if err != nil {
+		return false, err
+	}
+	err = file.Sync()
+	if err != nil {
+		return false, err
+	}
+	return true, os.Chtimes(path, time.Time{}, info.ModTime())
+}
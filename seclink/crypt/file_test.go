@@ -0,0 +1,241 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKey(t *testing.T) *SMasterKey {
+	t.Helper()
+	raw := make([]byte, keySize)
+	_, err := rand.Read(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewMasterKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func randomContent(t *testing.T, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// Encrypts content, into a file when sized so the size goes in the header,
+// otherwise into a buffer that can only be appended to
+func encrypt(t *testing.T, content []byte, key *SMasterKey, sized bool) []byte {
+	t.Helper()
+	if !sized {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeAll(t, w, content)
+		return buf.Bytes()
+	}
+
+	path := filepath.Join(t.TempDir(), "sealed")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWriter(file, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, w, content)
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sealed
+}
+
+// Writes content in uneven pieces, so chunks are filled across writes
+func writeAll(t *testing.T, w *SWriter, content []byte) {
+	t.Helper()
+	for len(content) > 0 {
+		n := min(len(content), 1000+len(content)%7919)
+		_, err := w.Write(content[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = content[n:]
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func decrypt(sealed []byte, key *SMasterKey) ([]byte, error) {
+	r, err := NewReaderWith(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newTestKey(t)
+	sizes := []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 5}
+
+	for _, sized := range []bool{false, true} {
+		for _, size := range sizes {
+			content := randomContent(t, size)
+			sealed := encrypt(t, content, key, sized)
+			if !IsEncrypted(bytes.NewReader(sealed)) {
+				t.Fatalf("size %d, sized %v: not recognised as encrypted", size, sized)
+			}
+			plainSize, err := PlainSize(bytes.NewReader(sealed), int64(len(sealed)))
+			if err != nil || plainSize != int64(size) {
+				t.Fatalf("size %d, sized %v: PlainSize gave %d, %v", size, sized, plainSize, err)
+			}
+			got, err := decrypt(sealed, key)
+			if err != nil {
+				t.Fatalf("size %d, sized %v: %v", size, sized, err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("size %d, sized %v: content changed on the way through", size, sized)
+			}
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	key := newTestKey(t)
+	content := randomContent(t, 3*ChunkSize+5)
+	sealed := encrypt(t, content, key, false)
+	r, err := NewReaderWith(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offsets := []int64{0, 10, ChunkSize - 3, ChunkSize, 2*ChunkSize + 100, int64(len(content)) - 1, int64(len(content))}
+	for _, offset := range offsets {
+		_, err = r.Seek(offset, io.SeekStart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 10)
+		n, err := io.ReadFull(r, got)
+		want := content[offset:min(offset+10, int64(len(content)))]
+		if !bytes.Equal(got[:n], want) {
+			t.Fatalf("read at %d gave %d bytes that do not match, err %v", offset, n, err)
+		}
+	}
+	if _, err = r.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("seeking before the start was allowed")
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key := newTestKey(t)
+	content := randomContent(t, 3*ChunkSize+5)
+	sealedChunk := ChunkSize + tagSize
+	chunkAt := func(index int) int { return HeaderSize + index*sealedChunk }
+
+	tests := []struct {
+		name   string
+		sized  bool
+		tamper func(sealed []byte) []byte
+	}{
+		{"last chunk dropped", false, func(s []byte) []byte { return s[:chunkAt(3)] }},
+		{"last chunk dropped", true, func(s []byte) []byte { return s[:chunkAt(3)] }},
+		{"last chunks dropped", false, func(s []byte) []byte { return s[:chunkAt(2)] }},
+		{"cut inside the last chunk", false, func(s []byte) []byte { return s[:len(s)-3] }},
+		{"cut inside the last chunk", true, func(s []byte) []byte { return s[:len(s)-3] }},
+		{"cut inside a full chunk", false, func(s []byte) []byte { return s[:chunkAt(2)-100] }},
+		{"bytes added", false, func(s []byte) []byte { return append(s, 0) }},
+		{"content flipped", false, func(s []byte) []byte { s[chunkAt(1)+7] ^= 1; return s }},
+		{"tag flipped", true, func(s []byte) []byte { s[len(s)-1] ^= 1; return s }},
+		{"chunks swapped", false, func(s []byte) []byte {
+			first := append([]byte{}, s[chunkAt(0):chunkAt(1)]...)
+			copy(s[chunkAt(0):], s[chunkAt(1):chunkAt(2)])
+			copy(s[chunkAt(1):], first)
+			return s
+		}},
+		{"size made smaller", true, func(s []byte) []byte { s[HeaderSize-1]--; return s }},
+		{"size made larger", true, func(s []byte) []byte { s[HeaderSize-2]++; return s }},
+		{"size cleared", true, func(s []byte) []byte {
+			copy(s[sizeOffset:HeaderSize], bytes.Repeat([]byte{0xff}, 8))
+			return s[:chunkAt(2)]
+		}},
+	}
+
+	for _, test := range tests {
+		sealed := test.tamper(encrypt(t, content, key, test.sized))
+		got, err := decrypt(sealed, key)
+		if !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s, sized %v: read %d bytes, err %v, wanted ErrCorrupt", test.name, test.sized, len(got), err)
+		}
+	}
+}
+
+func TestHeaderChecks(t *testing.T) {
+	key := newTestKey(t)
+	sealed := encrypt(t, []byte("content"), key, true)
+
+	_, err := decrypt(sealed, newTestKey(t))
+	if !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("another master key gave %v, wanted ErrWrongKey", err)
+	}
+
+	wrapped := append([]byte{}, sealed...)
+	wrapped[sizeOffset-1] ^= 1
+	if _, err = decrypt(wrapped, key); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("damaged data key gave %v, wanted ErrCorrupt", err)
+	}
+
+	plain := append([]byte("plain text"), sealed[magicSize:]...)
+	if IsEncrypted(bytes.NewReader(plain)) {
+		t.Fatal("content without the magic was taken as encrypted")
+	}
+	if _, err = decrypt(plain, key); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("missing magic gave %v, wanted ErrCorrupt", err)
+	}
+	if _, err = decrypt(sealed[:HeaderSize-1], key); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("short header gave %v, wanted ErrCorrupt", err)
+	}
+}
+
+func TestRewrapHeader(t *testing.T) {
+	from := newTestKey(t)
+	to := newTestKey(t)
+	content := randomContent(t, ChunkSize+10)
+	sealed := encrypt(t, content, from, true)
+
+	header, changed, err := RewrapHeader(bytes.NewReader(sealed), from, to)
+	if err != nil || !changed {
+		t.Fatalf("rewrap gave changed %v, err %v", changed, err)
+	}
+	rewrapped := append(header, sealed[HeaderSize:]...)
+
+	got, err := decrypt(rewrapped, to)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("rewrapped file does not open with the new key: %v", err)
+	}
+	if _, err = decrypt(rewrapped, from); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("rewrapped file opened with the old key, err %v", err)
+	}
+
+	// Running it again finds nothing to do
+	_, changed, err = RewrapHeader(bytes.NewReader(rewrapped), from, to)
+	if err != nil || changed {
+		t.Fatalf("second rewrap gave changed %v, err %v", changed, err)
+	}
+}
@@ -0,0 +1,30 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+)
+
+// Unfinished uploads are staged with AES-CTR under a key of their own. CTR
+// keeps the staged file the same length as what arrived and can start at any
+// offset, so a resumed upload just carries on appending. The content is
+// checked by its checksum and sealed properly once the upload completes
+
+// A keystream for staged data starting at offset, XOR it with the bytes to
+// encrypt or decrypt them
+func StagingStream(key []byte, offset int64) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every upload has its own key so the counter can start from zero
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[aes.BlockSize-8:], uint64(offset/aes.BlockSize))
+	stream := cipher.NewCTR(block, iv)
+
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream, nil
+}
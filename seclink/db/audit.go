@@ -0,0 +1,161 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/spf13/viper"
+)
+
+// Audit event actions
+const (
+	AuditLinkCreated    = "link.created"
+	AuditLinkUpdated    = "link.updated"
+	AuditLinkRevoked    = "link.revoked"
+	AuditLinkDownloaded = "link.downloaded"
+	AuditLinkDenied     = "link.denied" // A public request for a link that was refused, Detail says why
+	AuditLinkUnlocked   = "link.unlocked"
+	AuditFileUploaded   = "file.uploaded"
+	AuditFileDeleted    = "file.deleted"
+	AuditFileMoved      = "file.moved"
+	AuditLoginSucceeded = "login.succeeded"
+	AuditLoginFailed    = "login.failed"
+	AuditLogout         = "logout"
+	AuditTokenCreated   = "token.created"
+	AuditTokenRevoked   = "token.revoked"
+	AuditClientBanned   = "client.banned" // Target is the client address, Detail the failure that led to the ban
+	AuditBanCleared     = "ban.cleared"
+)
+
+// All audit event actions, for filter drop downs
+var AuditActions = []string{
+	AuditLinkCreated,
+	AuditLinkUpdated,
+	AuditLinkRevoked,
+	AuditLinkDownloaded,
+	AuditLinkDenied,
+	AuditLinkUnlocked,
+	AuditFileUploaded,
+	AuditFileDeleted,
+	AuditFileMoved,
+	AuditLoginSucceeded,
+	AuditLoginFailed,
+	AuditLogout,
+	AuditTokenCreated,
+	AuditTokenRevoked,
+	AuditClientBanned,
+	AuditBanCleared,
+}
+
+// Appends an event to the audit log, events are keyed by time so iterating
+// the prefix walks them in order. Events are kept for audit.retention, or
+// forever when it is not set
+func (d *SSeclinkDb) AddAuditEvent(event SAuditEvent) (SAuditEvent, error) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	// Random suffix so events in the same nanosecond do not overwrite each other
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return event, err
+	}
+	event.Id = fmt.Sprintf("%020d-%s", event.Time.UnixNano(), hex.EncodeToString(suffix))
+
+	retention := viper.GetDuration("audit.retention")
+	if retention <= 0 {
+		retention = NoExpiry
+	}
+	return event, d.setRecord(auditPrefix+event.Id, event, retention)
+}
+
+// Returns events matching filter, newest first
+func (d *SSeclinkDb) GetAuditEvents(filter SAuditFilter) ([]SAuditEvent, error) {
+	events := make([]SAuditEvent, 0)
+
+	err := d.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 50
+		opts.Prefix = []byte(auditPrefix)
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// A reverse seek lands on the last key at or before the seek key, "~"
+		// sorts after every id so this starts from the newest event
+		seek := auditPrefix + "~"
+		if filter.Before != "" {
+			seek = auditPrefix + filter.Before
+		}
+
+		for it.Seek([]byte(seek)); it.Valid(); it.Next() {
+			item := it.Item()
+			if filter.Before != "" && string(item.Key()) == auditPrefix+filter.Before {
+				continue
+			}
+
+			var event SAuditEvent
+			err := item.Value(func(v []byte) error {
+				return json.Unmarshal(v, &event)
+			})
+			if err != nil {
+				return err
+			}
+
+			// Everything after this is older still
+			if !filter.Since.IsZero() && event.Time.Before(filter.Since) {
+				return nil
+			}
+			if !filter.matches(event) {
+				continue
+			}
+
+			events = append(events, event)
+			if filter.Limit > 0 && len(events) >= filter.Limit {
+				return nil
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+// Calls fn with every event matching filter, oldest first. Before and Limit are ignored
+func (d *SSeclinkDb) EachAuditEvent(filter SAuditFilter, fn func(SAuditEvent) error) error {
+	return d.eachRecord(auditPrefix, func(_ string, value []byte, _ uint64) error {
+		var event SAuditEvent
+		err := json.Unmarshal(value, &event)
+		if err != nil {
+			return err
+		}
+		if !filter.Since.IsZero() && event.Time.Before(filter.Since) {
+			return nil
+		}
+		if !filter.matches(event) {
+			return nil
+		}
+		return fn(event)
+	})
+}
+
+// Whether event matches the action, actor, target and until fields of the filter
+func (f SAuditFilter) matches(event SAuditEvent) bool {
+	if f.Action != "" && event.Action != f.Action {
+		return false
+	}
+	if f.Actor != "" && event.Actor != f.Actor {
+		return false
+	}
+	if f.Target != "" && event.Target != f.Target {
+		return false
+	}
+	if !f.Until.IsZero() && event.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
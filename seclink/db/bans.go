@@ -0,0 +1,49 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Returned when a client has never been banned, or its ban has been forgotten
+var ErrBanNotFound = errors.New("ban not found")
+
+// Retrieves the ban of a client address
+func (d *SSeclinkDb) GetBan(ip string) (SBan, error) {
+	var ban SBan
+
+	err := d.getRecord(banPrefix+ip, &ban)
+	if err == badger.ErrKeyNotFound {
+		return ban, ErrBanNotFound
+	}
+	return ban, err
+}
+
+// Stores a ban, it is forgotten along with its strikes once ttl passes
+func (d *SSeclinkDb) SetBan(ban SBan, ttl time.Duration) error {
+	return d.setRecord(banPrefix+ban.Ip, ban, ttl)
+}
+
+// Lifts a ban and forgets its strikes
+func (d *SSeclinkDb) DeleteBan(ip string) error {
+	return d.deleteKey(banPrefix+ip, ErrBanNotFound)
+}
+
+// Lists all bans, including ended ones whose strikes are still remembered
+func (d *SSeclinkDb) GetAllBans() ([]SBan, error) {
+	bans := make([]SBan, 0)
+
+	err := d.eachRecord(banPrefix, func(_ string, value []byte, _ uint64) error {
+		var ban SBan
+		err := json.Unmarshal(value, &ban)
+		if err != nil {
+			return err
+		}
+		bans = append(bans, ban)
+		return nil
+	})
+	return bans, err
+}
@@ -1,7 +1,10 @@
 package db
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math"
 	"path/filepath"
 	"seclink/log"
 	"time"
@@ -10,11 +13,75 @@ import (
 	"github.com/spf13/viper"
 )
 
+// Key prefixes, every record type lives under its own prefix so iterators
+// never see each others values
+const (
+	linkPrefix    = "link/"
+	metaPrefix    = "meta/"
+	userPrefix    = "user/"
+	sessionPrefix = "session/"
+	tokenPrefix   = "token/"
+	auditPrefix   = "audit/"
+	uploadPrefix  = "upload/"
+	filePrefix    = "file/"
+	gonePrefix    = "gone/"   // Why a link went away, see GetGoneLink
+	resumePrefix  = "resume/" // Downloads a client may resume without counting, see SetResumeGrant
+	banPrefix     = "ban/"    // Clients kept off the public port, see SetBan
+)
+
+// Passed as the ttl of a record that is kept until it is removed
+const NoExpiry time.Duration = math.MinInt64
+
+// Returned when a record is given a ttl that has already run out
+var ErrInvalidTtl = errors.New("ttl must be positive")
+
 type ISeclinkDb interface {
 	Start(lock bool, ro bool) error
 	Get([]byte) ([]byte, error)
 	Set([]byte, []byte, time.Duration) error
+	GetLink(id string) (SLinkRecord, error)
+	SetLink(id string, record SLinkRecord, ttl time.Duration) error
+	UpdateLink(id string, update func(*SLinkRecord) error) (SLinkRecord, error)
+	ExtendLink(id string, by time.Duration, update func(*SLinkRecord) error) (SLinkRecord, error)
+	ConsumeDownload(id string, keep time.Duration) (SLinkRecord, error)
+	DeleteLink(id string, reason string) error
+	GetGoneLink(id string) (SGoneLink, error)
+	GetSharedLink(id string) (SSharedLink, error)
+	GetResumeGrant(id string, token string, path string) (SResumeGrant, error)
+	GetResumeSession(id string, token string) (time.Time, error)
+	SetResumeGrant(id string, token string, grant SResumeGrant, ttl time.Duration) error
+	GetBan(ip string) (SBan, error)
+	SetBan(ban SBan, ttl time.Duration) error
+	DeleteBan(ip string) error
+	GetAllBans() ([]SBan, error)
 	GetAllLinks() ([]SSharedLink, error)
+	GetLinksByPath(path string) ([]SSharedLink, error)
+	MoveLinkPaths(from string, to string) (int, error)
+	GetSecret(name string) ([]byte, error)
+	GetUser(username string) (SUser, error)
+	SetUser(user SUser) error
+	DeleteUser(username string) error
+	GetAllUsers() ([]SUser, error)
+	GetSession(id string) (SSession, error)
+	SetSession(id string, session SSession, ttl time.Duration) error
+	DeleteSession(id string) error
+	GetToken(id string) (SApiToken, error)
+	SetToken(token SApiToken) error
+	DeleteToken(id string) error
+	GetAllTokens() ([]SApiToken, error)
+	TouchToken(id string, usedAt time.Time) error
+	GetUpload(id string) (SUpload, error)
+	SetUpload(upload SUpload) error
+	DeleteUpload(id string) error
+	GetAllUploads() ([]SUpload, error)
+	GetFileRecord(path string) (SFileRecord, error)
+	SetFileRecord(record SFileRecord) error
+	DeleteFileRecord(path string) error
+	GetAllFileRecords() ([]SFileRecord, error)
+	MoveFileRecords(from string, to string) (int, error)
+	AddAuditEvent(event SAuditEvent) (SAuditEvent, error)
+	GetAuditEvents(filter SAuditFilter) ([]SAuditEvent, error)
+	EachAuditEvent(filter SAuditFilter, fn func(SAuditEvent) error) error
 	Close() error
 }
 
@@ -41,6 +108,18 @@ func (d *SSeclinkDb) Start(lock bool, ro bool) error {
 	// Success, assign the db to the struct
 	d.db = db
 	l.Info().Msg("Successfully started the BadgerDB")
+
+	// Upgrade any records written by older versions, this needs write access
+	if !ro {
+		err = d.migrate()
+		if err != nil {
+			l.Error().
+				Err(err).
+				Msg("An error was encountered migrating the BadgerDB")
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -59,19 +138,9 @@ func (d *SSeclinkDb) Get(key []byte) ([]byte, error) {
 			return err
 		}
 
-		err = item.Value(func(val []byte) error {
-			// This func with val would only be called if item.Value encounters no error.
-
-			value = val
-
-			return nil
-		})
-
-		if err != nil {
-			return err
-		}
-
-		return nil
+		// The slice item.Value hands over is only valid inside the transaction
+		value, err = item.ValueCopy(nil)
+		return err
 	})
 
 	// Final handle
@@ -82,60 +151,103 @@ func (d *SSeclinkDb) Get(key []byte) ([]byte, error) {
 	}
 }
 
-// Sets a key in the db
+// Sets a key in the db that expires after ttl, or never when ttl is NoExpiry
 func (d *SSeclinkDb) Set(key []byte, val []byte, ttl time.Duration) error {
 	l := log.Get()
 
 	l.Trace().Bytes("id", key).Bytes("val", val).Dur("ttl", ttl).Msg("Set trace")
+	if ttl <= 0 && ttl != NoExpiry {
+		return ErrInvalidTtl
+	}
 	err := d.db.Update(func(txn *badger.Txn) error {
-		e := badger.NewEntry(key, val).WithTTL(ttl)
+		e := badger.NewEntry(key, val)
+		if ttl != NoExpiry {
+			e = e.WithTTL(ttl)
+		}
 		err := txn.SetEntry(e)
 		return err
 	})
 	return err
 }
 
-// Gets all keys in the db
-func (d *SSeclinkDb) GetAllLinks() ([]SSharedLink, error) {
-	//l := log.Get()
+// Decodes the JSON record stored under key into v
+func (d *SSeclinkDb) getRecord(key string, v any) error {
+	value, err := d.Get([]byte(key))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(value, v)
+}
 
-	results := make([]SSharedLink, 0)
+// Stores v as a JSON record under key, see Set for the ttl
+func (d *SSeclinkDb) setRecord(key string, v any, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return d.Set([]byte(key), value, ttl)
+}
 
-	err := d.db.View(func(txn *badger.Txn) error {
+// Calls fn with the key, value and expiry of every item under prefix
+func (d *SSeclinkDb) eachRecord(prefix string, fn func(key string, value []byte, expiresAt uint64) error) error {
+	return d.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 10
+		opts.Prefix = []byte(prefix)
 		it := txn.NewIterator(opts)
 		defer it.Close()
 		for it.Rewind(); it.Valid(); it.Next() {
-			newResult := SSharedLink{}
 			item := it.Item()
-			k := item.Key()
-
-			// Get timestamp
-			expiresAt := time.Unix(int64(item.ExpiresAt()), 0)
-			newResult.ExpiresAt = expiresAt
-			newResult.Ttl = time.Duration(time.Since(expiresAt))
-			newResult.TtlString = newResult.Ttl.String()
-
-			// l.Trace().Time("expiresAt", expiresAt).Msg("trace log for record expiration")
-
 			err := item.Value(func(v []byte) error {
-				newResult.Id = string(k)
-				newResult.Path = string(v)
-				return nil
+				return fn(string(item.Key()), v, item.ExpiresAt())
 			})
 			if err != nil {
 				return err
 			}
+		}
+		return nil
+	})
+}
 
-			// Formulate external URL
-			newResult.Url = fmt.Sprintf("%s/links/%s", viper.GetString("server.externalurl"), newResult.Id)
+// Removes key, returning notFound when it does not exist
+func (d *SSeclinkDb) deleteKey(key string, notFound error) error {
+	return d.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			return notFound
+		}
+		if err != nil {
+			return err
+		}
+		return txn.Delete([]byte(key))
+	})
+}
 
-			results = append(results, newResult)
+// Returns the named server secret, generating and storing a random one the
+// first time it is asked for. Secrets are used to sign cookies so they
+// survive restarts without needing any configuration
+func (d *SSeclinkDb) GetSecret(name string) ([]byte, error) {
+	var secret []byte
+	key := []byte(metaPrefix + "secret/" + name)
+
+	err := d.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == nil {
+			secret, err = item.ValueCopy(nil)
+			return err
 		}
-		return nil
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		secret = make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, secret)
 	})
-	return results, err
+	return secret, err
 }
 
 // New Seclink DB
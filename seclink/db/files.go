@@ -0,0 +1,97 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Returned when no record exists for a file
+var ErrFileNotFound = errors.New("file record not found")
+
+// Retrieves the record of the file at path
+func (d *SSeclinkDb) GetFileRecord(path string) (SFileRecord, error) {
+	var record SFileRecord
+
+	err := d.getRecord(filePrefix+path, &record)
+	if err == badger.ErrKeyNotFound {
+		return record, ErrFileNotFound
+	}
+	return record, err
+}
+
+// Stores the record of a file, replacing any earlier one for the same path
+func (d *SSeclinkDb) SetFileRecord(record SFileRecord) error {
+	return d.setRecord(filePrefix+record.Path, record, NoExpiry)
+}
+
+// Removes the record of a deleted file
+func (d *SSeclinkDb) DeleteFileRecord(path string) error {
+	return d.deleteKey(filePrefix+path, ErrFileNotFound)
+}
+
+// Lists the records of every file
+func (d *SSeclinkDb) GetAllFileRecords() ([]SFileRecord, error) {
+	records := make([]SFileRecord, 0)
+
+	err := d.eachRecord(filePrefix, func(_ string, value []byte, _ uint64) error {
+		var record SFileRecord
+		err := json.Unmarshal(value, &record)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// Points the records of from, and everything below it when it is a folder,
+// at their new path under to. Returns how many records moved
+func (d *SSeclinkDb) MoveFileRecords(from string, to string) (int, error) {
+	moved := 0
+
+	err := d.db.Update(func(txn *badger.Txn) error {
+		var records []SFileRecord
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(filePrefix + from)
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			var record SFileRecord
+			err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &record)
+			})
+			if err != nil {
+				it.Close()
+				return err
+			}
+			// The prefix also matches siblings such as from2
+			if record.Path == from || strings.HasPrefix(record.Path, from+"/") {
+				records = append(records, record)
+			}
+		}
+		it.Close()
+
+		for _, record := range records {
+			err := txn.Delete([]byte(filePrefix + record.Path))
+			if err != nil {
+				return err
+			}
+			record.Path = movePath(record.Path, from, to)
+			value, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			err = txn.Set([]byte(filePrefix+record.Path), value)
+			if err != nil {
+				return err
+			}
+		}
+		moved = len(records)
+		return nil
+	})
+	return moved, err
+}
@@ -0,0 +1,375 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"seclink/log"
+	"slices"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/spf13/viper"
+)
+
+var (
+	// Returned when no link exists with the given id, or it has expired
+	ErrLinkNotFound = errors.New("link not found")
+	// Returned when a link has used up all of its downloads
+	ErrLinkExhausted = errors.New("link download limit reached")
+	// Returned when extending a link that never expires
+	ErrLinkNoExpiry = errors.New("link does not expire")
+)
+
+// Why a link went away, recorded by SetLink, ExtendLink and DeleteLink
+const (
+	LinkGoneExpired     = "expired"
+	LinkGoneRevoked     = "revoked"
+	LinkGoneFileRemoved = "file removed"
+	LinkGoneExhausted   = "exhausted"
+)
+
+// How long a link is remembered after it goes
+const goneLinkTTL = 30 * 24 * time.Hour
+
+// Retrieves a link record from the db
+func (d *SSeclinkDb) GetLink(id string) (SLinkRecord, error) {
+	var record SLinkRecord
+
+	err := d.getRecord(linkPrefix+id, &record)
+	if err == badger.ErrKeyNotFound {
+		return record, ErrLinkNotFound
+	}
+	return record, err
+}
+
+// Stores a link record in the db, the record expires after ttl or never
+// when it is NoExpiry
+func (d *SSeclinkDb) SetLink(id string, record SLinkRecord, ttl time.Duration) error {
+	record.Version = LinkRecordVersion
+	err := d.setRecord(linkPrefix+id, record, ttl)
+	if err != nil || ttl <= 0 {
+		return err
+	}
+	return d.setGoneLink(id, LinkGoneExpired, time.Now().Add(ttl))
+}
+
+// Counts a download against the link, the read and increment happen in one
+// transaction so concurrent downloads can never exceed the budget.
+// ErrLinkExhausted is returned when there are no downloads left. Once the
+// last download is taken the link is only kept for keep, so that download
+// can still be resumed, and is then remembered as exhausted
+func (d *SSeclinkDb) ConsumeDownload(id string, keep time.Duration) (SLinkRecord, error) {
+	var goneAt time.Time
+	record, err := d.updateLink(id, func(record *SLinkRecord, expiresAt *time.Time) error {
+		if record.Exhausted() {
+			return ErrLinkExhausted
+		}
+		record.Downloads++
+		if !record.Exhausted() || keep <= 0 {
+			return nil
+		}
+		goneAt = time.Now().Add(keep)
+		if !expiresAt.IsZero() && expiresAt.Before(goneAt) {
+			goneAt = *expiresAt
+		}
+		*expiresAt = goneAt
+		return nil
+	})
+	if err != nil || !record.Exhausted() {
+		return record, err
+	}
+	if !goneAt.IsZero() {
+		return record, d.setGoneLink(id, LinkGoneExhausted, goneAt)
+	}
+
+	// Nothing to resume so the link goes now, it may have been revoked in the meantime
+	err = d.DeleteLink(id, LinkGoneExhausted)
+	if err == ErrLinkNotFound {
+		err = nil
+	}
+	return record, err
+}
+
+// Applies update to a stored link record, keeping its current expiry
+func (d *SSeclinkDb) UpdateLink(id string, update func(*SLinkRecord) error) (SLinkRecord, error) {
+	return d.updateLink(id, func(record *SLinkRecord, _ *time.Time) error {
+		return update(record)
+	})
+}
+
+// Pushes the expiry of a link back by the given duration and applies update,
+// when it is not nil, in the same transaction. ErrLinkNoExpiry is returned
+// for links that never expire
+func (d *SSeclinkDb) ExtendLink(id string, by time.Duration, update func(*SLinkRecord) error) (SLinkRecord, error) {
+	if by <= 0 {
+		return SLinkRecord{}, ErrInvalidTtl
+	}
+	var extended time.Time
+	record, err := d.updateLink(id, func(record *SLinkRecord, expiresAt *time.Time) error {
+		if expiresAt.IsZero() {
+			return ErrLinkNoExpiry
+		}
+		*expiresAt = expiresAt.Add(by)
+		extended = *expiresAt
+		record.Ttl += by
+		if update == nil {
+			return nil
+		}
+		return update(record)
+	})
+	if err != nil {
+		return record, err
+	}
+	return record, d.setGoneLink(id, LinkGoneExpired, extended)
+}
+
+// Removes a link, reason is one of the LinkGone constants
+func (d *SSeclinkDb) DeleteLink(id string, reason string) error {
+	err := d.deleteKey(linkPrefix+id, ErrLinkNotFound)
+	if err != nil {
+		return err
+	}
+	return d.setGoneLink(id, reason, time.Now())
+}
+
+// Gets why a link that no longer exists went away. Links are remembered for
+// a while after they expire or are removed, ErrLinkNotFound is returned for
+// links that were forgotten or never existed
+func (d *SSeclinkDb) GetGoneLink(id string) (SGoneLink, error) {
+	var gone SGoneLink
+
+	err := d.getRecord(gonePrefix+id, &gone)
+	if err == badger.ErrKeyNotFound {
+		return gone, ErrLinkNotFound
+	}
+	return gone, err
+}
+
+// Records that link id goes, or went, away at for reason. Expiry is recorded
+// in advance as the record disappears on its own
+func (d *SSeclinkDb) setGoneLink(id string, reason string, at time.Time) error {
+	return d.setRecord(gonePrefix+id, SGoneLink{Reason: reason, At: at}, time.Until(at)+goneLinkTTL)
+}
+
+// Reads, modifies and writes back a link record inside a single transaction,
+// retrying when a concurrent writer got there first. update may move the
+// expiry, a zero time means the link never expires
+func (d *SSeclinkDb) updateLink(id string, update func(*SLinkRecord, *time.Time) error) (SLinkRecord, error) {
+	var record SLinkRecord
+	key := []byte(linkPrefix + id)
+
+	for {
+		err := d.db.Update(func(txn *badger.Txn) error {
+			// Start clean on a retry, fields left out of the JSON would keep what the last attempt set
+			record = SLinkRecord{}
+
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				return ErrLinkNotFound
+			}
+			if err != nil {
+				return err
+			}
+
+			err = item.Value(func(v []byte) error {
+				return json.Unmarshal(v, &record)
+			})
+			if err != nil {
+				return err
+			}
+
+			var expiresAt time.Time
+			if item.ExpiresAt() != 0 {
+				expiresAt = time.Unix(int64(item.ExpiresAt()), 0)
+			}
+
+			err = update(&record, &expiresAt)
+			if err != nil {
+				return err
+			}
+
+			value, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+
+			e := badger.NewEntry(key, value)
+			if !expiresAt.IsZero() {
+				e.ExpiresAt = uint64(expiresAt.Unix())
+			}
+			return txn.SetEntry(e)
+		})
+
+		// Another writer updated the record first, try again with fresh data
+		if err == badger.ErrConflict {
+			continue
+		}
+		return record, err
+	}
+}
+
+// Gets the UI/API view of a single link
+func (d *SSeclinkDb) GetSharedLink(id string) (SSharedLink, error) {
+	var link SSharedLink
+
+	err := d.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(linkPrefix + id))
+		if err == badger.ErrKeyNotFound {
+			return ErrLinkNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var record SLinkRecord
+		err = item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &record)
+		})
+		if err != nil {
+			return err
+		}
+
+		link = newSharedLink(id, record, item.ExpiresAt())
+		return nil
+	})
+	return link, err
+}
+
+// Gets all links in the db, exhausted links that are only kept so their last
+// download can be resumed are left out
+func (d *SSeclinkDb) GetAllLinks() ([]SSharedLink, error) {
+	l := log.Get()
+
+	results := make([]SSharedLink, 0)
+
+	err := d.eachRecord(linkPrefix, func(key string, value []byte, expiresAt uint64) error {
+		id := key[len(linkPrefix):]
+
+		var record SLinkRecord
+		err := json.Unmarshal(value, &record)
+		if err != nil {
+			// A single bad record should not hide every other link
+			l.Error().Err(err).Str("ID", id).Msg("Could not decode link record")
+			return nil
+		}
+		if record.Exhausted() {
+			return nil
+		}
+
+		results = append(results, newSharedLink(id, record, expiresAt))
+		return nil
+	})
+	return results, err
+}
+
+// Repoints every link sharing from, or a path below it, at to. Used when files
+// and folders are moved, returns how many links were changed
+func (d *SSeclinkDb) MoveLinkPaths(from string, to string) (int, error) {
+	var ids []string
+	err := d.eachRecord(linkPrefix, func(key string, value []byte, _ uint64) error {
+		var record SLinkRecord
+		if json.Unmarshal(value, &record) != nil {
+			return nil
+		}
+		for _, p := range append([]string{record.Path}, record.Paths...) {
+			if p == from || strings.HasPrefix(p, from+"/") {
+				ids = append(ids, key[len(linkPrefix):])
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, id := range ids {
+		_, err = d.UpdateLink(id, func(record *SLinkRecord) error {
+			record.Path = movePath(record.Path, from, to)
+			for i, p := range record.Paths {
+				record.Paths[i] = movePath(p, from, to)
+			}
+			return nil
+		})
+		// Revoked or expired while we were looking
+		if err == ErrLinkNotFound {
+			continue
+		}
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// p moved from from to to, p is returned unchanged when it is not from or below it
+func movePath(p string, from string, to string) string {
+	if p == from || strings.HasPrefix(p, from+"/") {
+		return to + strings.TrimPrefix(p, from)
+	}
+	return p
+}
+
+// Every link sharing path, exhausted ones included. That is links to the
+// file itself, bundles holding it and links to a folder it is in
+func (d *SSeclinkDb) GetLinksByPath(path string) ([]SSharedLink, error) {
+	l := log.Get()
+
+	results := make([]SSharedLink, 0)
+
+	err := d.eachRecord(linkPrefix, func(key string, value []byte, expiresAt uint64) error {
+		id := key[len(linkPrefix):]
+
+		var record SLinkRecord
+		err := json.Unmarshal(value, &record)
+		if err != nil {
+			l.Error().Err(err).Str("ID", id).Msg("Could not decode link record")
+			return nil
+		}
+		inFolder := record.Archive != "" && strings.HasPrefix(path, record.Path+"/")
+		if record.Path != path && !inFolder && !slices.Contains(record.Paths, path) {
+			return nil
+		}
+
+		results = append(results, newSharedLink(id, record, expiresAt))
+		return nil
+	})
+	return results, err
+}
+
+// Builds the UI/API view of a link from its stored record
+func newSharedLink(id string, record SLinkRecord, expiresAtUnix uint64) SSharedLink {
+	link := SSharedLink{
+		Id:           id,
+		Path:         record.Path,
+		CreatedBy:    record.CreatedBy,
+		CreatedAt:    record.CreatedAt,
+		Downloads:    record.Downloads,
+		MaxDownloads: record.MaxDownloads,
+		Notes:        record.Notes,
+		Archive:      record.Archive,
+		Paths:        record.Paths,
+		E2E:          record.E2E,
+		Landing:      record.Landing,
+		Message:      record.Message,
+		RateLimit:    record.RateLimit,
+		Protected:    record.PassphraseHash != "",
+		Locked:       record.Locked,
+		TtlString:    "never",
+		// Formulate external URL
+		Url: fmt.Sprintf("%s/links/%s", viper.GetString("server.externalurl"), id),
+	}
+
+	// Badger reports 0 for keys without a TTL
+	if expiresAtUnix != 0 {
+		link.ExpiresAt = time.Unix(int64(expiresAtUnix), 0)
+		link.Ttl = time.Until(link.ExpiresAt).Round(time.Second)
+		link.TtlString = link.Ttl.String()
+	}
+
+	return link
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// A database in a temporary folder, closed when the test ends
+func newTestDb(t *testing.T) *SSeclinkDb {
+	t.Cleanup(viper.Reset)
+	viper.Set("server.datapath", t.TempDir())
+
+	d := NewSeclinkDb().(*SSeclinkDb)
+	err := d.Start(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func mustSetLink(t *testing.T, d *SSeclinkDb, id string, record SLinkRecord, ttl time.Duration) {
+	t.Helper()
+	err := d.SetLink(id, record, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expiresAt(t *testing.T, d *SSeclinkDb, id string) time.Time {
+	t.Helper()
+	link, err := d.GetSharedLink(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link.ExpiresAt
+}
+
+func TestExtendLink(t *testing.T) {
+	d := newTestDb(t)
+	mustSetLink(t, d, "expiring", SLinkRecord{Path: "file.txt"}, time.Hour)
+	mustSetLink(t, d, "forever", SLinkRecord{Path: "file.txt"}, NoExpiry)
+	before := expiresAt(t, d, "expiring")
+
+	setNotes := func(record *SLinkRecord) error {
+		record.Notes = "extended"
+		return nil
+	}
+
+	// A failed update leaves the expiry where it was
+	failure := errors.New("update failed")
+	_, err := d.ExtendLink("expiring", time.Hour, func(*SLinkRecord) error { return failure })
+	if err != failure {
+		t.Fatalf("failed update gave %v", err)
+	}
+	if after := expiresAt(t, d, "expiring"); !after.Equal(before) {
+		t.Fatalf("failed update moved the expiry from %s to %s", before, after)
+	}
+
+	record, err := d.ExtendLink("expiring", time.Hour, setNotes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Notes != "extended" {
+		t.Fatalf("update was not applied, notes %q", record.Notes)
+	}
+	if after := expiresAt(t, d, "expiring"); !after.Equal(before.Add(time.Hour)) {
+		t.Fatalf("expiry moved from %s to %s, wanted an hour later", before, after)
+	}
+	gone, err := d.GetGoneLink("expiring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gone.Reason != LinkGoneExpired || gone.At.Unix() != before.Add(time.Hour).Unix() {
+		t.Fatalf("link is remembered as going %+v, wanted expired at %s", gone, before.Add(time.Hour))
+	}
+
+	_, err = d.ExtendLink("forever", time.Hour, setNotes)
+	if err != ErrLinkNoExpiry {
+		t.Fatalf("extending a link that never expires gave %v", err)
+	}
+	record, err = d.GetLink("forever")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Notes != "" {
+		t.Fatal("update was applied to a link that could not be extended")
+	}
+
+	for _, by := range []time.Duration{0, -time.Hour} {
+		_, err = d.ExtendLink("expiring", by, nil)
+		if err != ErrInvalidTtl {
+			t.Fatalf("extending by %s gave %v", by, err)
+		}
+	}
+	_, err = d.ExtendLink("missing", time.Hour, nil)
+	if err != ErrLinkNotFound {
+		t.Fatalf("extending a missing link gave %v", err)
+	}
+}
+
+func TestConsumeDownloadConcurrent(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		keep time.Duration
+	}{
+		{"one time", 1, 0},
+		{"limited", 5, 0},
+		{"kept for resuming", 5, time.Hour},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTestDb(t)
+			mustSetLink(t, d, "link", SLinkRecord{Path: "file.txt", MaxDownloads: test.max}, time.Hour)
+
+			const clients = 50
+			results := make(chan error, clients)
+			var start sync.WaitGroup
+			start.Add(1)
+			for i := 0; i < clients; i++ {
+				go func() {
+					start.Wait()
+					_, err := d.ConsumeDownload("link", test.keep)
+					results <- err
+				}()
+			}
+			start.Done()
+
+			counted := 0
+			for i := 0; i < clients; i++ {
+				err := <-results
+				switch err {
+				case nil:
+					counted++
+				case ErrLinkExhausted, ErrLinkNotFound:
+				default:
+					t.Fatal(err)
+				}
+			}
+			if counted != test.max {
+				t.Fatalf("%d downloads were counted, the limit is %d", counted, test.max)
+			}
+
+			gone, err := d.GetGoneLink("link")
+			if err != nil || gone.Reason != LinkGoneExhausted {
+				t.Fatalf("exhausted link is remembered as %+v, err %v", gone, err)
+			}
+			record, err := d.GetLink("link")
+			if test.keep == 0 {
+				if err != ErrLinkNotFound {
+					t.Fatalf("exhausted link was kept, err %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("exhausted link was not kept for resuming: %v", err)
+			}
+			if record.Downloads != test.max {
+				t.Fatalf("link records %d downloads, wanted %d", record.Downloads, test.max)
+			}
+			links, err := d.GetAllLinks()
+			if err != nil || len(links) != 0 {
+				t.Fatalf("exhausted link is listed: %+v, err %v", links, err)
+			}
+		})
+	}
+}
+
+func TestGetLinksByPath(t *testing.T) {
+	d := newTestDb(t)
+	links := map[string]SLinkRecord{
+		"file":         {Path: "docs/report.pdf"},
+		"folder":       {Path: "docs", Archive: "zip"},
+		"other folder": {Path: "work/docs", Archive: "zip"},
+		"bundle":       {Paths: []string{"notes.txt", "docs/report.pdf"}},
+		"other bundle": {Paths: []string{"notes.txt"}},
+		"similar file": {Path: "docs/report.pdf.bak"},
+		"similar name": {Path: "docs2", Archive: "zip"},
+		"file as name": {Path: "docs/report", Archive: "zip"},
+	}
+	for id, record := range links {
+		mustSetLink(t, d, id, record, time.Hour)
+	}
+
+	found, err := d.GetLinksByPath("docs/report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, link := range found {
+		ids = append(ids, link.Id)
+	}
+	slices.Sort(ids)
+	if want := []string{"bundle", "file", "folder"}; !slices.Equal(ids, want) {
+		t.Fatalf("links sharing the file are %v, wanted %v", ids, want)
+	}
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"encoding/json"
+	"seclink/log"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Key holding the schema version the stored records have been migrated to
+const schemaVersionKey = metaPrefix + "schemaversion"
+
+// A migration upgrades the db from the previous schema version to the next
+type migration func(d *SSeclinkDb) error
+
+// Migrations are applied in order, index 0 upgrades schema version 0 to 1
+var migrations = []migration{
+	migratePlainPathLinks,
+	migrateUserRoles,
+}
+
+// migrate brings every stored record up to the latest schema version
+func (d *SSeclinkDb) migrate() error {
+	l := log.Get()
+
+	version, err := d.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		l.Info().
+			Int("From", version).
+			Int("To", version+1).
+			Msg("Migrating the BadgerDB schema")
+
+		err = migrations[version](d)
+		if err != nil {
+			return err
+		}
+
+		err = d.Set([]byte(schemaVersionKey), []byte(strconv.Itoa(version+1)), NoExpiry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the schema version of the db, a missing key means version 0
+func (d *SSeclinkDb) schemaVersion() (int, error) {
+	value, err := d.Get([]byte(schemaVersionKey))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(value))
+}
+
+// Schema 0 stored the relative file path as the raw value under the bare
+// link id, rewrite those as link records under the link prefix keeping the
+// remaining TTL
+func migratePlainPathLinks(d *SSeclinkDb) error {
+	l := log.Get()
+
+	type plainLink struct {
+		id        string
+		path      string
+		expiresAt uint64
+	}
+	var links []plainLink
+
+	err := d.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := string(item.Key())
+			if strings.Contains(key, "/") {
+				continue
+			}
+
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			links = append(links, plainLink{id: key, path: string(value), expiresAt: item.ExpiresAt()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		err = d.db.Update(func(txn *badger.Txn) error {
+			err := txn.Delete([]byte(link.id))
+			if err != nil {
+				return err
+			}
+
+			var ttl time.Duration
+			if link.expiresAt != 0 {
+				ttl = time.Until(time.Unix(int64(link.expiresAt), 0))
+				if ttl <= 0 {
+					// Already expired, nothing worth keeping
+					return nil
+				}
+			}
+
+			value, err := json.Marshal(SLinkRecord{
+				Version: LinkRecordVersion,
+				Path:    link.path,
+				Ttl:     ttl,
+			})
+			if err != nil {
+				return err
+			}
+
+			e := badger.NewEntry([]byte(linkPrefix+link.id), value)
+			if ttl > 0 {
+				e = e.WithTTL(ttl)
+			}
+			return txn.SetEntry(e)
+		})
+		if err != nil {
+			return err
+		}
+
+		l.Info().Str("ID", link.id).Str("Path", link.path).Msg("Migrated plain path link to a link record")
+	}
+
+	return nil
+}
+
+// Users created before roles existed had full access, keep it that way by
+// making them admins
+func migrateUserRoles(d *SSeclinkDb) error {
+	l := log.Get()
+
+	users, err := d.GetAllUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		if user.Role != "" {
+			continue
+		}
+		user.Role = "admin"
+
+		err = d.SetUser(user)
+		if err != nil {
+			return err
+		}
+		l.Info().Str("Username", user.Username).Msg("Migrated user without a role to admin")
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Returned when a token has no grant to resume a download
+var ErrResumeGrantNotFound = errors.New("resume grant not found")
+
+func resumeKey(id string, token string) string {
+	return resumePrefix + id + "/" + token + "/"
+}
+
+// Retrieves the grant of the holder of token to resume downloading path from link id
+func (d *SSeclinkDb) GetResumeGrant(id string, token string, path string) (SResumeGrant, error) {
+	var grant SResumeGrant
+
+	err := d.getRecord(resumeKey(id, token)+path, &grant)
+	if err == badger.ErrKeyNotFound {
+		return grant, ErrResumeGrantNotFound
+	}
+	return grant, err
+}
+
+// When the session of the holder of token on link id started, the time the
+// download that began it was counted. Every grant of a session carries it
+func (d *SSeclinkDb) GetResumeSession(id string, token string) (time.Time, error) {
+	var started time.Time
+	err := d.eachRecord(resumeKey(id, token), func(key string, value []byte, expiresAt uint64) error {
+		var grant SResumeGrant
+		err := json.Unmarshal(value, &grant)
+		if err != nil {
+			return err
+		}
+		if started.IsZero() || grant.At.Before(started) {
+			started = grant.At
+		}
+		return nil
+	})
+	if err == nil && started.IsZero() {
+		err = ErrResumeGrantNotFound
+	}
+	return started, err
+}
+
+// Lets the holder of token resume downloading grant.Path from link id
+// without it being counted again, until ttl passes
+func (d *SSeclinkDb) SetResumeGrant(id string, token string, grant SResumeGrant, ttl time.Duration) error {
+	return d.setRecord(resumeKey(id, token)+grant.Path, grant, ttl)
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Returned when no API token exists with the given id, or it has expired
+var ErrTokenNotFound = errors.New("token not found")
+
+// Retrieves an API token
+func (d *SSeclinkDb) GetToken(id string) (SApiToken, error) {
+	var token SApiToken
+
+	err := d.getRecord(tokenPrefix+id, &token)
+	if err == badger.ErrKeyNotFound {
+		return token, ErrTokenNotFound
+	}
+	return token, err
+}
+
+// Stores an API token, it is removed once ExpiresAt passes
+func (d *SSeclinkDb) SetToken(token SApiToken) error {
+	ttl := NoExpiry
+	if !token.ExpiresAt.IsZero() {
+		ttl = time.Until(token.ExpiresAt)
+	}
+	return d.setRecord(tokenPrefix+token.Id, token, ttl)
+}
+
+// Revokes an API token
+func (d *SSeclinkDb) DeleteToken(id string) error {
+	return d.deleteKey(tokenPrefix+id, ErrTokenNotFound)
+}
+
+// Lists all API tokens
+func (d *SSeclinkDb) GetAllTokens() ([]SApiToken, error) {
+	tokens := make([]SApiToken, 0)
+
+	err := d.eachRecord(tokenPrefix, func(_ string, value []byte, _ uint64) error {
+		var token SApiToken
+		err := json.Unmarshal(value, &token)
+		if err != nil {
+			return err
+		}
+		tokens = append(tokens, token)
+		return nil
+	})
+	return tokens, err
+}
+
+// Records that an API token was used at the given time
+func (d *SSeclinkDb) TouchToken(id string, usedAt time.Time) error {
+	key := []byte(tokenPrefix + id)
+
+	for {
+		err := d.db.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				return ErrTokenNotFound
+			}
+			if err != nil {
+				return err
+			}
+
+			var token SApiToken
+			err = item.Value(func(v []byte) error {
+				return json.Unmarshal(v, &token)
+			})
+			if err != nil {
+				return err
+			}
+			token.LastUsedAt = usedAt
+
+			value, err := json.Marshal(token)
+			if err != nil {
+				return err
+			}
+
+			// Keep the original expiry
+			e := badger.NewEntry(key, value)
+			e.ExpiresAt = item.ExpiresAt()
+			return txn.SetEntry(e)
+		})
+
+		// Concurrent requests with the same token, the newest timestamp wins either way
+		if err == badger.ErrConflict {
+			continue
+		}
+		return err
+	}
+}
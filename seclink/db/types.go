@@ -2,11 +2,175 @@ package db
 
 import "time"
 
+// The current layout version of SLinkRecord, bump this and add a step to
+// migrate when the record changes shape
+const LinkRecordVersion = 1
+
+// SLinkRecord is the serialized value stored against each link id
+type SLinkRecord struct {
+	Version      int           `json:"version"`
+	Path         string        `json:"path"`
+	CreatedBy    string        `json:"createdBy,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	Ttl          time.Duration `json:"ttl"`
+	Downloads    int           `json:"downloads"`
+	MaxDownloads int           `json:"maxDownloads,omitempty"` // Downloads allowed before the link is exhausted, 0 is unlimited
+	Notes        string        `json:"notes,omitempty"`
+	Archive      string        `json:"archive,omitempty"`   // Set for folder links, the format the folder is streamed as
+	Paths        []string      `json:"paths,omitempty"`     // Set for bundle links, the files in the bundle. Path is empty
+	E2E          bool          `json:"e2e,omitempty"`       // The file was encrypted in the browser, the key never reaches the server
+	Landing      bool          `json:"landing,omitempty"`   // Downloads start from a landing page with a button, so link previews never count one
+	Message      string        `json:"message,omitempty"`   // Shown to whoever opens the link, unlike notes
+	RateLimit    int64         `json:"rateLimit,omitempty"` // Bytes a second shared by every download of the link, 0 is unlimited
+	// Links with a passphrase must be unlocked before downloading
+	PassphraseHash string `json:"passphraseHash,omitempty"`
+	FailedAttempts int    `json:"failedAttempts,omitempty"`
+	Locked         bool   `json:"locked,omitempty"` // Set once FailedAttempts reaches the configured threshold
+}
+
+// Whether the download budget of the link has been spent
+func (r SLinkRecord) Exhausted() bool {
+	return r.MaxDownloads > 0 && r.Downloads >= r.MaxDownloads
+}
+
 type SSharedLink struct {
-	Id        string
-	Path      string
-	ExpiresAt time.Time
-	Ttl       time.Duration
-	TtlString string
-	Url       string
+	Id           string        `json:"id"`
+	Path         string        `json:"path"`
+	CreatedBy    string        `json:"createdBy,omitempty"`
+	CreatedAt    time.Time     `json:"createdAt"`
+	Downloads    int           `json:"downloads"`
+	MaxDownloads int           `json:"maxDownloads,omitempty"`
+	Notes        string        `json:"notes,omitempty"`
+	Archive      string        `json:"archive,omitempty"`
+	Paths        []string      `json:"paths,omitempty"`
+	E2E          bool          `json:"e2e,omitempty"`
+	Landing      bool          `json:"landing,omitempty"`
+	Message      string        `json:"message,omitempty"`
+	RateLimit    int64         `json:"rateLimit,omitempty"`
+	Protected    bool          `json:"protected"`
+	Locked       bool          `json:"locked"`
+	ExpiresAt    time.Time     `json:"expiresAt"`
+	Ttl          time.Duration `json:"-"`
+	TtlString    string        `json:"ttl"`
+	Url          string        `json:"url"`
+}
+
+// Whether the download budget of the link has been spent
+func (s SSharedLink) Exhausted() bool {
+	return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+// SGoneLink remembers why a link no longer exists, so visitors following it
+// can be told rather than getting a plain not found
+type SGoneLink struct {
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// SResumeGrant lets a client that downloaded a file from a link fetch the
+// rest of it with range requests, without that counting as another download
+type SResumeGrant struct {
+	Path string    `json:"path"`
+	ETag string    `json:"etag"` // The version of the file that was counted, a changed file is a new download
+	At   time.Time `json:"at"`   // When the download that started the session was counted
+}
+
+// SBan keeps a client that kept asking for links that do not exist, or
+// guessing passphrases, away from the public port
+type SBan struct {
+	Ip       string    `json:"ip"`
+	Strikes  int       `json:"strikes"` // Bans so far, each lasts twice as long as the one before
+	Reason   string    `json:"reason"`  // The failure that led to the last ban
+	BannedAt time.Time `json:"bannedAt"`
+	Until    time.Time `json:"until"`
+}
+
+// Whether the client is still banned, an ended ban is kept a while to remember its strikes
+func (b SBan) Active() bool {
+	return time.Now().Before(b.Until)
+}
+
+// SUser is a local admin user
+type SUser struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Role         string    `json:"role"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// SSession is a logged in admin session, stored against a hash of the session cookie
+type SSession struct {
+	Username  string    `json:"username"`
+	Provider  string    `json:"provider"` // The auth provider the user logged in with
+	Role      string    `json:"role,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// SApiToken is a long lived token for automation against the admin API, only
+// a hash of the secret part is stored
+type SApiToken struct {
+	Id         string    `json:"id"`
+	Name       string    `json:"name"`
+	SecretHash string    `json:"secretHash,omitempty"`
+	Scopes     []string  `json:"scopes"`
+	CreatedBy  string    `json:"createdBy,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt,omitempty"` // Zero when the token never expires
+	LastUsedAt time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// SAuditEvent is an entry in the append only audit log
+type SAuditEvent struct {
+	Id        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor,omitempty"` // Empty for anonymous visitors of public links
+	Target    string    `json:"target,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	ClientIp  string    `json:"clientIp,omitempty"`
+	UserAgent string    `json:"userAgent,omitempty"`
+}
+
+// SAuditFilter narrows down audit events, zero values match everything
+type SAuditFilter struct {
+	Action string
+	Actor  string
+	Target string
+	Since  time.Time
+	Until  time.Time
+	Before string // Only events older than this event id, used for paging
+	Limit  int
+}
+
+// SUpload is a resumable upload in progress, the bytes received so far are
+// staged on disk and the offset is the size of the staged file
+type SUpload struct {
+	Id        string    `json:"id"`
+	Path      string    `json:"path"` // Where the file goes in the files directory once complete
+	Length    int64     `json:"length"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// The checksum is carried between requests as the saved state of the hash
+	HashState  []byte `json:"hashState,omitempty"`
+	StagingKey []byte `json:"stagingKey,omitempty"` // Wrapped by the master key, set when the upload is staged encrypted
+	Hashed     int64  `json:"hashed"`               // Bytes that went through the hash, behind the offset when a write was cut short
+}
+
+// SFileRecord holds what seclink knows about a file in the files directory
+// beyond what the file system does, stored against its path. Files copied in
+// by hand have none
+type SFileRecord struct {
+	Path       string    `json:"path"`
+	UploadedBy string    `json:"uploadedBy,omitempty"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	Sha256     string    `json:"sha256,omitempty"` // Hex checksum of the content, worked out as it was written
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+}
+
+// Whether the checksum still describes a file with this size and
+// modification time, a file changed on disk no longer matches it
+func (r SFileRecord) Current(size int64, modTime time.Time) bool {
+	return r.Sha256 != "" && r.Size == size && r.ModTime.Equal(modTime)
 }
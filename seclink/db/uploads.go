@@ -0,0 +1,49 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// Returned when no upload exists with the given id, or it has expired
+var ErrUploadNotFound = errors.New("upload not found")
+
+// Retrieves an in progress upload
+func (d *SSeclinkDb) GetUpload(id string) (SUpload, error) {
+	var upload SUpload
+
+	err := d.getRecord(uploadPrefix+id, &upload)
+	if err == badger.ErrKeyNotFound {
+		return upload, ErrUploadNotFound
+	}
+	return upload, err
+}
+
+// Stores an in progress upload, it is removed once ExpiresAt passes
+func (d *SSeclinkDb) SetUpload(upload SUpload) error {
+	return d.setRecord(uploadPrefix+upload.Id, upload, time.Until(upload.ExpiresAt))
+}
+
+// Removes an upload, when it completes or is terminated
+func (d *SSeclinkDb) DeleteUpload(id string) error {
+	return d.deleteKey(uploadPrefix+id, ErrUploadNotFound)
+}
+
+// Lists all in progress uploads that have not expired
+func (d *SSeclinkDb) GetAllUploads() ([]SUpload, error) {
+	uploads := make([]SUpload, 0)
+
+	err := d.eachRecord(uploadPrefix, func(_ string, value []byte, _ uint64) error {
+		var upload SUpload
+		err := json.Unmarshal(value, &upload)
+		if err != nil {
+			return err
+		}
+		uploads = append(uploads, upload)
+		return nil
+	})
+	return uploads, err
+}
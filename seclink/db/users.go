@@ -0,0 +1,82 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+var (
+	// Returned when no local user exists with the given username
+	ErrUserNotFound = errors.New("user not found")
+	// Returned when a session id is unknown or the session has expired
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// Retrieves a local user
+func (d *SSeclinkDb) GetUser(username string) (SUser, error) {
+	var user SUser
+
+	err := d.getRecord(userPrefix+username, &user)
+	if err == badger.ErrKeyNotFound {
+		return user, ErrUserNotFound
+	}
+	return user, err
+}
+
+// Creates or replaces a local user
+func (d *SSeclinkDb) SetUser(user SUser) error {
+	return d.setRecord(userPrefix+user.Username, user, NoExpiry)
+}
+
+// Removes a local user
+func (d *SSeclinkDb) DeleteUser(username string) error {
+	return d.deleteKey(userPrefix+username, ErrUserNotFound)
+}
+
+// Lists all local users
+func (d *SSeclinkDb) GetAllUsers() ([]SUser, error) {
+	users := make([]SUser, 0)
+
+	err := d.eachRecord(userPrefix, func(_ string, value []byte, _ uint64) error {
+		var user SUser
+		err := json.Unmarshal(value, &user)
+		if err != nil {
+			return err
+		}
+		users = append(users, user)
+		return nil
+	})
+	return users, err
+}
+
+// Retrieves a session by the id from the session cookie
+func (d *SSeclinkDb) GetSession(id string) (SSession, error) {
+	var session SSession
+
+	err := d.getRecord(sessionKey(id), &session)
+	if err == badger.ErrKeyNotFound {
+		return session, ErrSessionNotFound
+	}
+	return session, err
+}
+
+// Stores a session that expires after ttl
+func (d *SSeclinkDb) SetSession(id string, session SSession, ttl time.Duration) error {
+	return d.setRecord(sessionKey(id), session, ttl)
+}
+
+// Removes a session, used on logout
+func (d *SSeclinkDb) DeleteSession(id string) error {
+	return d.deleteKey(sessionKey(id), ErrSessionNotFound)
+}
+
+// Sessions are keyed by a hash of their id so the db never holds a usable cookie
+func sessionKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return sessionPrefix + hex.EncodeToString(sum[:])
+}
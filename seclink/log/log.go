@@ -3,7 +3,7 @@ package log
 import (
 	// "fmt"
 
-	"os"
+	"io"
 	"time"
 
 	// "gopkg.in/natefinch/lumberjack.v2"
@@ -13,7 +13,7 @@ import (
 
 var log zerolog.Logger
 
-func InitLog(logLevel int) {
+func InitLog(logLevel int, out io.Writer) {
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 	zerolog.TimeFieldFormat = time.RFC3339Nano
 
@@ -28,7 +28,7 @@ func InitLog(logLevel int) {
 	// 	MaxAge:     14, // days
 	// 	Compress:   true,
 	// }
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	output := zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339}
 
 	log = zerolog.New(output).
 		Level(zerolog.Level(logLevel)).
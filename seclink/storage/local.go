@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SLocalStorage keeps files in a folder on disk. Symlinks inside it are
+// followed as long as they lead somewhere else inside it
+type SLocalStorage struct {
+	root string
+}
+
+func NewLocalStorage(root string) *SLocalStorage {
+	return &SLocalStorage{root: root}
+}
+
+func (s *SLocalStorage) LocalPath(rel string) (string, error) {
+	return resolveSafePath(s.root, rel)
+}
+
+func (s *SLocalStorage) Stat(rel string) (SObject, error) {
+	absolutePath, err := resolveSafePath(s.root, rel)
+	if err != nil {
+		return SObject{}, err
+	}
+	info, err := os.Stat(absolutePath)
+	if err != nil {
+		return SObject{}, err
+	}
+	return localObject(rel, info), nil
+}
+
+func (s *SLocalStorage) List(dir string) ([]SObject, error) {
+	absoluteDir, err := resolveSafePath(s.root, dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(absoluteDir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, ErrNotDirectory
+	}
+
+	entries, err := os.ReadDir(absoluteDir)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]SObject, 0, len(entries))
+	for _, entry := range entries {
+		if isPartial(entry.Name()) {
+			continue
+		}
+		// Symlinks leading outside the files directory are left out
+		object, err := s.Stat(path.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func (s *SLocalStorage) Walk(dir string, fn func(object SObject) error) error {
+	absoluteDir, err := resolveSafePath(s.root, dir)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(absoluteDir, func(walkPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if walkPath == absoluteDir || isPartial(entry.Name()) {
+			return nil
+		}
+		inner, err := filepath.Rel(absoluteDir, walkPath)
+		if err != nil {
+			return err
+		}
+		rel := path.Join(dir, filepath.ToSlash(inner))
+
+		resolved, err := resolveSafePath(s.root, rel)
+		if err != nil {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := os.Stat(resolved)
+		if err != nil {
+			return nil
+		}
+
+		// Symlinked folders are not walked into, only real ones
+		if info.IsDir() && entry.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		return fn(localObject(rel, info))
+	})
+}
+
+func (s *SLocalStorage) Open(rel string) (IReader, error) {
+	absolutePath, err := resolveSafePath(s.root, rel)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(absolutePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, &fs.PathError{Op: "open", Path: rel, Err: errors.New("is a folder")}
+	}
+	return &SLocalReader{File: file, size: info.Size()}, nil
+}
+
+func (s *SLocalStorage) Create(rel string) (IWriter, error) {
+	absolutePath, err := resolveSafePath(s.root, rel)
+	if err != nil {
+		return nil, err
+	}
+	// Written beside the destination and renamed over it on Close, so a
+	// failed or aborted write leaves any file already there untouched
+	file, err := os.CreateTemp(filepath.Dir(absolutePath), partialPrefix+"*"+partialSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &SLocalWriter{File: file, destination: absolutePath}, nil
+}
+
+func (s *SLocalStorage) Delete(rel string) error {
+	err := s.checkEntry(rel)
+	if err != nil {
+		return err
+	}
+	// Remove the entry itself rather than what the resolver followed it to,
+	// so deleting a symlink never deletes its target
+	absolutePath := filepath.Join(s.root, filepath.FromSlash(rel))
+	info, err := os.Lstat(absolutePath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return &fs.PathError{Op: "delete", Path: rel, Err: errors.New("is a folder")}
+	}
+	return os.Remove(absolutePath)
+}
+
+func (s *SLocalStorage) Move(from string, to string) error {
+	err := s.checkEntry(from)
+	if err != nil {
+		return err
+	}
+	absoluteTo, err := resolveSafePath(s.root, to)
+	if err != nil {
+		return err
+	}
+
+	// Move the entry itself, never what a symlink points at
+	absoluteFrom := filepath.Join(s.root, filepath.FromSlash(from))
+	if _, err := os.Lstat(absoluteFrom); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(absoluteTo); err == nil {
+		return ErrExists
+	}
+	info, err := os.Stat(filepath.Dir(absoluteTo))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return ErrNotDirectory
+	}
+	return os.Rename(absoluteFrom, absoluteTo)
+}
+
+func (s *SLocalStorage) MakeDir(rel string) error {
+	absoluteDir, err := resolveSafePath(s.root, rel)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(absoluteDir); err == nil {
+		return ErrExists
+	}
+	return os.MkdirAll(absoluteDir, 0700)
+}
+
+// Checks rel is safe, for operations on the entry at rel itself rather than
+// where it leads. Its folder must resolve inside the root
+func (s *SLocalStorage) checkEntry(rel string) error {
+	err := CheckPath(rel)
+	if err != nil {
+		return err
+	}
+	_, err = resolveSafePath(s.root, rel)
+	return err
+}
+
+func localObject(rel string, info fs.FileInfo) SObject {
+	return SObject{
+		Path:    rel,
+		Name:    path.Base(rel),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+}
+
+// SLocalReader is a file opened from local storage
+type SLocalReader struct {
+	*os.File
+	size int64
+}
+
+func (r *SLocalReader) Size() int64 {
+	return r.size
+}
+
+// Names of files still being written, they are kept out of listings
+const (
+	partialPrefix = ".seclink-"
+	partialSuffix = ".part"
+)
+
+func isPartial(name string) bool {
+	return strings.HasPrefix(name, partialPrefix) && strings.HasSuffix(name, partialSuffix)
+}
+
+// SLocalWriter is a new file being written to local storage, it goes to a
+// temporary file until Close moves it into place
+type SLocalWriter struct {
+	*os.File
+	destination string
+}
+
+func (w *SLocalWriter) Close() error {
+	err := w.File.Close()
+	if err != nil {
+		os.Remove(w.File.Name())
+		return err
+	}
+	err = os.Rename(w.File.Name(), w.destination)
+	if err != nil {
+		os.Remove(w.File.Name())
+	}
+	return err
+}
+
+func (w *SLocalWriter) Abort() {
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+// Resolves a user supplied path, relative to root, to an absolute path that
+// is guaranteed to be inside root. Absolute paths, any ".." element and
+// symlinks that lead outside root are rejected. The path does not need to
+// exist, so this is also used for upload targets
+func resolveSafePath(root string, rel string) (string, error) {
+	err := CheckPath(rel)
+	if err != nil {
+		return "", err
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(realRoot, filepath.FromSlash(rel))
+
+	// Follow symlinks in the longest part of the path that exists, whatever
+	// is left over can not be a symlink yet
+	existing := path
+	var rest []string
+	for {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(existing)}, rest...)
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		// A dangling symlink, where it points can not be checked
+		return "", ErrUnsafePath
+	}
+	if !isWithin(realRoot, real) {
+		return "", ErrUnsafePath
+	}
+
+	return filepath.Join(append([]string{real}, rest...)...), nil
+}
+
+// Rejects absolute paths and paths with a ".." element, without touching storage
+func CheckPath(rel string) error {
+	if strings.ContainsRune(rel, 0) {
+		return ErrUnsafePath
+	}
+
+	// Check both separators so a path that is harmless here cannot turn
+	// into a traversal on another platform
+	if strings.HasPrefix(rel, "/") || strings.HasPrefix(rel, `\`) || filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" {
+		return ErrUnsafePath
+	}
+	for _, element := range strings.FieldsFunc(rel, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if element == ".." {
+			return ErrUnsafePath
+		}
+	}
+	return nil
+}
+
+// Whether path is root or somewhere below it, both must be clean absolute paths
+func isWithin(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckPath(t *testing.T) {
+	tests := []struct {
+		rel  string
+		safe bool
+	}{
+		{"", true},
+		{"file.txt", true},
+		{"folder/file.txt", true},
+		{"folder/", true},
+		{"./folder/./file.txt", true},
+		{"...", true},
+		{"..file", true},
+		{"file..", true},
+		{"%2e%2e/file", true}, // Only a name until something decodes it
+		{"..", false},
+		{"../file", false},
+		{"folder/..", false},
+		{"folder/../file", false},
+		{"folder/../../file", false},
+		{"folder//../file", false},
+		{"/etc/passwd", false},
+		{"//server/share", false},
+		{`\windows\system32`, false},
+		{`..\file`, false},
+		{`folder\..\..\file`, false},
+		{"file\x00.txt", false},
+		{"\x00", false},
+	}
+
+	for _, test := range tests {
+		err := CheckPath(test.rel)
+		if test.safe && err != nil {
+			t.Errorf("CheckPath(%q) rejected a safe path: %v", test.rel, err)
+		}
+		if !test.safe && !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("CheckPath(%q) gave %v, wanted ErrUnsafePath", test.rel, err)
+		}
+	}
+}
+
+func TestResolveSafePath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	mustWrite(t, filepath.Join(root, "inside.txt"))
+	mustWrite(t, filepath.Join(outside, "secret.txt"))
+	err := os.Mkdir(filepath.Join(root, "sub"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustSymlink(t, filepath.Join(root, "sub"), filepath.Join(root, "link"))
+	mustSymlink(t, "..", filepath.Join(root, "sub", "up"))
+	mustSymlink(t, outside, filepath.Join(root, "escape"))
+	mustSymlink(t, filepath.Join(outside, "secret.txt"), filepath.Join(root, "escape.txt"))
+	mustSymlink(t, "../../..", filepath.Join(root, "sub", "relative"))
+	mustSymlink(t, filepath.Join(root, "missing"), filepath.Join(root, "dangling"))
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		rel    string
+		decode bool   // Unescaped first, the way a path from a URL is
+		want   string // Relative to root, empty when the path must be rejected
+	}{
+		{"file", "inside.txt", false, "inside.txt"},
+		{"root", "", false, "."},
+		{"missing file", "new/file.txt", false, "new/file.txt"},
+		{"trailing slash", "sub/", false, "sub"},
+		{"symlink inside", "link/file.txt", false, "sub/file.txt"},
+		{"symlink up to the root", "sub/up/inside.txt", false, "inside.txt"},
+		{"encoded dots left alone", "%2e%2e/secret.txt", false, "%2e%2e/secret.txt"},
+		{"dot dot", "../secret.txt", false, ""},
+		{"dot dot inside", "sub/../inside.txt", false, ""},
+		{"encoded dot dot", "%2e%2e/secret.txt", true, ""},
+		{"encoded slash", "sub%2f..%2f..%2fsecret.txt", true, ""},
+		{"absolute", filepath.Join(outside, "secret.txt"), false, ""},
+		{"absolute inside root", filepath.Join(root, "inside.txt"), false, ""},
+		{"windows dot dot", `..\secret.txt`, false, ""},
+		{"nul byte", "inside.txt\x00.png", false, ""},
+		{"encoded nul byte", "inside.txt%00.png", true, ""},
+		{"symlink escaping", "escape", false, ""},
+		{"file below symlink escaping", "escape/secret.txt", false, ""},
+		{"new file below symlink escaping", "escape/new.txt", false, ""},
+		{"symlink to file outside", "escape.txt", false, ""},
+		{"relative symlink escaping", "sub/relative", false, ""},
+		{"dangling symlink", "dangling", false, ""},
+		{"trailing slash on symlink escaping", "escape/", false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rel := test.rel
+			if test.decode {
+				rel, err = url.PathUnescape(rel)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			resolved, err := resolveSafePath(root, rel)
+			if test.want == "" {
+				if !errors.Is(err, ErrUnsafePath) {
+					t.Fatalf("resolved %q to %q, err %v, wanted ErrUnsafePath", rel, resolved, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rejected %q: %v", rel, err)
+			}
+			if want := filepath.Join(realRoot, filepath.FromSlash(test.want)); resolved != want {
+				t.Fatalf("resolved %q to %q, wanted %q", rel, resolved, want)
+			}
+		})
+	}
+}
+
+func mustWrite(t *testing.T, name string) {
+	t.Helper()
+	err := os.WriteFile(name, []byte(name), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustSymlink(t *testing.T, target string, name string) {
+	t.Helper()
+	err := os.Symlink(target, name)
+	if err != nil {
+		t.Skipf("symlinks are not supported here: %v", err)
+	}
+}
@@ -0,0 +1,533 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3 has no folders, only keys. A folder exists while there are keys below
+// it, and an empty one is kept by a marker object named after it with a
+// trailing slash, as the AWS console and MinIO do
+
+const (
+	s3PartSize     = 16 * 1024 * 1024 // Buffered per upload, anything larger goes up in parts this size
+	s3CheckTimeout = 10 * time.Second
+	s3MaxCopySize  = 5 * 1024 * 1024 * 1024
+)
+
+var errAborted = errors.New("write aborted")
+
+type SS3Config struct {
+	Endpoint  string // Host and port, without a scheme
+	Region    string
+	Bucket    string
+	Prefix    string // Keeps the files under a folder of the bucket
+	AccessKey string // When empty the standard AWS and MinIO environment variables are used
+	SecretKey string
+	UseSSL    bool
+}
+
+// SS3Storage keeps files in a bucket on S3 or a compatible server
+type SS3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// Connects to the bucket, failing when it can not be reached
+func NewS3Storage(config SS3Config) (*SS3Storage, error) {
+	if config.Endpoint == "" || config.Bucket == "" {
+		return nil, errors.New("storage.s3.endpoint and storage.s3.bucket are required for s3 storage")
+	}
+
+	creds := credentials.NewStaticV4(config.AccessKey, config.SecretKey, "")
+	if config.AccessKey == "" {
+		creds = credentials.NewChainCredentials([]credentials.Provider{&credentials.EnvAWS{}, &credentials.EnvMinio{}})
+	}
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: config.UseSSL,
+		Region: config.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3CheckTimeout)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach bucket %s: %w", config.Bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %s does not exist", config.Bucket)
+	}
+
+	prefix := strings.Trim(config.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &SS3Storage{client: client, bucket: config.Bucket, prefix: prefix}, nil
+}
+
+// The key of rel, folders are given a trailing slash by the caller
+func (s *SS3Storage) key(rel string) string {
+	return s.prefix + rel
+}
+
+// The prefix of every key inside dir
+func (s *SS3Storage) dirPrefix(dir string) string {
+	if dir == "" {
+		return s.prefix
+	}
+	return s.key(dir) + "/"
+}
+
+// Cleans rel, which must be safe, to the form keys use
+func s3Path(rel string) (string, error) {
+	err := CheckPath(rel)
+	if err != nil {
+		return "", err
+	}
+	rel = path.Clean(strings.ReplaceAll(rel, `\`, "/"))
+	if rel == "." {
+		return "", nil
+	}
+	return rel, nil
+}
+
+func notExist(op string, rel string) error {
+	return &fs.PathError{Op: op, Path: rel, Err: fs.ErrNotExist}
+}
+
+func isNoSuchKey(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+func (s *SS3Storage) Stat(rel string) (SObject, error) {
+	rel, err := s3Path(rel)
+	if err != nil {
+		return SObject{}, err
+	}
+	if rel == "" {
+		return SObject{IsDir: true}, nil
+	}
+	// Stops the listing below when it is left after the first object
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	info, err := s.client.StatObject(ctx, s.bucket, s.key(rel), minio.StatObjectOptions{})
+	if err == nil {
+		return s3Object(rel, info), nil
+	}
+	if !isNoSuchKey(err) {
+		return SObject{}, err
+	}
+
+	// Not a file, a folder if anything is kept below it
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.dirPrefix(rel), MaxKeys: 1}) {
+		if object.Err != nil {
+			return SObject{}, object.Err
+		}
+		return SObject{Path: rel, Name: path.Base(rel), IsDir: true}, nil
+	}
+	return SObject{}, notExist("stat", rel)
+}
+
+func (s *SS3Storage) List(dir string) ([]SObject, error) {
+	dir, err := s3Path(dir)
+	if err != nil {
+		return nil, err
+	}
+	folder, err := s.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !folder.IsDir {
+		return nil, ErrNotDirectory
+	}
+
+	prefix := s.dirPrefix(dir)
+	var objects []SObject
+	seen := make(map[string]bool)
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(object.Key, prefix), "/")
+		// Skips the marker of dir itself, and a folder listed both by its
+		// marker and by what it holds
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		if strings.HasSuffix(object.Key, "/") {
+			objects = append(objects, SObject{Path: path.Join(dir, name), Name: name, IsDir: true})
+			continue
+		}
+		objects = append(objects, s3Object(path.Join(dir, name), object))
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects, nil
+}
+
+func (s *SS3Storage) Walk(dir string, fn func(object SObject) error) error {
+	dir, err := s3Path(dir)
+	if err != nil {
+		return err
+	}
+
+	prefix := s.dirPrefix(dir)
+	seen := make(map[string]bool)
+	// Folders only show up in the keys below them, each is reported the first time
+	folder := func(rel string) error {
+		var missing []string
+		for p := rel; p != dir && p != "." && !seen[p]; p = path.Dir(p) {
+			seen[p] = true
+			missing = append([]string{p}, missing...)
+		}
+		for _, p := range missing {
+			err := fn(SObject{Path: p, Name: path.Base(p), IsDir: true})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// fn can stop the walk part way, the listing has to stop with it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		inner := strings.TrimPrefix(object.Key, prefix)
+		if inner == "" {
+			continue
+		}
+		rel := path.Join(dir, strings.TrimSuffix(inner, "/"))
+		if strings.HasSuffix(inner, "/") {
+			err = folder(rel)
+		} else {
+			err = folder(path.Dir(rel))
+			if err == nil {
+				err = fn(s3Object(rel, object))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SS3Storage) Open(rel string) (IReader, error) {
+	rel, err := s3Path(rel)
+	if err != nil {
+		return nil, err
+	}
+	object, err := s.client.GetObject(context.Background(), s.bucket, s.key(rel), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// Nothing is fetched until asked for, make sure there is something to fetch
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		if isNoSuchKey(err) {
+			return nil, notExist("open", rel)
+		}
+		return nil, err
+	}
+	return &SS3Reader{Object: object, storage: s, key: s.key(rel), size: info.Size}, nil
+}
+
+func (s *SS3Storage) Create(rel string) (IWriter, error) {
+	rel, err := s3Path(rel)
+	if err != nil {
+		return nil, err
+	}
+	if rel == "" {
+		return nil, ErrExists
+	}
+	err = s.checkFolder(path.Dir(rel))
+	if err != nil {
+		return nil, err
+	}
+
+	return &SS3Writer{storage: s, key: s.key(rel)}, nil
+}
+
+func (s *SS3Storage) Delete(rel string) error {
+	object, err := s.Stat(rel)
+	if err != nil {
+		return err
+	}
+	if object.IsDir {
+		return &fs.PathError{Op: "delete", Path: rel, Err: errors.New("is a folder")}
+	}
+	return s.client.RemoveObject(context.Background(), s.bucket, s.key(object.Path), minio.RemoveObjectOptions{})
+}
+
+// Moves by copying within the bucket then removing the originals, a folder
+// is moved key by key so a failure part way leaves it split between both
+func (s *SS3Storage) Move(from string, to string) error {
+	source, err := s.Stat(from)
+	if err != nil {
+		return err
+	}
+	to, err = s3Path(to)
+	if err != nil {
+		return err
+	}
+	if to == "" {
+		return ErrExists
+	}
+	_, err = s.Stat(to)
+	if err == nil {
+		return ErrExists
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	err = s.checkFolder(path.Dir(to))
+	if err != nil {
+		return err
+	}
+
+	if !source.IsDir {
+		return s.moveKey(s.key(source.Path), s.key(to), source.Size)
+	}
+	fromPrefix := s.dirPrefix(source.Path)
+	toPrefix := s.dirPrefix(to)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: fromPrefix, Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		err = s.moveKey(object.Key, toPrefix+strings.TrimPrefix(object.Key, fromPrefix), object.Size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies one key then removes it. A single copy is limited to 5GiB, larger
+// objects are copied a part at a time
+func (s *SS3Storage) moveKey(from string, to string, size int64) error {
+	ctx := context.Background()
+	dest := minio.CopyDestOptions{Bucket: s.bucket, Object: to}
+	source := minio.CopySrcOptions{Bucket: s.bucket, Object: from}
+	var err error
+	if size > s3MaxCopySize {
+		_, err = s.client.ComposeObject(ctx, dest, source)
+	} else {
+		_, err = s.client.CopyObject(ctx, dest, source)
+	}
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, from, minio.RemoveObjectOptions{})
+}
+
+func (s *SS3Storage) MakeDir(rel string) error {
+	rel, err := s3Path(rel)
+	if err != nil {
+		return err
+	}
+	_, err = s.Stat(rel)
+	if err == nil {
+		return ErrExists
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_, err = s.client.PutObject(context.Background(), s.bucket, s.dirPrefix(rel), bytes.NewReader(nil), 0, minio.PutObjectOptions{})
+	return err
+}
+
+func (s *SS3Storage) PresignGet(rel string, name string, expiry time.Duration) (string, error) {
+	rel, err := s3Path(rel)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	params.Set("response-content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	presigned, err := s.client.PresignedGetObject(context.Background(), s.bucket, s.key(rel), expiry, params)
+	if err != nil {
+		return "", err
+	}
+	return presigned.String(), nil
+}
+
+// Fails unless dir is an existing folder
+func (s *SS3Storage) checkFolder(dir string) error {
+	if dir == "." {
+		return nil
+	}
+	folder, err := s.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !folder.IsDir {
+		return ErrNotDirectory
+	}
+	return nil
+}
+
+// Listings give modification times to the millisecond but a stat only to the
+// second, they are cut to the second so both describe a file the same way
+func s3Object(rel string, info minio.ObjectInfo) SObject {
+	return SObject{
+		Path:    rel,
+		Name:    path.Base(rel),
+		Size:    info.Size,
+		ModTime: info.LastModified.Truncate(time.Second),
+	}
+}
+
+// SS3Reader is an object opened from S3, ranges are fetched as they are read.
+// The object's own ReadAt moves its read position, so ReadAt gets a stream of
+// its own that carries on for as long as reads follow on from each other
+type SS3Reader struct {
+	*minio.Object
+	storage  *SS3Storage
+	key      string
+	size     int64
+	mutex    sync.Mutex
+	ranged   io.ReadCloser
+	rangedAt int64
+}
+
+func (r *SS3Reader) Size() int64 {
+	return r.size
+}
+
+func (r *SS3Reader) ReadAt(p []byte, off int64) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if r.ranged == nil || off != r.rangedAt {
+		r.closeRanged()
+		opts := minio.GetObjectOptions{}
+		if off > 0 {
+			err := opts.SetRange(off, 0)
+			if err != nil {
+				return 0, err
+			}
+		}
+		object, err := r.storage.client.GetObject(context.Background(), r.storage.bucket, r.key, opts)
+		if err != nil {
+			return 0, err
+		}
+		r.ranged, r.rangedAt = object, off
+	}
+
+	n, err := io.ReadFull(r.ranged, p)
+	r.rangedAt += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	if err != nil {
+		r.closeRanged()
+	}
+	return n, err
+}
+
+func (r *SS3Reader) closeRanged() {
+	if r.ranged != nil {
+		r.ranged.Close()
+		r.ranged = nil
+	}
+}
+
+func (r *SS3Reader) Close() error {
+	r.mutex.Lock()
+	r.closeRanged()
+	r.mutex.Unlock()
+	return r.Object.Close()
+}
+
+// SS3Writer writes a new object to S3. Content that fits in one part is
+// buffered and sent in one request, anything larger is streamed up in parts
+// as it is written
+type SS3Writer struct {
+	storage *SS3Storage
+	key     string
+	buf     bytes.Buffer
+	pipe    *io.PipeWriter // Set once the content outgrows the buffer
+	done    chan error
+}
+
+func (w *SS3Writer) Write(p []byte) (int, error) {
+	if w.pipe == nil {
+		if w.buf.Len()+len(p) <= s3PartSize {
+			return w.buf.Write(p)
+		}
+		w.stream()
+	}
+	return w.pipe.Write(p)
+}
+
+// Starts a multipart upload of what was buffered followed by everything written after
+func (w *SS3Writer) stream() {
+	reader, writer := io.Pipe()
+	w.pipe = writer
+	w.done = make(chan error, 1)
+	go func() {
+		_, err := w.storage.client.PutObject(context.Background(), w.storage.bucket, w.key, io.MultiReader(&w.buf, reader), -1, minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+			PartSize:    s3PartSize,
+		})
+		// Unblocks the writer when the upload gives up early
+		reader.CloseWithError(err)
+		w.done <- err
+	}()
+}
+
+// Waits for the upload to finish
+func (w *SS3Writer) Close() error {
+	if w.pipe == nil {
+		_, err := w.storage.client.PutObject(context.Background(), w.storage.bucket, w.key, bytes.NewReader(w.buf.Bytes()), int64(w.buf.Len()), minio.PutObjectOptions{
+			ContentType: "application/octet-stream",
+		})
+		return err
+	}
+	w.pipe.Close()
+	return <-w.done
+}
+
+func (w *SS3Writer) Abort() {
+	if w.pipe == nil {
+		w.buf.Reset()
+		return
+	}
+	w.pipe.CloseWithError(errAborted)
+	<-w.done
+}
@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// SFakeS3 is an in-memory stand in for S3, answering just the requests
+// SS3Storage makes. Objects must stay under s3PartSize, multipart uploads are
+// not supported
+type SFakeS3 struct {
+	bucket  string
+	mutex   sync.Mutex
+	objects map[string]SFakeObject
+}
+
+type SFakeObject struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+// Starts a fake S3 with one empty bucket, stopped when the test ends
+func newFakeS3(t *testing.T, bucket string) *httptest.Server {
+	fake := &SFakeS3{bucket: bucket, objects: make(map[string]SFakeObject)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// A storage using a fresh fake S3, under prefix when it is set
+func newFakeS3Storage(t *testing.T, prefix string) *SS3Storage {
+	server := newFakeS3(t, "seclink")
+	store, err := NewS3Storage(SS3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Region:    "us-east-1",
+		Bucket:    "seclink",
+		Prefix:    prefix,
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatalf("could not connect to fake S3: %v", err)
+	}
+	return store
+}
+
+func (f *SFakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, r.URL.Query())
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		f.get(w, r, key)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.copy(w, r, key)
+	case r.Method == http.MethodPut:
+		f.put(w, r, key)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *SFakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *SFakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	object, ok := f.objects[key]
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	body := object.data
+	status := http.StatusOK
+	if spec := strings.TrimPrefix(r.Header.Get("Range"), "bytes="); spec != "" {
+		startText, endText, _ := strings.Cut(spec, "-")
+		start, err := strconv.ParseInt(startText, 10, 64)
+		end := int64(len(body)) - 1
+		if endText != "" {
+			end, _ = strconv.ParseInt(endText, 10, 64)
+		}
+		if err != nil || start >= int64(len(body)) {
+			f.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		end = min(end, int64(len(body))-1)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(body)))
+		body = body[start : end+1]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("ETag", object.etag)
+	w.Header().Set("Last-Modified", object.modTime.UTC().Format(http.TimeFormat))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
+
+func (f *SFakeS3) put(w http.ResponseWriter, r *http.Request, key string) {
+	var reader io.Reader = r.Body
+	// Over plain HTTP the client signs each chunk of the body
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		reader = newAwsChunkedReader(r.Body)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	object := f.store(key, data)
+	w.Header().Set("ETag", object.etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *SFakeS3) copy(w http.ResponseWriter, r *http.Request, key string) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	_, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	original, ok := f.objects[sourceKey]
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	object := f.store(key, original.data)
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>",
+		object.etag, object.modTime.UTC().Format(time.RFC3339))
+}
+
+func (f *SFakeS3) store(key string, data []byte) SFakeObject {
+	sum := md5.Sum(data)
+	object := SFakeObject{data: data, etag: `"` + hex.EncodeToString(sum[:]) + `"`, modTime: time.Now()}
+	f.objects[key] = object
+	return object
+}
+
+type SFakeListResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	KeyCount              int              `xml:"KeyCount"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	Contents              []SFakeListEntry `xml:"Contents"`
+	CommonPrefixes        []SFakePrefix    `xml:"CommonPrefixes"`
+}
+
+type SFakeListEntry struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type SFakePrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// Answers ListObjectsV2, pages continue after the last key or prefix returned
+func (f *SFakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	after := query.Get("continuation-token")
+	if after == "" {
+		after = query.Get("start-after")
+	}
+	maxKeys := 1000
+	if value := query.Get("max-keys"); value != "" {
+		maxKeys, _ = strconv.Atoi(value)
+	}
+
+	keys := make([]string, 0, len(f.objects))
+	for key := range f.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := SFakeListResult{Name: f.bucket, Prefix: prefix, MaxKeys: maxKeys, Delimiter: delimiter}
+	last := ""
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || (after != "" && key <= after) {
+			continue
+		}
+		// Everything below a prefix already returned was returned with it
+		if after != "" && delimiter != "" && strings.HasSuffix(after, delimiter) && strings.HasPrefix(key, after) {
+			continue
+		}
+
+		entry, common := key, false
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry, common = key[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if entry == last {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		last = entry
+		result.KeyCount++
+		if common {
+			result.CommonPrefixes = append(result.CommonPrefixes, SFakePrefix{Prefix: entry})
+			continue
+		}
+		object := f.objects[key]
+		result.Contents = append(result.Contents, SFakeListEntry{
+			Key:          key,
+			LastModified: object.modTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         object.etag,
+			Size:         len(object.data),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+// Reads the payload out of an aws-chunked body, each chunk is
+// "<hex size>;chunk-signature=<sig>\r\n<data>\r\n" and a 0 size one ends it
+func newAwsChunkedReader(body io.Reader) io.Reader {
+	reader, writer := io.Pipe()
+	go func() {
+		buffered := bufio.NewReader(body)
+		for {
+			header, err := buffered.ReadString('\n')
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+			sizeText, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+			size, err := strconv.ParseInt(sizeText, 16, 64)
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+			if size == 0 {
+				writer.Close()
+				return
+			}
+			_, err = io.CopyN(writer, buffered, size)
+			if err == nil {
+				_, err = buffered.Discard(2)
+			}
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return reader
+}
+
+// A second page of a listing must carry on where the first stopped
+func TestFakeS3Paging(t *testing.T) {
+	server := newFakeS3(t, "paging")
+	fake := server.Config.Handler.(*SFakeS3)
+	for _, key := range []string{"a", "b/x", "b/y", "c"} {
+		fake.store(key, nil)
+	}
+
+	var seen []string
+	token := ""
+	for {
+		query := url.Values{"prefix": {""}, "delimiter": {"/"}, "max-keys": {"1"}, "continuation-token": {token}}
+		recorder := httptest.NewRecorder()
+		fake.list(recorder, query)
+		var result SFakeListResult
+		err := xml.NewDecoder(bytes.NewReader(recorder.Body.Bytes())).Decode(&result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range result.Contents {
+			seen = append(seen, entry.Key)
+		}
+		for _, common := range result.CommonPrefixes {
+			seen = append(seen, common.Prefix)
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if strings.Join(seen, ",") != "a,b/,c" {
+		t.Fatalf("paged listing gave %v", seen)
+	}
+}
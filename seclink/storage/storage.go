@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Where shared files are kept, set by storage.backend
+const (
+	BackendLocal = "local" // A folder on disk, files under server.datapath
+	BackendS3    = "s3"    // A bucket on S3 or anything speaking its API, such as MinIO
+)
+
+var (
+	// Returned when a user supplied path would point outside the files directory
+	ErrUnsafePath = errors.New("path must be relative and stay inside the files directory")
+	// Returned when a folder operation is given a file
+	ErrNotDirectory = errors.New("path is not a folder")
+	// Returned when a file or folder is in the way of a move or a new folder
+	ErrExists = errors.New("a file or folder already exists at that path")
+)
+
+// SObject describes a file or folder in storage. Paths are relative to the
+// files directory with forward slashes, the root is empty
+type SObject struct {
+	Path    string
+	Name    string
+	Size    int64 // Bytes as stored, for an encrypted file more than its content
+	ModTime time.Time
+	IsDir   bool
+}
+
+// IReader reads a stored file. Reading is random access, so any range of the
+// file can be served by seeking or with ReadAt without fetching the rest
+type IReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Size() int64
+}
+
+// IWriter takes the content of a new file, it replaces whatever was at the
+// path once Close returns without error. Abort drops the file instead
+type IWriter interface {
+	io.WriteCloser
+	Abort()
+}
+
+// IStorage is where the files being shared live. Every path given to it is
+// relative to the files directory and is checked before anything is touched,
+// a path leaving the files directory fails with ErrUnsafePath. Missing files
+// and folders give errors matching fs.ErrNotExist
+type IStorage interface {
+	// The files and folders directly inside dir, sorted by name
+	List(dir string) ([]SObject, error)
+	// Calls fn for every file and folder below dir, folders before what they hold
+	Walk(dir string, fn func(object SObject) error) error
+	Stat(rel string) (SObject, error)
+	Open(rel string) (IReader, error)
+	// Starts writing a new file at rel, the folder holding it must exist
+	Create(rel string) (IWriter, error)
+	// Removes the file at rel, folders are not removed
+	Delete(rel string) error
+	// Moves a file or folder, nothing may exist at to and its folder must
+	Move(from string, to string) error
+	// Creates a folder along with any missing parents
+	MakeDir(rel string) error
+}
+
+// ILocalStorage is storage on the local disk, some things are done faster
+// when the file can be reached directly
+type ILocalStorage interface {
+	IStorage
+	// The checked absolute path of rel
+	LocalPath(rel string) (string, error)
+}
+
+// IPresigner hands out URLs clients can download a file from directly, so
+// the bytes do not pass through seclink
+type IPresigner interface {
+	// A URL downloading rel as an attachment called name, valid for expiry
+	PresignGet(rel string, name string, expiry time.Duration) (string, error)
+}
+
+// The storage configured by storage.backend
+func NewStorage() (IStorage, error) {
+	backend := viper.GetString("storage.backend")
+	switch backend {
+	case "", BackendLocal:
+		return NewLocalStorage(filepath.Join(viper.GetString("server.datapath"), "files")), nil
+	case BackendS3:
+		return NewS3Storage(SS3Config{
+			Endpoint:  viper.GetString("storage.s3.endpoint"),
+			Region:    viper.GetString("storage.s3.region"),
+			Bucket:    viper.GetString("storage.s3.bucket"),
+			Prefix:    viper.GetString("storage.s3.prefix"),
+			AccessKey: viper.GetString("storage.s3.accesskey"),
+			SecretKey: viper.GetString("storage.s3.secretkey"),
+			UseSSL:    viper.GetBool("storage.s3.usessl"),
+		})
+	}
+	return nil, fmt.Errorf("unknown storage.backend %q, use %s or %s", backend, BackendLocal, BackendS3)
+}
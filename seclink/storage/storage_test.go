@@ -0,0 +1,430 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+// Every backend must behave the same way as far as IStorage promises, so the
+// same checks run against each of them
+func TestStorageConformance(t *testing.T) {
+	backends := map[string]func(t *testing.T) IStorage{
+		"local": func(t *testing.T) IStorage {
+			return NewLocalStorage(t.TempDir())
+		},
+		"s3": func(t *testing.T) IStorage {
+			return newFakeS3Storage(t, "")
+		},
+		"s3-prefix": func(t *testing.T) IStorage {
+			return newFakeS3Storage(t, "files/")
+		},
+	}
+	tests := map[string]func(t *testing.T, store IStorage){
+		"read back":        testReadBack,
+		"replace":          testReplace,
+		"abort":            testAbort,
+		"list":             testList,
+		"walk":             testWalk,
+		"make dir":         testMakeDir,
+		"move file":        testMoveFile,
+		"move folder":      testMoveFolder,
+		"delete":           testDelete,
+		"missing":          testMissing,
+		"unsafe paths":     testUnsafePaths,
+		"create no folder": testCreateNoFolder,
+	}
+
+	for backend, newStorage := range backends {
+		t.Run(backend, func(t *testing.T) {
+			for name, test := range tests {
+				t.Run(name, func(t *testing.T) {
+					test(t, newStorage(t))
+				})
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, store IStorage, rel string, content []byte) {
+	t.Helper()
+	writer, err := store.Create(rel)
+	if err != nil {
+		t.Fatalf("create %s: %v", rel, err)
+	}
+	_, err = writer.Write(content)
+	if err != nil {
+		writer.Abort()
+		t.Fatalf("write %s: %v", rel, err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatalf("close %s: %v", rel, err)
+	}
+}
+
+func readFile(t *testing.T, store IStorage, rel string) []byte {
+	t.Helper()
+	reader, err := store.Open(rel)
+	if err != nil {
+		t.Fatalf("open %s: %v", rel, err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read %s: %v", rel, err)
+	}
+	return content
+}
+
+func mustMakeDir(t *testing.T, store IStorage, rel string) {
+	t.Helper()
+	err := store.MakeDir(rel)
+	if err != nil {
+		t.Fatalf("make dir %s: %v", rel, err)
+	}
+}
+
+func names(objects []SObject) string {
+	var list []string
+	for _, object := range objects {
+		name := object.Path
+		if object.IsDir {
+			name += "/"
+		}
+		list = append(list, name)
+	}
+	return strings.Join(list, ",")
+}
+
+func testReadBack(t *testing.T, store IStorage) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	writeFile(t, store, "file.bin", content)
+
+	object, err := store.Stat("file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.IsDir || object.Name != "file.bin" || object.Size != int64(len(content)) || object.ModTime.IsZero() {
+		t.Fatalf("unexpected stat %+v", object)
+	}
+
+	reader, err := store.Open("file.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if reader.Size() != int64(len(content)) {
+		t.Fatalf("size is %d, wanted %d", reader.Size(), len(content))
+	}
+
+	all, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(all, content) {
+		t.Fatalf("read gave %d bytes, err %v", len(all), err)
+	}
+
+	part := make([]byte, 25)
+	n, err := reader.ReadAt(part, 4995)
+	if err != nil || n != len(part) || !bytes.Equal(part, content[4995:5020]) {
+		t.Fatalf("ReadAt gave %q, err %v", part[:n], err)
+	}
+	// Reads that follow on and one running off the end
+	n, err = reader.ReadAt(part, 5020)
+	if err != nil || !bytes.Equal(part[:n], content[5020:5045]) {
+		t.Fatalf("following ReadAt gave %q, err %v", part[:n], err)
+	}
+	n, err = reader.ReadAt(part, int64(len(content)-10))
+	if err != io.EOF || n != 10 {
+		t.Fatalf("ReadAt at the end gave %d bytes, err %v", n, err)
+	}
+
+	_, err = reader.Seek(9990, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(tail, content[9990:]) {
+		t.Fatalf("read after seek gave %q, err %v", tail, err)
+	}
+}
+
+func testReplace(t *testing.T, store IStorage) {
+	writeFile(t, store, "file.txt", []byte("first version"))
+	writeFile(t, store, "file.txt", []byte("second"))
+	if content := readFile(t, store, "file.txt"); string(content) != "second" {
+		t.Fatalf("content is %q after replacing", content)
+	}
+}
+
+func testAbort(t *testing.T, store IStorage) {
+	writeFile(t, store, "keep.txt", []byte("original"))
+
+	writer, err := store.Create("keep.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writer.Write([]byte("partial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Abort()
+
+	if content := readFile(t, store, "keep.txt"); string(content) != "original" {
+		t.Fatalf("aborted write changed the file to %q", content)
+	}
+
+	writer, err = store.Create("new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Abort()
+	objects, err := store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(objects); got != "keep.txt" {
+		t.Fatalf("after aborting listing is %s", got)
+	}
+}
+
+func testList(t *testing.T, store IStorage) {
+	mustMakeDir(t, store, "b")
+	mustMakeDir(t, store, "empty")
+	writeFile(t, store, "c.txt", []byte("c"))
+	writeFile(t, store, "a.txt", []byte("a"))
+	writeFile(t, store, "b/inner.txt", []byte("inner"))
+
+	objects, err := store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(objects); got != "a.txt,b/,c.txt,empty/" {
+		t.Fatalf("root listing is %s", got)
+	}
+	if objects[0].Size != 1 {
+		t.Fatalf("listed size of a.txt is %d", objects[0].Size)
+	}
+	// File records are checked against either, they have to agree
+	object, err := store.Stat("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !object.ModTime.Equal(objects[0].ModTime) {
+		t.Fatalf("stat gives modification time %s, listing %s", object.ModTime, objects[0].ModTime)
+	}
+
+	objects, err = store.List("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(objects); got != "b/inner.txt" {
+		t.Fatalf("folder listing is %s", got)
+	}
+
+	objects, err = store.List("empty")
+	if err != nil || len(objects) != 0 {
+		t.Fatalf("empty folder listing is %s, err %v", names(objects), err)
+	}
+
+	_, err = store.List("a.txt")
+	if !errors.Is(err, ErrNotDirectory) {
+		t.Fatalf("listing a file gave %v", err)
+	}
+}
+
+func testWalk(t *testing.T, store IStorage) {
+	mustMakeDir(t, store, "top/middle")
+	mustMakeDir(t, store, "top/empty")
+	writeFile(t, store, "top/middle/deep.txt", []byte("deep"))
+	writeFile(t, store, "top/file.txt", []byte("file"))
+	writeFile(t, store, "outside.txt", []byte("outside"))
+
+	var walked []SObject
+	err := store.Walk("top", func(object SObject) error {
+		walked = append(walked, object)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, object := range walked {
+		if seen[object.Path] {
+			t.Fatalf("%s was walked twice", object.Path)
+		}
+		seen[object.Path] = true
+		// Folders come before anything inside them
+		for parent := object.Path; strings.Contains(parent, "/"); {
+			parent = parent[:strings.LastIndex(parent, "/")]
+			if parent != "top" && !seen[parent] {
+				t.Fatalf("%s was walked before its folder %s", object.Path, parent)
+			}
+		}
+	}
+	for _, want := range []string{"top/middle", "top/empty", "top/middle/deep.txt", "top/file.txt"} {
+		if !seen[want] {
+			t.Fatalf("walk missed %s, got %s", want, names(walked))
+		}
+	}
+	if len(walked) != 4 {
+		t.Fatalf("walk gave %s", names(walked))
+	}
+
+	// Returning an error stops the walk
+	stop := errors.New("stop")
+	calls := 0
+	err = store.Walk("", func(object SObject) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Fatalf("stopped walk gave %v after %d calls", err, calls)
+	}
+}
+
+func testMakeDir(t *testing.T, store IStorage) {
+	mustMakeDir(t, store, "one/two")
+
+	object, err := store.Stat("one")
+	if err != nil || !object.IsDir {
+		t.Fatalf("parent stat %+v, err %v", object, err)
+	}
+	object, err = store.Stat("one/two")
+	if err != nil || !object.IsDir || object.Name != "two" {
+		t.Fatalf("folder stat %+v, err %v", object, err)
+	}
+
+	err = store.MakeDir("one/two")
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("making an existing folder gave %v", err)
+	}
+	writeFile(t, store, "file.txt", nil)
+	err = store.MakeDir("file.txt")
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("making a folder over a file gave %v", err)
+	}
+}
+
+func testMoveFile(t *testing.T, store IStorage) {
+	mustMakeDir(t, store, "dest")
+	writeFile(t, store, "from.txt", []byte("moving"))
+	writeFile(t, store, "other.txt", []byte("other"))
+
+	err := store.Move("from.txt", "dest/to.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := readFile(t, store, "dest/to.txt"); string(content) != "moving" {
+		t.Fatalf("moved content is %q", content)
+	}
+	_, err = store.Stat("from.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("source still there after move, err %v", err)
+	}
+
+	err = store.Move("other.txt", "dest/to.txt")
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("moving onto a file gave %v", err)
+	}
+	err = store.Move("other.txt", "missing/to.txt")
+	if err == nil {
+		t.Fatal("moving into a missing folder worked")
+	}
+	err = store.Move("missing.txt", "dest/new.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("moving a missing file gave %v", err)
+	}
+}
+
+func testMoveFolder(t *testing.T, store IStorage) {
+	mustMakeDir(t, store, "from/sub")
+	writeFile(t, store, "from/a.txt", []byte("a"))
+	writeFile(t, store, "from/sub/b.txt", []byte("b"))
+
+	err := store.Move("from", "to")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content := readFile(t, store, "to/sub/b.txt"); string(content) != "b" {
+		t.Fatalf("moved content is %q", content)
+	}
+	objects, err := store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(objects); got != "to/" {
+		t.Fatalf("after moving the folder the root holds %s", got)
+	}
+	objects, err = store.List("to")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(objects); got != "to/a.txt,to/sub/" {
+		t.Fatalf("moved folder holds %s", got)
+	}
+}
+
+func testDelete(t *testing.T, store IStorage) {
+	mustMakeDir(t, store, "folder")
+	writeFile(t, store, "folder/file.txt", []byte("gone"))
+
+	err := store.Delete("folder")
+	if err == nil {
+		t.Fatal("deleting a folder worked")
+	}
+	err = store.Delete("folder/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Stat("folder/file.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("deleted file still there, err %v", err)
+	}
+	err = store.Delete("folder/file.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("deleting a missing file gave %v", err)
+	}
+}
+
+func testMissing(t *testing.T, store IStorage) {
+	_, err := store.Stat("missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat gave %v", err)
+	}
+	_, err = store.Open("missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("open gave %v", err)
+	}
+	_, err = store.List("missing")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("list gave %v", err)
+	}
+}
+
+func testUnsafePaths(t *testing.T, store IStorage) {
+	for _, rel := range []string{"../escape", "a/../../escape", "/etc/passwd", `..\escape`, "a\x00b"} {
+		_, err := store.Stat(rel)
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("stat %q gave %v", rel, err)
+		}
+		_, err = store.Create(rel)
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("create %q gave %v", rel, err)
+		}
+		err = store.MakeDir(rel)
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("make dir %q gave %v", rel, err)
+		}
+	}
+}
+
+func testCreateNoFolder(t *testing.T, store IStorage) {
+	_, err := store.Create("missing/file.txt")
+	if err == nil {
+		t.Fatal("creating in a missing folder worked")
+	}
+}